@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// SendFileToAll sends a file to every session, reading it from disk once.
+// A remote path puts it there below the incoming files directory of the
+// peers, like a synced file, otherwise it goes by its name.
+// Every chunk is written to all sessions in parallel, so the transfer goes
+// at the pace of the slowest peer. A failing session drops out without
+// stopping the others. The result holds an error for every failed session
+// and nil for the successful ones, peers refusing the file get a
+// *RejectedError and may take the next one.
+func SendFileToAll(sessions []*Session, name string, remote string, l func(i int, p int)) []error {
+	started := time.Now()
+	var size int64
+	if stat, err := os.Stat(name); err == nil {
+		size = stat.Size()
+	}
+	errs := sendFileToAll(sessions, name, remote, l)
+	for i, s := range sessions {
+		s.countFile(metricFilesSent, errs[i], size, started)
+	}
+	return errs
+}
+
+func sendFileToAll(sessions []*Session, name string, remote string, l func(i int, p int)) []error {
+	errs := make([]error, len(sessions))
+	fail := func(err error) []error {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+		return errs
+	}
+	// each runs f for every session still alive and reports if any is left.
+	each := func(f func(s *Session) error) bool {
+		var wg sync.WaitGroup
+		for i, s := range sessions {
+			if errs[i] != nil {
+				continue
+			}
+			wg.Add(1)
+			go func(i int, s *Session) {
+				defer wg.Done()
+				errs[i] = f(s)
+			}(i, s)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err == nil {
+				return true
+			}
+		}
+		return false
+	}
+
+	t, base := typeFile, filepath.Base(name)
+	if remote != "" {
+		t, base = typeSyncFile, remote
+	}
+	stat, err := os.Stat(name)
+	if assertError(err, "unable to get file info") {
+		return fail(err)
+	}
+	size := stat.Size()
+	meta := statMeta(name, stat)
+	if !each(func(s *Session) error {
+		// Every peer gets the same data, so none gets a delta.
+		if err := s.sendHeader(t, base, size, meta, 0); err != nil {
+			return err
+		}
+		_, err := s.readReply(base)
+		return err
+	}) {
+		return errs
+	}
+
+	file, err := os.Open(name)
+	if assertError(err, "unable to open file") {
+		return fail(err)
+	}
+	//noinspection GoUnhandledErrorResult
+	defer file.Close()
+	whole := sha256.New()
+	buffer := make([]byte, BufferSize)
+	var total int64 = 0
+	p := 0
+	for {
+		n, err := file.Read(buffer)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			assertError(err, "local file read error")
+			return fail(err)
+		}
+		total += int64(n)
+		chunk := buffer[:n]
+		whole.Write(chunk)
+		if !each(func(s *Session) error { return s.sendChunk(chunk) }) {
+			return errs
+		}
+		if int(100*total/size) != p {
+			p = int(100 * total / size)
+			for i := range sessions {
+				if errs[i] == nil {
+					l(i, p)
+				}
+			}
+		}
+	}
+	if total != size {
+		return fail(errors.New("file changed while sending"))
+	}
+	sum := whole.Sum(nil)
+	each(func(s *Session) error { return s.sendChunk(sum) })
+	return errs
+}
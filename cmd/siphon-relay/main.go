@@ -0,0 +1,168 @@
+// Command siphon-relay pairs two Siphon peers which can't reach each other
+// directly. Both peers dial out to the relay with the same rendezvous channel
+// and the relay splices their streams together. The traffic is end-to-end
+// encrypted by the peers, the relay never sees the rendezvous code itself.
+//
+// Usage:
+//
+//	siphon-relay -listen :3215 -timeout 10m
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	helloPrefix    = "SIPHON-RELAY 1 "
+	helloTimeout   = 10 * time.Second
+	channelHexSize = 64
+)
+
+type waiter struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	paired chan *waiter
+}
+
+type relay struct {
+	timeout    time.Duration
+	maxWaiting int
+
+	mu      sync.Mutex
+	waiting map[string]*waiter
+}
+
+func main() {
+	listen := flag.String("listen", ":3215", "address to accept peers on")
+	timeout := flag.Duration("timeout", 10*time.Minute, "how long a peer waits for its partner")
+	maxWaiting := flag.Int("max-waiting", 1000, "maximum number of peers waiting for a partner")
+	flag.Parse()
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatalln("unable to listen:", err)
+	}
+	log.Println("relay listening on", ln.Addr())
+
+	r := &relay{
+		timeout:    *timeout,
+		maxWaiting: *maxWaiting,
+		waiting:    make(map[string]*waiter),
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Fatalln("accepting failed:", err)
+		}
+		go r.handle(conn)
+	}
+}
+
+func (r *relay) handle(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	channel, err := readHello(conn, reader)
+	if err != nil {
+		log.Println(conn.RemoteAddr(), "bad hello:", err)
+		_ = conn.Close()
+		return
+	}
+	w := &waiter{conn: conn, reader: reader, paired: make(chan *waiter, 1)}
+
+	r.mu.Lock()
+	partner, ok := r.waiting[channel]
+	if ok {
+		delete(r.waiting, channel)
+	} else if len(r.waiting) >= r.maxWaiting {
+		r.mu.Unlock()
+		log.Println(conn.RemoteAddr(), "too many waiting peers, rejecting")
+		_ = conn.Close()
+		return
+	} else {
+		r.waiting[channel] = w
+	}
+	r.mu.Unlock()
+
+	if ok {
+		partner.paired <- w
+		return
+	}
+
+	log.Println(conn.RemoteAddr(), "waiting on channel", channel[:8])
+	select {
+	case other := <-w.paired:
+		log.Println(conn.RemoteAddr(), "paired with", other.conn.RemoteAddr())
+		splice(w, other)
+	case <-time.After(r.timeout):
+		r.mu.Lock()
+		if r.waiting[channel] == w {
+			delete(r.waiting, channel)
+		}
+		r.mu.Unlock()
+		select {
+		case other := <-w.paired:
+			// Paired right at the deadline.
+			splice(w, other)
+		default:
+			log.Println(conn.RemoteAddr(), "no partner, timed out")
+			_ = conn.Close()
+		}
+	}
+}
+
+func readHello(conn net.Conn, reader *bufio.Reader) (string, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(helloTimeout)); err != nil {
+		return "", err
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if err = conn.SetReadDeadline(time.Time{}); err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(line, helloPrefix) {
+		return "", errors.New("unknown protocol")
+	}
+	channel := strings.TrimSpace(strings.TrimPrefix(line, helloPrefix))
+	if _, err := hex.DecodeString(channel); err != nil || len(channel) != channelHexSize {
+		return "", errors.New("invalid channel")
+	}
+	return channel, nil
+}
+
+// splice tells both peers they are paired and copies their streams
+// into each other until either side disconnects.
+func splice(a *waiter, b *waiter) {
+	//noinspection GoUnhandledErrorResult
+	defer a.conn.Close()
+	//noinspection GoUnhandledErrorResult
+	defer b.conn.Close()
+	for _, w := range []*waiter{a, b} {
+		if _, err := io.WriteString(w.conn, "OK\n"); err != nil {
+			log.Println(w.conn.RemoteAddr(), "pairing failed:", err)
+			return
+		}
+	}
+	done := make(chan struct{}, 2)
+	pipe := func(dst *waiter, src *waiter) {
+		_, _ = io.Copy(dst.conn, src.reader)
+		if tcp, ok := dst.conn.(*net.TCPConn); ok {
+			_ = tcp.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go pipe(a, b)
+	go pipe(b, a)
+	<-done
+	<-done
+	log.Println(a.conn.RemoteAddr(), "and", b.conn.RemoteAddr(), "disconnected")
+}
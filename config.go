@@ -0,0 +1,500 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	configVersion  = 2
+	configDirName  = "siphon"
+	configFileName = "config.yml"
+	defaultPort    = "3214"
+
+	defaultMaxPeers = 4
+	maxMaxPeers     = 64
+
+	// maxRateLimit is 1 GiB/s in KiB/s.
+	maxRateLimit = 1 << 20
+)
+
+var config Config
+
+// configProblems collects issues found while loading the config, they are
+// shown to the user once the main window is up.
+var configProblems []string
+
+type Config struct {
+	Version int `yaml:"version"`
+	Client  struct {
+		Host     string    `yaml:"host"`
+		Port     string    `yaml:"port"`
+		Profiles []Profile `yaml:"profiles"`
+		Recent   []Profile `yaml:"recent"`
+	} `yaml:"client"`
+	Server struct {
+		Listen    bool   `yaml:"listen"`
+		Network   string `yaml:"network"`
+		Bind      string `yaml:"bind"`
+		Port      string `yaml:"port"`
+		MaxPeers  int    `yaml:"max_peers"`
+		MapPort   bool   `yaml:"map_port"`
+		Directory string `yaml:"directory"`
+		// Address is a transport address like unix:///run/siphon.sock
+		// listened on instead of the bind address and port.
+		Address string `yaml:"address,omitempty"`
+		// Secret is the pairing secret connecting peers must have.
+		Secret string `yaml:"secret,omitempty"`
+		// MaxFileSize and Quota are in MiB, zero means unlimited.
+		MaxFileSize int  `yaml:"max_file_size"`
+		Quota       int  `yaml:"session_quota"`
+		Preallocate bool `yaml:"preallocate"`
+		// Metadata of the sender applied to received files.
+		KeepModTime bool `yaml:"keep_mtime"`
+		KeepMode    bool `yaml:"keep_mode"`
+		KeepXattrs  bool `yaml:"keep_xattrs"`
+		// AllowDelete lets peers remove synced files.
+		AllowDelete bool `yaml:"allow_delete"`
+		// Delta patches existing files with the changed blocks only.
+		Delta bool `yaml:"delta"`
+	} `yaml:"server"`
+	Relay struct {
+		Address string `yaml:"address"`
+	} `yaml:"relay"`
+	// Web serves a page on the port letting browsers upload files while
+	// listening, Downloads offers them the queued files too.
+	Web struct {
+		Enabled   bool   `yaml:"enabled"`
+		Port      string `yaml:"port"`
+		Downloads bool   `yaml:"downloads"`
+	} `yaml:"web"`
+	// LocalSend exchanges files with LocalSend devices on the network,
+	// they see this one by the alias, the host name if empty.
+	LocalSend struct {
+		Enabled bool   `yaml:"enabled"`
+		Alias   string `yaml:"alias"`
+		Port    string `yaml:"port"`
+		HTTPS   bool   `yaml:"https"`
+	} `yaml:"localsend"`
+	// Watch sends files written to the directory to the profile.
+	Watch struct {
+		Directory string `yaml:"directory"`
+		Profile   string `yaml:"profile"`
+	} `yaml:"watch"`
+	// Hooks are shell commands run once a file or a session with received
+	// files is complete, Timeout is in seconds.
+	Hooks struct {
+		Received   string `yaml:"received"`
+		SessionEnd string `yaml:"session_end"`
+		Timeout    int    `yaml:"timeout"`
+	} `yaml:"hooks"`
+	// Routes pick the directory of received files, the first match wins.
+	Routes []Route `yaml:"routes"`
+	// Log goes to the file, an empty name turns it off. MaxSize is in MiB,
+	// Keep is the number of rotated files kept.
+	Log struct {
+		Level   string `yaml:"level"`
+		File    string `yaml:"file"`
+		MaxSize int    `yaml:"max_size"`
+		Keep    int    `yaml:"keep"`
+	} `yaml:"log"`
+	// Metrics are served in the Prometheus format on the address, if set.
+	Metrics struct {
+		Listen string `yaml:"listen"`
+	} `yaml:"metrics"`
+	// Control serves the control API on the socket, the default one
+	// if empty.
+	Control struct {
+		Enabled bool   `yaml:"enabled"`
+		Socket  string `yaml:"socket"`
+	} `yaml:"control"`
+	// Limits are in KiB/s, zero means unlimited.
+	Limits struct {
+		Upload       int `yaml:"upload"`
+		Download     int `yaml:"download"`
+		PeerUpload   int `yaml:"peer_upload"`
+		PeerDownload int `yaml:"peer_download"`
+	} `yaml:"limits"`
+}
+
+// configMigrations[i] upgrades a config of schema version i to version i+1.
+var configMigrations = []func(cfg *Config){
+	// 0 -> 1: unversioned config from the working directory,
+	// empty ports were treated as the default one.
+	func(cfg *Config) {
+		if cfg.Client.Port == "" {
+			cfg.Client.Port = defaultPort
+		}
+		if cfg.Server.Port == "" {
+			cfg.Server.Port = defaultPort
+		}
+	},
+	// 1 -> 2: the last used destination becomes the first recent connection.
+	func(cfg *Config) {
+		if cfg.Client.Host != "" {
+			cfg.Client.Recent = []Profile{{Host: cfg.Client.Host, Port: cfg.Client.Port}}
+		}
+	},
+}
+
+func defaultConfig() Config {
+	var cfg Config
+	cfg.Version = configVersion
+	cfg.Client.Host = ""
+	cfg.Client.Port = defaultPort
+	cfg.Server.Listen = false
+	cfg.Server.Network = NetworkDualStack
+	cfg.Server.Bind = ""
+	cfg.Server.Port = defaultPort
+	cfg.Server.MaxPeers = defaultMaxPeers
+	cfg.Server.Directory = defaultDirectory()
+	cfg.Server.KeepModTime = true
+	cfg.Server.KeepMode = true
+	cfg.Server.Delta = true
+	cfg.Web.Port = defaultWebPort
+	cfg.LocalSend.Port = defaultLocalSendPort
+	cfg.LocalSend.HTTPS = true
+	cfg.Hooks.Timeout = defaultHookTimeout
+	cfg.Log.Level = LevelInfo.String()
+	cfg.Log.File = defaultLogFile()
+	cfg.Log.MaxSize = defaultLogMaxSize
+	cfg.Log.Keep = defaultLogKeep
+	cfg.Control.Enabled = true
+	return cfg
+}
+
+func defaultDirectory() string {
+	ex, err := os.Executable()
+	if err != nil {
+		panic(err)
+	}
+	return filepath.Dir(ex)
+}
+
+// configPath returns $XDG_CONFIG_HOME/siphon/config.yml.
+func configPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, configDirName, configFileName), nil
+}
+
+func loadConfig() {
+	config = defaultConfig()
+	configProblems = nil
+
+	path, err := configPath()
+	if err != nil {
+		reportConfigProblem("unable to locate config directory: %v", err)
+		return
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		data, err = ioutil.ReadFile(configFileName)
+		if os.IsNotExist(err) {
+			logger.Info("no config file, using defaults")
+			return
+		}
+		if err == nil {
+			logger.Info("migrating config", "from", configFileName, "to", path)
+		}
+	}
+	if err != nil {
+		reportConfigProblem("unable to read config file: %v", err)
+		return
+	}
+
+	cfg, err := decodeConfig(data)
+	if err != nil {
+		backup := path + ".bak"
+		werr := os.MkdirAll(filepath.Dir(path), 0700)
+		if werr == nil {
+			werr = ioutil.WriteFile(backup, data, 0600)
+		}
+		if werr == nil {
+			reportConfigProblem("config file is malformed (%v), defaults are used, the old file is kept as %s", err, backup)
+		} else {
+			reportConfigProblem("config file is malformed (%v), defaults are used", err)
+		}
+		return
+	}
+
+	for _, problem := range validateConfig(&cfg) {
+		reportConfigProblem("%s", problem)
+	}
+	config = cfg
+
+	if cfg.Version != configVersion || !fileExists(path) {
+		config.Version = configVersion
+		if err := saveConfig(); err != nil {
+			reportConfigProblem("unable to save migrated config: %v", err)
+		}
+	}
+}
+
+func decodeConfig(data []byte) (Config, error) {
+	cfg := defaultConfig()
+	cfg.Version = 0
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.Version > configVersion {
+		return cfg, fmt.Errorf("unsupported config version %d", cfg.Version)
+	}
+	if cfg.Version < 0 {
+		return cfg, fmt.Errorf("invalid config version %d", cfg.Version)
+	}
+	for cfg.Version < configVersion {
+		configMigrations[cfg.Version](&cfg)
+		cfg.Version++
+	}
+	return cfg, nil
+}
+
+// validateConfig resets invalid fields to their defaults
+// and returns a description of every reset field.
+func validateConfig(cfg *Config) []string {
+	var problems []string
+	def := defaultConfig()
+	if err := validatePort(cfg.Client.Port); err != nil {
+		problems = append(problems, "client port: "+err.Error())
+		cfg.Client.Port = def.Client.Port
+	}
+	if err := validatePort(cfg.Server.Port); err != nil {
+		problems = append(problems, "server port: "+err.Error())
+		cfg.Server.Port = def.Server.Port
+	}
+	if err := validatePort(cfg.Web.Port); err != nil {
+		problems = append(problems, "upload page port: "+err.Error())
+		cfg.Web.Port = def.Web.Port
+	}
+	if err := validatePort(cfg.LocalSend.Port); err != nil {
+		problems = append(problems, "localsend port: "+err.Error())
+		cfg.LocalSend.Port = def.LocalSend.Port
+	}
+	if err := validateNetwork(cfg.Server.Network, cfg.Server.Bind); err != nil {
+		problems = append(problems, "listen address: "+err.Error())
+		cfg.Server.Network = def.Server.Network
+		cfg.Server.Bind = def.Server.Bind
+	}
+	if cfg.Server.Address != "" {
+		if err := validateTransportAddress(cfg.Server.Address); err != nil {
+			problems = append(problems, "listen address: "+err.Error())
+			cfg.Server.Address = def.Server.Address
+		}
+	}
+	if cfg.Server.MaxPeers < 1 || cfg.Server.MaxPeers > maxMaxPeers {
+		problems = append(problems, fmt.Sprintf("max peers: %d is out of range 1-%d", cfg.Server.MaxPeers, maxMaxPeers))
+		cfg.Server.MaxPeers = def.Server.MaxPeers
+	}
+	if err := validateRelay(cfg.Relay.Address); err != nil {
+		problems = append(problems, "relay address: "+err.Error())
+		cfg.Relay.Address = def.Relay.Address
+	}
+	if err := validateMetrics(cfg.Metrics.Listen); err != nil {
+		problems = append(problems, "metrics address: "+err.Error())
+		cfg.Metrics.Listen = def.Metrics.Listen
+	}
+	for _, limit := range []*int{&cfg.Limits.Upload, &cfg.Limits.Download, &cfg.Limits.PeerUpload, &cfg.Limits.PeerDownload} {
+		if *limit < 0 || *limit > maxRateLimit {
+			problems = append(problems, fmt.Sprintf("rate limit: %d KiB/s is out of range 0-%d", *limit, maxRateLimit))
+			*limit = 0
+		}
+	}
+	if cfg.Server.MaxFileSize < 0 {
+		problems = append(problems, fmt.Sprintf("max file size: %d MiB is negative", cfg.Server.MaxFileSize))
+		cfg.Server.MaxFileSize = 0
+	}
+	if cfg.Server.Quota < 0 {
+		problems = append(problems, fmt.Sprintf("session quota: %d MiB is negative", cfg.Server.Quota))
+		cfg.Server.Quota = 0
+	}
+	if cfg.Hooks.Timeout < 1 || cfg.Hooks.Timeout > maxHookTimeout {
+		problems = append(problems, fmt.Sprintf("hook timeout: %d seconds is out of range 1-%d", cfg.Hooks.Timeout, maxHookTimeout))
+		cfg.Hooks.Timeout = def.Hooks.Timeout
+	}
+	if _, err := parseLevel(cfg.Log.Level); err != nil {
+		problems = append(problems, "log level: "+err.Error())
+		cfg.Log.Level = def.Log.Level
+	}
+	if cfg.Log.MaxSize < 1 {
+		problems = append(problems, fmt.Sprintf("log file size: %d MiB is below 1", cfg.Log.MaxSize))
+		cfg.Log.MaxSize = def.Log.MaxSize
+	}
+	if cfg.Log.Keep < 0 {
+		problems = append(problems, fmt.Sprintf("kept log files: %d is negative", cfg.Log.Keep))
+		cfg.Log.Keep = def.Log.Keep
+	}
+	profiles := cfg.Client.Profiles[:0]
+	for _, p := range cfg.Client.Profiles {
+		if err := p.validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("profile %q is dropped: %v", p.Name, err))
+			continue
+		}
+		profiles = append(profiles, p)
+	}
+	cfg.Client.Profiles = profiles
+	routes := cfg.Routes[:0]
+	for _, r := range cfg.Routes {
+		if err := r.validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("routing rule %q is dropped: %v", r.Name, err))
+			continue
+		}
+		routes = append(routes, r)
+	}
+	cfg.Routes = routes
+	if err := validateWatch(cfg.Watch.Directory, cfg.Watch.Profile, cfg.Client.Profiles); err != nil {
+		problems = append(problems, "outbox: "+err.Error())
+		cfg.Watch.Directory = def.Watch.Directory
+	}
+	if err := validateDirectory(cfg.Server.Directory); err != nil {
+		problems = append(problems, "incoming files directory: "+err.Error())
+		cfg.Server.Directory = def.Server.Directory
+	}
+	return problems
+}
+
+func validatePort(port string) error {
+	p, err := strconv.Atoi(strings.TrimSpace(port))
+	if err != nil {
+		return fmt.Errorf("%q is not a number", port)
+	}
+	if p < 1 || p > 65535 {
+		return fmt.Errorf("%d is out of range 1-65535", p)
+	}
+	return nil
+}
+
+func validateRelay(address string) error {
+	if address == "" {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return errors.New("host is empty")
+	}
+	return validatePort(port)
+}
+
+func validateMetrics(address string) error {
+	if address == "" {
+		return nil
+	}
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	return validatePort(port)
+}
+
+func validateDirectory(dir string) error {
+	if dir == "" {
+		return errors.New("not specified")
+	}
+	stat, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	f, err := ioutil.TempFile(dir, ".siphon-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable", dir)
+	}
+	//noinspection GoUnhandledErrorResult
+	f.Close()
+	//noinspection GoUnhandledErrorResult
+	os.Remove(f.Name())
+	return nil
+}
+
+// validateWatch checks the outbox, an empty directory turns it off.
+func validateWatch(dir string, profile string, profiles []Profile) error {
+	if dir == "" {
+		return nil
+	}
+	if err := validateDirectory(dir); err != nil {
+		return err
+	}
+	for _, p := range profiles {
+		if p.Name == profile {
+			return nil
+		}
+	}
+	return fmt.Errorf("profile %q not found", profile)
+}
+
+func encodeConfig(cfg *Config) ([]byte, error) {
+	return yaml.Marshal(cfg)
+}
+
+func saveConfig() error {
+	data, err := encodeConfig(&config)
+	if err != nil {
+		return err
+	}
+	return writeConfig(data)
+}
+
+// writeConfig writes the encoded config to a temporary file next to the
+// target and renames it over, so a crash never leaves a truncated config
+// behind.
+func writeConfig(data []byte) error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "."+configFileName+"-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0600)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		//noinspection GoUnhandledErrorResult
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func reportConfigProblem(format string, a ...interface{}) {
+	problem := fmt.Sprintf(format, a...)
+	logger.Warn("config problem", "problem", problem)
+	configProblems = append(configProblems, problem)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// The control API lets scripts drive the running instance over a Unix
+// socket. Every line written to it is a JSON request like
+// {"id":1,"method":"queue","params":{"files":["/tmp/a.txt"]}}, answered by a
+// line like {"id":1,"result":...} or {"id":1,"error":"..."}. A connection
+// calling "subscribe" also gets a line for every change of the transfer list
+// like {"event":"progress","path":"0:1","progress":42}.
+
+const (
+	controlSocketName = "control.sock"
+	// maxControlRequest bounds the length of a request line.
+	maxControlRequest = 1 << 20
+	// controlEventBuffer is the number of events kept for a slow subscriber,
+	// newer ones are dropped once it is full.
+	controlEventBuffer = 256
+)
+
+type ControlRequest struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type ControlResponse struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Result interface{}     `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// ControlEvent is a row of the transfer list added or making progress,
+// the path is the position of the row like "2" or "2:0" for its first file.
+type ControlEvent struct {
+	Event    string `json:"event"`
+	Path     string `json:"path"`
+	Name     string `json:"name,omitempty"`
+	Size     string `json:"size,omitempty"`
+	Progress int    `json:"progress"`
+}
+
+const (
+	eventAdded    = "added"
+	eventProgress = "progress"
+)
+
+// ControlMethod handles a request, the result is encoded to JSON.
+type ControlMethod func(params json.RawMessage) (interface{}, error)
+
+var controlMu sync.Mutex
+var controlSubscribers = make(map[chan ControlEvent]bool)
+
+func subscribeControl() chan ControlEvent {
+	events := make(chan ControlEvent, controlEventBuffer)
+	controlMu.Lock()
+	controlSubscribers[events] = true
+	controlMu.Unlock()
+	return events
+}
+
+func unsubscribeControl(events chan ControlEvent) {
+	controlMu.Lock()
+	delete(controlSubscribers, events)
+	close(events)
+	controlMu.Unlock()
+}
+
+// publishControl passes the event to the subscribers without waiting for them.
+func publishControl(event ControlEvent) {
+	controlMu.Lock()
+	defer controlMu.Unlock()
+	for events := range controlSubscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// defaultControlSocket returns $XDG_RUNTIME_DIR/siphon/control.sock,
+// or a directory of the user in the temporary one without it.
+func defaultControlSocket() string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		return filepath.Join(os.TempDir(), configDirName+"-"+strconv.Itoa(os.Getuid()), controlSocketName)
+	}
+	return filepath.Join(dir, configDirName, controlSocketName)
+}
+
+// ControlServer serves the control API on a Unix socket.
+type ControlServer struct {
+	ln      net.Listener
+	path    string
+	methods map[string]ControlMethod
+	wg      sync.WaitGroup
+
+	mu     sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+}
+
+// StartControlServer listens on the socket, which only the user may access.
+// A socket left behind by a crashed instance is replaced.
+func StartControlServer(path string, methods map[string]ControlMethod) (*ControlServer, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		//noinspection GoUnhandledErrorResult
+		conn.Close()
+		return nil, errors.New("socket is in use by another instance")
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		//noinspection GoUnhandledErrorResult
+		ln.Close()
+		return nil, err
+	}
+	c := &ControlServer{ln: ln, path: path, methods: methods, conns: make(map[net.Conn]bool)}
+	c.wg.Add(1)
+	go c.serve()
+	logger.Info("serving control api", "socket", path)
+	return c, nil
+}
+
+func (c *ControlServer) serve() {
+	defer c.wg.Done()
+	for {
+		conn, err := c.ln.Accept()
+		if err != nil {
+			c.mu.Lock()
+			closed := c.closed
+			c.mu.Unlock()
+			if !closed {
+				logger.Error("control api failed", "error", err)
+			}
+			return
+		}
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			//noinspection GoUnhandledErrorResult
+			conn.Close()
+			return
+		}
+		c.conns[conn] = true
+		c.wg.Add(1)
+		c.mu.Unlock()
+		go c.handle(conn)
+	}
+}
+
+func (c *ControlServer) handle(conn net.Conn) {
+	var events chan ControlEvent
+	defer func() {
+		if events != nil {
+			unsubscribeControl(events)
+		}
+		c.mu.Lock()
+		delete(c.conns, conn)
+		c.mu.Unlock()
+		//noinspection GoUnhandledErrorResult
+		conn.Close()
+		c.wg.Done()
+	}()
+
+	// Events and responses are written by different goroutines.
+	var mu sync.Mutex
+	encoder := json.NewEncoder(conn)
+	send := func(v interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return encoder.Encode(v)
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), maxControlRequest)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var request ControlRequest
+		if err := json.Unmarshal(line, &request); err != nil {
+			if send(ControlResponse{Error: "malformed request: " + err.Error()}) != nil {
+				return
+			}
+			continue
+		}
+		response := ControlResponse{ID: request.ID}
+		if request.Method == "subscribe" {
+			if events == nil {
+				events = subscribeControl()
+				go func(events chan ControlEvent) {
+					for event := range events {
+						if send(event) != nil {
+							return
+						}
+					}
+				}(events)
+			}
+			response.Result = true
+		} else if method, ok := c.methods[request.Method]; ok {
+			result, err := method(request.Params)
+			if err != nil {
+				response.Error = err.Error()
+			} else {
+				response.Result = result
+			}
+		} else {
+			response.Error = fmt.Sprintf("unknown method %q", request.Method)
+		}
+		if send(response) != nil {
+			return
+		}
+	}
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if err := scanner.Err(); err != nil && !closed {
+		logger.Warn("control connection failed", "error", err)
+	}
+}
+
+// Close stops serving, drops the connections and removes the socket.
+func (c *ControlServer) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	err := c.ln.Close()
+	for conn := range c.conns {
+		//noinspection GoUnhandledErrorResult
+		conn.Close()
+	}
+	c.mu.Unlock()
+	c.wg.Wait()
+	if rerr := os.Remove(c.path); err == nil && !os.IsNotExist(rerr) {
+		err = rerr
+	}
+	return err
+}
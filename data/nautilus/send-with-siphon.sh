@@ -0,0 +1,3 @@
+#!/bin/sh
+# Nautilus script handing the selected files and folders to Siphon.
+exec siphon --send "$@"
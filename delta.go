@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// Delta transfer, like rsync: the receiver sends a signature of the blocks
+// of its copy, the sender answers with literal data and references to the
+// blocks it already has. The receiver builds the new file next to its copy
+// and replaces the copy only once the checksum matches, so a failed
+// transfer leaves it as it was.
+const (
+	// deltaMinSize is the smallest existing copy worth a signature.
+	deltaMinSize  = 1 << 20
+	deltaMinBlock = 2048
+	deltaMaxBlock = 128 << 10
+	// deltaMaxBlocks bounds the signature a peer may send, larger copies
+	// are sent whole.
+	deltaMaxBlocks = 1 << 20
+	deltaMaxSize   = deltaMaxBlocks * deltaMaxBlock
+	// deltaMaxLiteral bounds the literal data sent in one operation.
+	deltaMaxLiteral = 64 << 10
+	strongSize      = 16
+
+	opLiteral byte = 0
+	opCopy    byte = 1
+	opEnd     byte = 2
+)
+
+// blockSignature identifies a block by a rolling checksum, cheap to
+// compute at every offset, and a strong one to confirm a match.
+type blockSignature struct {
+	Weak   uint32
+	Strong [strongSize]byte
+}
+
+type deltaSignature struct {
+	Size      int64
+	BlockSize int
+	Blocks    []blockSignature
+}
+
+// blockLen returns the length of the block, the last one may be shorter.
+func (sig *deltaSignature) blockLen(i int) int {
+	if rest := sig.Size - int64(i)*int64(sig.BlockSize); rest < int64(sig.BlockSize) {
+		return int(rest)
+	}
+	return sig.BlockSize
+}
+
+// deltaBlockSize grows with the square root of the size like rsync does.
+func deltaBlockSize(size int64) int {
+	b := int(math.Sqrt(float64(size))) &^ 1023
+	if b < deltaMinBlock {
+		return deltaMinBlock
+	}
+	if b > deltaMaxBlock {
+		return deltaMaxBlock
+	}
+	return b
+}
+
+// rollingSum is the checksum of rsync, a and b are sums modulo 2^16.
+type rollingSum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRollingSum(block []byte) rollingSum {
+	r := rollingSum{n: uint32(len(block))}
+	for i, c := range block {
+		r.a += uint32(c)
+		r.b += uint32(len(block)-i) * uint32(c)
+	}
+	return r
+}
+
+// roll moves the window by one byte.
+func (r *rollingSum) roll(out byte, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.n*uint32(out)
+}
+
+func (r rollingSum) sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+func strongSum(block []byte) [strongSize]byte {
+	var strong [strongSize]byte
+	sum := sha256.Sum256(block)
+	copy(strong[:], sum[:])
+	return strong
+}
+
+// signFile computes the signature of the existing copy.
+func signFile(file *os.File, size int64) (*deltaSignature, error) {
+	sig := &deltaSignature{Size: size, BlockSize: deltaBlockSize(size)}
+	reader := bufio.NewReaderSize(io.NewSectionReader(file, 0, size), BufferSize)
+	block := make([]byte, sig.BlockSize)
+	for {
+		n, err := io.ReadFull(reader, block)
+		if n > 0 {
+			sig.Blocks = append(sig.Blocks, blockSignature{
+				Weak:   newRollingSum(block[:n]).sum(),
+				Strong: strongSum(block[:n]),
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (s *Session) sendSignature(sig *deltaSignature) error {
+	fields := []interface{}{sig.Size, uint32(sig.BlockSize), uint32(len(sig.Blocks))}
+	for _, field := range fields {
+		if err := binary.Write(s.writer, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	for _, block := range sig.Blocks {
+		if err := binary.Write(s.writer, binary.LittleEndian, block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Session) readSignature() (*deltaSignature, error) {
+	sig := &deltaSignature{}
+	var blockSize, count uint32
+	for _, field := range []interface{}{&sig.Size, &blockSize, &count} {
+		if err := binary.Read(s.reader, binary.LittleEndian, field); err != nil {
+			return nil, err
+		}
+	}
+	sig.BlockSize = int(blockSize)
+	if sig.Size < 0 || blockSize < deltaMinBlock || blockSize > deltaMaxBlock || count > deltaMaxBlocks ||
+		int64(count) != (sig.Size+int64(blockSize)-1)/int64(blockSize) {
+		return nil, errors.New("invalid signature")
+	}
+	sig.Blocks = make([]blockSignature, count)
+	for i := range sig.Blocks {
+		if err := binary.Read(s.reader, binary.LittleEndian, &sig.Blocks[i]); err != nil {
+			return nil, err
+		}
+	}
+	return sig, nil
+}
+
+// sendDelta streams the file as operations against the signature and
+// ends with the checksum of the whole file.
+func (s *Session) sendDelta(file io.Reader, size int64, sig *deltaSignature, l func(p int)) error {
+	index := make(map[uint32][]int)
+	for i, block := range sig.Blocks {
+		index[block.Weak] = append(index[block.Weak], i)
+	}
+	whole := sha256.New()
+	reader := bufio.NewReaderSize(io.TeeReader(file, whole), BufferSize)
+	bs := sig.BlockSize
+	lastLen := sig.blockLen(len(sig.Blocks) - 1)
+
+	// window holds the data from the current offset on, at least one
+	// byte more than a block unless the file ends.
+	window := make([]byte, 0, 2*bs+BufferSize)
+	start := 0
+	eof := false
+	fill := func() error {
+		if eof || len(window)-start > bs {
+			return nil
+		}
+		window = append(window[:0], window[start:]...)
+		start = 0
+		for len(window) <= bs && !eof {
+			n, err := reader.Read(window[len(window):cap(window)])
+			window = window[:len(window)+n]
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var literal []byte
+	var out int64 // offset of the next byte of the new file
+	p := 0
+	progress := func() {
+		if size > 0 && int(100*out/size) != p {
+			p = int(100 * out / size)
+			l(p)
+		}
+	}
+	flush := func() error {
+		if len(literal) == 0 {
+			return nil
+		}
+		out += int64(len(literal))
+		if err := s.writeOp(opLiteral, uint32(len(literal)), literal); err != nil {
+			return err
+		}
+		literal = literal[:0]
+		return nil
+	}
+	// match finds a block equal to the window.
+	match := func(weak uint32, data []byte) int {
+		candidates := index[weak]
+		if len(candidates) == 0 {
+			return -1
+		}
+		strong := strongSum(data)
+		for _, i := range candidates {
+			if sig.blockLen(i) == len(data) && sig.Blocks[i].Strong == strong {
+				return i
+			}
+		}
+		return -1
+	}
+
+	var rolling rollingSum
+	rolled := false
+	for {
+		if err := fill(); err != nil {
+			return err
+		}
+		n := len(window) - start
+		if n == 0 {
+			break
+		}
+		if n > bs {
+			n = bs
+		}
+		// Only the last block may be shorter, the rest of the tail can't match.
+		matchable := n == bs || n == lastLen
+		if matchable && !rolled {
+			rolling = newRollingSum(window[start : start+n])
+			rolled = true
+		}
+		i := -1
+		if matchable {
+			i = match(rolling.sum(), window[start:start+n])
+		}
+		if i >= 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+			if err := s.writeOp(opCopy, uint32(i), nil); err != nil {
+				return err
+			}
+			out += int64(n)
+			start += n
+			rolled = false
+			progress()
+			continue
+		}
+		literal = append(literal, window[start])
+		if n == bs && len(window)-start > bs {
+			rolling.roll(window[start], window[start+bs])
+		} else {
+			rolled = false
+		}
+		start++
+		if len(literal) == deltaMaxLiteral {
+			if err := flush(); err != nil {
+				return err
+			}
+			progress()
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	if out != size {
+		return errors.New("file changed while sending")
+	}
+	if err := s.writeOp(opEnd, 0, whole.Sum(nil)); err != nil {
+		return err
+	}
+	err := s.writer.Flush()
+	if s.assertError(err, "delta flushing error") {
+		return err
+	}
+	return nil
+}
+
+func (s *Session) writeOp(op byte, arg uint32, data []byte) error {
+	err := s.writer.WriteByte(op)
+	if err == nil && op != opEnd {
+		err = binary.Write(s.writer, binary.LittleEndian, arg)
+	}
+	if err == nil {
+		_, err = s.writer.Write(data)
+	}
+	s.assertError(err, "delta sending failed")
+	return err
+}
+
+// receiveDelta writes the new file from the delta and the blocks of the
+// existing copy and returns the checksum announced by the sender and the
+// one of the written data.
+func (s *Session) receiveDelta(file *os.File, size int64, patch *deltaPatch, pl func(p int)) ([]byte, []byte, error) {
+	sig := patch.sig
+	writer := &hashingWriter{Writer: file, hash: sha256.New()}
+	buffer := make([]byte, deltaMaxLiteral)
+	block := make([]byte, sig.BlockSize)
+	var out int64
+	p := 0
+	for {
+		op, err := s.reader.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		if op == opEnd {
+			break
+		}
+		var arg uint32
+		if err = binary.Read(s.reader, binary.LittleEndian, &arg); err != nil {
+			return nil, nil, err
+		}
+		var data []byte
+		switch op {
+		case opLiteral:
+			if arg > deltaMaxLiteral {
+				return nil, nil, errors.New("literal is too long")
+			}
+			data = buffer[:arg]
+			if _, err = io.ReadFull(s.reader, data); err != nil {
+				return nil, nil, err
+			}
+		case opCopy:
+			i := int(arg)
+			if i >= len(sig.Blocks) {
+				return nil, nil, errors.New("invalid block reference")
+			}
+			data = block[:sig.blockLen(i)]
+			if _, err = patch.base.ReadAt(data, int64(i)*int64(sig.BlockSize)); err != nil {
+				return nil, nil, err
+			}
+		default:
+			return nil, nil, errors.New("invalid delta operation")
+		}
+		if out+int64(len(data)) > size {
+			return nil, nil, errors.New("delta exceeds the file size")
+		}
+		if _, err = writer.Write(data); err != nil {
+			return nil, nil, err
+		}
+		out += int64(len(data))
+		if size > 0 && int(100*out/size) != p {
+			p = int(100 * out / size)
+			pl(p)
+		}
+	}
+	expected := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(s.reader, expected); err != nil {
+		return nil, nil, err
+	}
+	if out != size {
+		return nil, nil, errors.New("delta doesn't match the file size")
+	}
+	return expected, writer.hash.Sum(nil), nil
+}
+
+// deltaPatch is an existing copy the new file is built from, in a
+// temporary file next to it.
+type deltaPatch struct {
+	base   *os.File
+	sig    *deltaSignature
+	target string
+}
+
+// newDeltaPatch signs the existing copy and creates the temporary file,
+// with the permissions of the copy.
+func newDeltaPatch(target string, existing int64) (*os.File, *deltaPatch, error) {
+	base, err := os.Open(target)
+	if err != nil {
+		return nil, nil, err
+	}
+	fail := func(err error) (*os.File, *deltaPatch, error) {
+		//noinspection GoUnhandledErrorResult
+		base.Close()
+		return nil, nil, err
+	}
+	stat, err := base.Stat()
+	if err != nil {
+		return fail(err)
+	}
+	sig, err := signFile(base, existing)
+	if err != nil {
+		return fail(err)
+	}
+	dir, name := filepath.Split(target)
+	file, err := os.CreateTemp(dir, "."+name+".*.part")
+	if err != nil {
+		return fail(err)
+	}
+	patch := &deltaPatch{base: base, sig: sig, target: target}
+	if err = file.Chmod(stat.Mode().Perm()); err != nil {
+		patch.discard(file)
+		return nil, nil, err
+	}
+	return file, patch, nil
+}
+
+// discard removes the temporary file, the copy stays as it was.
+func (p *deltaPatch) discard(file *os.File) {
+	//noinspection GoUnhandledErrorResult
+	file.Close()
+	//noinspection GoUnhandledErrorResult
+	os.Remove(file.Name())
+	//noinspection GoUnhandledErrorResult
+	p.base.Close()
+}
+
+// commit replaces the copy with the complete temporary file.
+func (p *deltaPatch) commit(file *os.File) error {
+	//noinspection GoUnhandledErrorResult
+	p.base.Close()
+	err := file.Close()
+	if err == nil {
+		err = os.Rename(file.Name(), p.target)
+	}
+	if err != nil {
+		//noinspection GoUnhandledErrorResult
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// hashingWriter passes the data on and keeps its checksum.
+type hashingWriter struct {
+	io.Writer
+	hash hash.Hash
+}
+
+func (w *hashingWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	w.hash.Write(b[:n])
+	return n, err
+}
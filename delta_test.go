@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func randomData(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestRollingSum(t *testing.T) {
+	data := randomData(1, 10000)
+	const n = deltaMinBlock
+	r := newRollingSum(data[:n])
+	for i := 1; i+n <= len(data); i++ {
+		r.roll(data[i-1], data[i+n-1])
+		if want := newRollingSum(data[i : i+n]).sum(); r.sum() != want {
+			t.Fatalf("rolled sum at %d = %08x, want %08x", i, r.sum(), want)
+		}
+	}
+}
+
+// deltaSessions returns a sender writing into the buffer and a receiver
+// reading from it.
+func deltaSessions(buf *bytes.Buffer) (*Session, *Session) {
+	sender := &Session{log: logger, writer: bufio.NewWriter(buf)}
+	receiver := &Session{log: logger, reader: bufio.NewReader(buf)}
+	return sender, receiver
+}
+
+// editedData inserts, changes and removes data of the old one.
+func editedData(old []byte) []byte {
+	var edited []byte
+	edited = append(edited, []byte("inserted at the start")...)
+	edited = append(edited, old[:len(old)/2]...)
+	edited = append(edited, randomData(2, 5000)...)
+	edited = append(edited, old[len(old)/2+5000:len(old)-3000]...)
+	return edited
+}
+
+func writeTarget(t *testing.T, data []byte) string {
+	target := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(target, data, 0640); err != nil {
+		t.Fatal(err)
+	}
+	return target
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	old := randomData(3, 3<<20)
+	edited := editedData(old)
+	target := writeTarget(t, old)
+
+	file, patch, err := newDeltaPatch(target, int64(len(old)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	sender, receiver := deltaSessions(&buf)
+	if err = sender.sendDelta(bytes.NewReader(edited), int64(len(edited)), patch.sig, func(int) {}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() > len(edited)/10 {
+		t.Errorf("delta of %d bytes for a file of %d", buf.Len(), len(edited))
+	}
+	expected, actual, err := receiver.receiveDelta(file, int64(len(edited)), patch, func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expected, actual) {
+		t.Fatal("checksum mismatch")
+	}
+	if err = patch.commit(file); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, edited) {
+		t.Error("patched file differs from the sent one")
+	}
+	stat, err := os.Stat(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode().Perm() != 0640 {
+		t.Errorf("patched file mode is %o, want 640", stat.Mode().Perm())
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(target)); len(entries) != 1 {
+		t.Errorf("%d files left in the directory, want 1", len(entries))
+	}
+}
+
+func TestDeltaInterruptedKeepsCopy(t *testing.T) {
+	old := randomData(4, 2<<20)
+	edited := editedData(old)
+	target := writeTarget(t, old)
+
+	file, patch, err := newDeltaPatch(target, int64(len(old)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	sender, _ := deltaSessions(&buf)
+	if err = sender.sendDelta(bytes.NewReader(edited), int64(len(edited)), patch.sig, func(int) {}); err != nil {
+		t.Fatal(err)
+	}
+	buf.Truncate(buf.Len() / 2)
+	receiver := &Session{log: logger, reader: bufio.NewReader(&buf)}
+	if _, _, err = receiver.receiveDelta(file, int64(len(edited)), patch, func(int) {}); err == nil {
+		t.Fatal("truncated delta was received")
+	}
+	discardFile(file, patch)
+	got, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, old) {
+		t.Error("existing copy was changed")
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(target)); len(entries) != 1 {
+		t.Errorf("%d files left in the directory, want 1", len(entries))
+	}
+}
+
+func TestReadSignatureLimit(t *testing.T) {
+	var buf bytes.Buffer
+	count := uint32(deltaMaxBlocks + 1)
+	size := int64(count) * deltaMaxBlock
+	for _, field := range []interface{}{size, uint32(deltaMaxBlock), count} {
+		if err := binary.Write(&buf, binary.LittleEndian, field); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &Session{log: logger, reader: bufio.NewReader(&buf)}
+	if _, err := s.readSignature(); err == nil {
+		t.Error("signature with too many blocks was accepted")
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"syscall"
+)
+
+var errNoSpace error = syscall.ENOSPC
+
+// freeSpace returns the bytes available to unprivileged users in the directory.
+func freeSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// preallocate reserves the disk blocks for the whole file up front.
+func preallocate(file *os.File, size int64) error {
+	return syscall.Fallocate(int(file.Fd()), 0, 0, size)
+}
+
+// readXattrs returns the extended attributes of the user namespace,
+// the others need privileges on the receiver.
+func readXattrs(name string) (map[string][]byte, error) {
+	size, err := syscall.Listxattr(name, nil)
+	if err != nil || size == 0 {
+		return nil, ignoreNotSupported(err)
+	}
+	list := make([]byte, size)
+	if size, err = syscall.Listxattr(name, list); err != nil {
+		return nil, ignoreNotSupported(err)
+	}
+	xattrs := make(map[string][]byte)
+	for _, key := range bytes.Split(list[:size], []byte{0}) {
+		if !strings.HasPrefix(string(key), "user.") {
+			continue
+		}
+		size, err := syscall.Getxattr(name, string(key), nil)
+		if err != nil {
+			return xattrs, err
+		}
+		value := make([]byte, size)
+		if size, err = syscall.Getxattr(name, string(key), value); err != nil {
+			return xattrs, err
+		}
+		xattrs[string(key)] = value[:size]
+	}
+	return xattrs, nil
+}
+
+func writeXattrs(name string, xattrs map[string][]byte) error {
+	for key, value := range xattrs {
+		if !strings.HasPrefix(key, "user.") {
+			continue
+		}
+		if err := syscall.Setxattr(name, key, value, 0); err != nil {
+			return ignoreNotSupported(err)
+		}
+	}
+	return nil
+}
+
+// ignoreNotSupported hides the error of file systems without xattrs.
+func ignoreNotSupported(err error) error {
+	if err == syscall.ENOTSUP {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoSpace = errors.New("no space left on device")
+
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.New("free space is unknown on this platform")
+}
+
+// preallocate only sets the size, the blocks are allocated on write.
+func preallocate(file *os.File, size int64) error {
+	return file.Truncate(size)
+}
+
+func readXattrs(name string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func writeXattrs(name string, xattrs map[string][]byte) error {
+	return nil
+}
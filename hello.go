@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// The connecting peer starts a session with a hello, the accepting one
+// answers with its own. A hello is the magic and the protocol version.
+// Peers of the first version, without replies to file headers, metadata,
+// flags and checksums, send no hello and start with an event right away,
+// they are refused.
+//
+// With matching versions the hello goes on with the identity key of each
+// peer, a random nonce and an ephemeral X25519 key. The accepting peer
+// signs all of them, and from then on both peers encrypt the session with
+// keys of the exchange. The connecting peer answers with its signature and
+// a proof of the pairing secret, and the accepting one tells if it takes
+// the session. Neither the secret nor the events are seen by someone
+// listening in, and a party in the middle can't alter them without the
+// key of the accepting peer.
+const (
+	helloMagic = "SIPHON"
+	// protocolVersion changes with every change of the framing.
+	protocolVersion byte = 4
+	helloNonceSize       = 32
+	helloShareSize       = 32
+	// maxHelloReason bounds the reason of a refused session.
+	maxHelloReason = 1024
+)
+
+var errLegacyPeer = errors.New("peer runs a version of siphon without protocol versions, it needs to be updated")
+
+// VersionError is a peer speaking another protocol version.
+type VersionError struct {
+	Version byte
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("peer speaks protocol version %d, this one speaks %d", e.Version, protocolVersion)
+}
+
+// Pairing is what a session asks of the peer at the hello.
+type Pairing struct {
+	// Secret is shared by both peers, an accepting peer with a secret
+	// refuses those without it.
+	Secret string
+	// Key is the fingerprint of the identity the accepting peer must
+	// have, any is taken when it is empty.
+	Key string
+}
+
+// helloState is what both peers sign, the keys, nonces and ephemeral keys
+// of the connecting and the accepting peer.
+type helloState struct {
+	dialerKey, acceptorKey     ed25519.PublicKey
+	dialerNonce, acceptorNonce []byte
+	dialerShare, acceptorShare []byte
+	// ephemeral is the private key of this peer's share.
+	ephemeral *ecdh.PrivateKey
+}
+
+// newHelloState picks the nonce and ephemeral key of this peer.
+func newHelloState() (*helloState, []byte, []byte, error) {
+	nonce := make([]byte, helloNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, nil, err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return &helloState{ephemeral: ephemeral}, nonce, ephemeral.PublicKey().Bytes(), nil
+}
+
+// transcript binds a signature or proof to the session and its purpose.
+func (h *helloState) transcript(purpose string) []byte {
+	var b bytes.Buffer
+	b.WriteString(helloMagic + " " + purpose)
+	b.Write(h.dialerKey)
+	b.Write(h.dialerNonce)
+	b.Write(h.dialerShare)
+	b.Write(h.acceptorKey)
+	b.Write(h.acceptorNonce)
+	b.Write(h.acceptorShare)
+	return b.Bytes()
+}
+
+// sessionKeys agrees on the keys of the session with the share of the
+// peer, role is the side of this peer.
+func (h *helloState) sessionKeys(role string) (*sessionKeys, error) {
+	peer, peerRole := h.acceptorShare, "acceptor"
+	if role == "acceptor" {
+		peer, peerRole = h.dialerShare, "dialer"
+	}
+	pub, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return nil, errors.New("invalid peer share")
+	}
+	shared, err := h.ephemeral.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, shared)
+	mac.Write(h.transcript("session"))
+	return &sessionKeys{master: mac.Sum(nil), role: role, peerRole: peerRole}, nil
+}
+
+func (h *helloState) proof(secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(h.transcript("pairing"))
+	return mac.Sum(nil)
+}
+
+// Hello introduces the session to the accepting peer and checks its
+// answer, it is the first thing a connecting peer does.
+func (s *Session) Hello(pairing Pairing) error {
+	err := s.hello(pairing)
+	s.helloFailed(err)
+	return err
+}
+
+func (s *Session) hello(pairing Pairing) error {
+	key := localIdentity()
+	h, nonce, share, err := newHelloState()
+	if err != nil {
+		return err
+	}
+	h.dialerKey, h.dialerNonce, h.dialerShare = key.Public().(ed25519.PublicKey), nonce, share
+	if err = s.openEvent(); err != nil {
+		return err
+	}
+	s.writeHello(h.dialerKey, h.dialerNonce, h.dialerShare)
+	if err = s.writer.Flush(); err != nil {
+		return err
+	}
+	if err = s.readVersion(); err != nil {
+		return err
+	}
+	if h.acceptorKey, h.acceptorNonce, h.acceptorShare, err = s.readIdentity(); err != nil {
+		return err
+	}
+	signature := make([]byte, ed25519.SignatureSize)
+	if _, err = io.ReadFull(s.reader, signature); err != nil {
+		return err
+	}
+	if !ed25519.Verify(h.acceptorKey, h.transcript("acceptor"), signature) {
+		return errors.New("peer signature doesn't match its key")
+	}
+	s.peerKey = Fingerprint(h.acceptorKey)
+	if pairing.Key != "" {
+		pinned, err := normalizeFingerprint(pairing.Key)
+		if err != nil {
+			return err
+		}
+		if pinned != s.peerKey {
+			return fmt.Errorf("peer key %s doesn't match the pinned key %s", s.peerKey, pinned)
+		}
+	}
+	if err = s.secure(h, "dialer"); err != nil {
+		return err
+	}
+	_, _ = s.writer.Write(ed25519.Sign(key, h.transcript("dialer")))
+	_, _ = s.writer.Write(h.proof(pairing.Secret))
+	if err = s.writer.Flush(); err != nil {
+		return err
+	}
+	reply, err := s.reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	if reply == replyAccept {
+		return nil
+	}
+	reason, err := readBoundedLine(s.reader, maxHelloReason)
+	if err != nil {
+		return err
+	}
+	return errors.New("peer refused the session: " + reason)
+}
+
+// AcceptHello checks the hello of a connecting peer and answers it, a
+// peer without the secret is refused when there is one. A peer of another
+// version gets the answer before the session ends, so it can tell why.
+func (s *Session) AcceptHello(secret string) error {
+	err := s.acceptHello(secret)
+	s.helloFailed(err)
+	return err
+}
+
+func (s *Session) acceptHello(secret string) error {
+	if err := s.acceptEvent(); err != nil {
+		return err
+	}
+	if err := s.readVersion(); err != nil {
+		if _, ok := err.(*VersionError); ok {
+			s.writeHello(nil, nil, nil)
+			_ = s.writer.Flush()
+		}
+		return err
+	}
+	key := localIdentity()
+	h, nonce, share, err := newHelloState()
+	if err != nil {
+		return err
+	}
+	h.acceptorKey, h.acceptorNonce, h.acceptorShare = key.Public().(ed25519.PublicKey), nonce, share
+	if h.dialerKey, h.dialerNonce, h.dialerShare, err = s.readIdentity(); err != nil {
+		return err
+	}
+	s.writeHello(h.acceptorKey, h.acceptorNonce, h.acceptorShare)
+	_, _ = s.writer.Write(ed25519.Sign(key, h.transcript("acceptor")))
+	if err = s.writer.Flush(); err != nil {
+		return err
+	}
+	if err = s.secure(h, "acceptor"); err != nil {
+		return err
+	}
+	signature := make([]byte, ed25519.SignatureSize)
+	if _, err = io.ReadFull(s.reader, signature); err != nil {
+		return err
+	}
+	proof := make([]byte, sha256.Size)
+	if _, err = io.ReadFull(s.reader, proof); err != nil {
+		return err
+	}
+	if !ed25519.Verify(h.dialerKey, h.transcript("dialer"), signature) {
+		return errors.New("peer signature doesn't match its key")
+	}
+	s.peerKey = Fingerprint(h.dialerKey)
+	if secret != "" && !hmac.Equal(proof, h.proof(secret)) {
+		err = errors.New("pairing secret doesn't match")
+		if rerr := s.sendReply(replyReject, err.Error()); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	return s.sendReply(replyAccept, "")
+}
+
+// secure encrypts the rest of the session with the keys agreed on in the
+// hello. The peer sends nothing else in the clear, so nothing is left in
+// the buffer.
+func (s *Session) secure(h *helloState, role string) error {
+	if s.reader.Buffered() > 0 {
+		return errors.New("peer sent data before the session was encrypted")
+	}
+	keys, err := h.sessionKeys(role)
+	if err != nil {
+		return err
+	}
+	s.keys = keys
+	conn := s.conn
+	if s.stream != nil {
+		conn = s.stream
+	}
+	s.use(conn, keys.channel("hello"))
+	return nil
+}
+
+// helloFailed logs the failure and counts the session as failed.
+func (s *Session) helloFailed(err error) {
+	if s.assertError(err, "hello failed") {
+		atomic.StoreInt32(&s.failed, 1)
+	} else {
+		s.log.Info("peer identified", "key", s.peerKey)
+	}
+}
+
+// writeHello buffers the magic, the version and the identity, if given.
+// Errors of the buffered writer show up when it is flushed.
+func (s *Session) writeHello(key ed25519.PublicKey, nonce, share []byte) {
+	_, _ = s.writer.WriteString(helloMagic)
+	_ = s.writer.WriteByte(protocolVersion)
+	_, _ = s.writer.Write(key)
+	_, _ = s.writer.Write(nonce)
+	_, _ = s.writer.Write(share)
+}
+
+func (s *Session) readVersion() error {
+	// An old peer starts with a file or is done already, and then waits.
+	first, err := s.reader.ReadByte()
+	if err == nil && (first == typeFile || first == typeDone) {
+		return errLegacyPeer
+	}
+	magic := make([]byte, len(helloMagic))
+	magic[0] = first
+	if err == nil {
+		_, err = io.ReadFull(s.reader, magic[1:])
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.New("peer closed the connection before the hello, it may run an old version of siphon")
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(magic, []byte(helloMagic)) {
+		return errors.New("peer is not siphon")
+	}
+	version, err := s.reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	if version != protocolVersion {
+		return &VersionError{Version: version}
+	}
+	return nil
+}
+
+func (s *Session) readIdentity() (ed25519.PublicKey, []byte, []byte, error) {
+	key := make([]byte, ed25519.PublicKeySize)
+	if _, err := io.ReadFull(s.reader, key); err != nil {
+		return nil, nil, nil, err
+	}
+	nonce := make([]byte, helloNonceSize)
+	if _, err := io.ReadFull(s.reader, nonce); err != nil {
+		return nil, nil, nil, err
+	}
+	share := make([]byte, helloShareSize)
+	if _, err := io.ReadFull(s.reader, share); err != nil {
+		return nil, nil, nil, err
+	}
+	return key, nonce, share, nil
+}
+
+// sessionKeys derives the keys of the connection, or of every stream of
+// it, from the exchange in the hello.
+type sessionKeys struct {
+	master         []byte
+	role, peerRole string
+	// opened and accepted count the streams each peer opened.
+	opened, accepted int
+}
+
+// stream returns the keys of the next stream this peer opened, or the
+// peer did.
+func (k *sessionKeys) stream(opened bool) func(net.Conn) net.Conn {
+	if opened {
+		k.opened++
+		return k.channel(fmt.Sprintf("%s stream %d", k.role, k.opened))
+	}
+	k.accepted++
+	return k.channel(fmt.Sprintf("%s stream %d", k.peerRole, k.accepted))
+}
+
+// channel encrypts a connection with keys of the name, one for each
+// direction.
+func (k *sessionKeys) channel(name string) func(net.Conn) net.Conn {
+	send, recv := k.aead(name, k.role), k.aead(name, k.peerRole)
+	return func(conn net.Conn) net.Conn {
+		return &secureConn{Conn: conn, send: send, recv: recv}
+	}
+}
+
+// aead derives the key of the sender of the channel. It is always of a
+// valid size, the cipher can't fail.
+func (k *sessionKeys) aead(name, sender string) cipher.AEAD {
+	mac := hmac.New(sha256.New, k.master)
+	mac.Write([]byte(name + " " + sender))
+	aead, _ := newAEAD(mac.Sum(nil))
+	return aead
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// acceptOne accepts a single peer on the listener and returns the outcome
+// of its hello.
+func acceptOne(ln net.Listener, secret string) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			result <- err
+			return
+		}
+		s := NewSession(conn)
+		result <- s.AcceptHello(secret)
+		_ = s.Close()
+	}()
+	return result
+}
+
+func TestHello(t *testing.T) {
+	ln, err := Listen(NetworkDualStack, "mem://hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//noinspection GoUnhandledErrorResult
+	defer ln.Close()
+	result := acceptOne(ln, "")
+	s, err := Connect("mem://hello", Pairing{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Close()
+	if err = <-result; err != nil {
+		t.Fatal(err)
+	}
+	if s.PeerKey() != LocalFingerprint() {
+		t.Errorf("peer key = %s, want %s", s.PeerKey(), LocalFingerprint())
+	}
+}
+
+func TestHelloPairing(t *testing.T) {
+	ln, err := Listen(NetworkDualStack, "mem://hello-pairing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//noinspection GoUnhandledErrorResult
+	defer ln.Close()
+	other := strings.Repeat("0000:", 7) + "0000"
+	cases := []struct {
+		name      string
+		secret    string
+		pairing   Pairing
+		refused   bool
+		connected bool
+	}{
+		{"no secret", "", Pairing{Secret: "ignored"}, false, true},
+		{"secret", "s3cret", Pairing{Secret: "s3cret"}, false, true},
+		{"wrong secret", "s3cret", Pairing{Secret: "guess"}, true, false},
+		{"missing secret", "s3cret", Pairing{}, true, false},
+		{"pinned key", "", Pairing{Key: strings.ToUpper(LocalFingerprint())}, false, true},
+		{"other key", "", Pairing{Key: other}, true, false},
+	}
+	for _, c := range cases {
+		result := acceptOne(ln, c.secret)
+		s, err := Connect("mem://hello-pairing", c.pairing)
+		if s != nil {
+			_ = s.Close()
+		}
+		if (err == nil) != c.connected {
+			t.Errorf("%s: connect error = %v", c.name, err)
+		}
+		if err = <-result; (err != nil) != c.refused {
+			t.Errorf("%s: accept error = %v", c.name, err)
+		}
+	}
+}
+
+// tappedConn keeps a copy of everything written to the connection.
+type tappedConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *tappedConn) Write(p []byte) (int, error) {
+	c.written.Write(p)
+	return c.Conn.Write(p)
+}
+
+func TestHelloEncrypted(t *testing.T) {
+	ln, err := Listen(NetworkDualStack, "mem://hello-encrypted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	accepted := make(chan *Session, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		s := NewSession(conn)
+		if s.AcceptHello("s3cret") != nil {
+			_ = s.Close()
+			s = nil
+		}
+		accepted <- s
+	}()
+	conn, err := memTransport{}.Dial("hello-encrypted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tapped := &tappedConn{Conn: conn}
+	sender := NewSession(tapped)
+	t.Cleanup(func() {
+		_ = sender.Close()
+	})
+	if err = sender.Hello(Pairing{Secret: "s3cret"}); err != nil {
+		t.Fatal(err)
+	}
+	receiver := <-accepted
+	if receiver == nil {
+		t.Fatal("hello failed")
+	}
+	t.Cleanup(func() {
+		_ = receiver.Close()
+	})
+
+	data := []byte(strings.Repeat("plain text of the file ", 100))
+	name := writeFile(t, filepath.Join(t.TempDir(), "secret-name.txt"), data)
+	result := receiveAll(receiver, t.TempDir())
+	if err = sender.SendFile(name, func(int) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err = sender.SendDone(); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-result; r.err != nil || len(r.files) != 1 {
+		t.Fatalf("received %d files, error %v", len(r.files), r.err)
+	}
+	for _, plain := range []string{"s3cret", "secret-name.txt", "plain text"} {
+		if bytes.Contains(tapped.written.Bytes(), []byte(plain)) {
+			t.Errorf("%q was sent in the clear", plain)
+		}
+	}
+}
+
+func TestNormalizeFingerprint(t *testing.T) {
+	want := "0123:4567:89ab:cdef:0123:4567:89ab:cdef"
+	for _, in := range []string{want, "0123456789ABCDEF0123456789abcdef", " 0123-4567-89ab-cdef-0123-4567-89ab-cdef"} {
+		if got, err := normalizeFingerprint(in); err != nil || got != want {
+			t.Errorf("normalizeFingerprint(%q) = %q, %v", in, got, err)
+		}
+	}
+	for _, in := range []string{"", "0123", want + "00", "g123:4567:89ab:cdef:0123:4567:89ab:cdef"} {
+		if _, err := normalizeFingerprint(in); err == nil {
+			t.Errorf("normalizeFingerprint(%q) succeeded", in)
+		}
+	}
+}
+
+func TestHelloLegacyPeer(t *testing.T) {
+	ln, err := Listen(NetworkDualStack, "mem://hello-legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//noinspection GoUnhandledErrorResult
+	defer ln.Close()
+	result := acceptOne(ln, "")
+	conn, err := memTransport{}.Dial("hello-legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//noinspection GoUnhandledErrorResult
+	defer conn.Close()
+	// An old peer starts with the file right away.
+	if _, err = conn.Write([]byte{typeFile, 'a', '\n'}); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-result; err != errLegacyPeer {
+		t.Fatalf("hello error = %v, want %v", err, errLegacyPeer)
+	}
+}
+
+func TestHelloVersionMismatch(t *testing.T) {
+	ln, err := Listen(NetworkDualStack, "mem://hello-version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//noinspection GoUnhandledErrorResult
+	defer ln.Close()
+	result := acceptOne(ln, "")
+	conn, err := memTransport{}.Dial("hello-version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//noinspection GoUnhandledErrorResult
+	defer conn.Close()
+	if _, err = conn.Write(append([]byte(helloMagic), protocolVersion+1)); err != nil {
+		t.Fatal(err)
+	}
+	// The peer learns the version of the listener.
+	answer := make([]byte, len(helloMagic)+1)
+	if _, err = io.ReadFull(conn, answer); err != nil {
+		t.Fatal(err)
+	}
+	if string(answer[:len(helloMagic)]) != helloMagic || answer[len(helloMagic)] != protocolVersion {
+		t.Errorf("answer = %q", answer)
+	}
+	verr, ok := (<-result).(*VersionError)
+	if !ok || verr.Version != protocolVersion+1 {
+		t.Fatalf("hello error = %v, want a version error", verr)
+	}
+}
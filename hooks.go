@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultHookTimeout = 60
+	maxHookTimeout     = 3600
+	// maxHookOutput bounds the output of a hook kept for the log.
+	maxHookOutput = 64 << 10
+)
+
+// RunHook runs the command by the shell with the variables added to the
+// environment and returns its combined output. The command is killed once
+// the timeout passes.
+func RunHook(command string, dir string, env []string, timeout time.Duration) (string, error) {
+	// The output goes to a file rather than a pipe, so waiting doesn't hang
+	// on background processes of a killed command holding the pipe open.
+	output, err := ioutil.TempFile("", "siphon-hook-*")
+	if err != nil {
+		return "", err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer os.Remove(output.Name())
+	//noinspection GoUnhandledErrorResult
+	defer output.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+
+	if _, serr := output.Seek(0, io.SeekStart); serr != nil {
+		return "", err
+	}
+	data, rerr := ioutil.ReadAll(io.LimitReader(output, maxHookOutput))
+	if rerr != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), err
+}
+
+// receivedEnv describes a received file to the hook.
+func receivedEnv(file ReceivedFile, sender string, profile string) []string {
+	return []string{
+		"SIPHON_FILE=" + file.Path,
+		"SIPHON_NAME=" + file.Name,
+		"SIPHON_SIZE=" + strconv.FormatInt(file.Size, 10),
+		"SIPHON_SHA256=" + hex.EncodeToString(file.Checksum),
+		"SIPHON_RULE=" + file.Rule,
+		"SIPHON_SENDER=" + sender,
+		"SIPHON_PROFILE=" + profile,
+	}
+}
+
+// sessionEnv describes the files received in a session to the hook.
+func sessionEnv(dir string, files []ReceivedFile, sender string, profile string) []string {
+	var size int64
+	paths := make([]string, len(files))
+	for i, file := range files {
+		size += file.Size
+		paths[i] = file.Path
+	}
+	return []string{
+		"SIPHON_DIRECTORY=" + dir,
+		"SIPHON_FILES=" + strings.Join(paths, "\n"),
+		"SIPHON_COUNT=" + strconv.Itoa(len(files)),
+		"SIPHON_SIZE=" + strconv.FormatInt(size, 10),
+		"SIPHON_SENDER=" + sender,
+		"SIPHON_PROFILE=" + profile,
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	identityFileName = "identity.pem"
+	// fingerprintSize is the part of the SHA-256 of a key shown to users.
+	fingerprintSize = 16
+)
+
+// identity is the key of this instance, it proves itself to peers with it
+// at every hello. Peers may pin its fingerprint in their profiles.
+var identity ed25519.PrivateKey
+var identityOnce sync.Once
+
+// loadIdentity reads the key stored next to the config, the first start
+// generates it.
+func loadIdentity() error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	path = filepath.Join(filepath.Dir(path), identityFileName)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return err
+		}
+		if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err = ioutil.WriteFile(path, data, 0600); err != nil {
+			return err
+		}
+		logger.Info("identity generated", "file", path)
+		identity = key
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return errors.New("identity file is not PEM")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return errors.New("identity is not an Ed25519 key")
+	}
+	identity = key
+	return nil
+}
+
+// localIdentity returns the key of this instance. Without a stored one,
+// when the config directory is unusable, a key lasting until exit is used.
+func localIdentity() ed25519.PrivateKey {
+	identityOnce.Do(func() {
+		if identity != nil {
+			return
+		}
+		logger.Warn("no stored identity, using a temporary one")
+		_, identity, _ = ed25519.GenerateKey(rand.Reader)
+	})
+	return identity
+}
+
+// Fingerprint names the key for users, like 3f2a:91bc:07de:….
+func Fingerprint(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	fingerprint, _ := normalizeFingerprint(hex.EncodeToString(sum[:fingerprintSize]))
+	return fingerprint
+}
+
+// LocalFingerprint is the fingerprint of this instance.
+func LocalFingerprint() string {
+	return Fingerprint(localIdentity().Public().(ed25519.PublicKey))
+}
+
+// normalizeFingerprint accepts fingerprints typed with any separators and
+// case and returns them in the form of Fingerprint.
+func normalizeFingerprint(s string) (string, error) {
+	digits := strings.Map(func(r rune) rune {
+		switch {
+		case r >= '0' && r <= '9' || r >= 'a' && r <= 'f':
+			return r
+		case r >= 'A' && r <= 'F':
+			return r - 'A' + 'a'
+		case r == ':' || r == '-' || r == ' ':
+			return -1
+		}
+		return 'x'
+	}, s)
+	if len(digits) != 2*fingerprintSize || strings.ContainsRune(digits, 'x') {
+		return "", errors.New("key fingerprint must be 32 hex digits")
+	}
+	groups := make([]string, 0, len(digits)/4)
+	for i := 0; i < len(digits); i += 4 {
+		groups = append(groups, digits[i:i+4])
+	}
+	return strings.Join(groups, ":"), nil
+}
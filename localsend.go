@@ -0,0 +1,717 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LocalSend exchanges files with devices running LocalSend, following its
+// protocol v2: devices find each other by multicast announcements on the
+// LAN, a sender offers its files to the receiver's prepare-upload endpoint
+// and uploads the accepted ones one by one with the tokens it gets back.
+
+const (
+	localSendVersion = "2.0"
+	localSendGroup   = "224.0.0.167"
+	// localSendGroupPort is the port of the announcements, whatever
+	// port the devices listen on.
+	localSendGroupPort   = 53317
+	defaultLocalSendPort = "53317"
+	localSendAPI         = "/api/localsend/v2/"
+	// localSendPeerTTL drops the devices which weren't heard from for long.
+	localSendPeerTTL = 10 * time.Minute
+	// localSendSessionTimeout lets another device send once a transfer
+	// got no uploads for long.
+	localSendSessionTimeout = 2 * time.Minute
+	// maxLocalSendMessage bounds the JSON messages read from devices.
+	maxLocalSendMessage = 1 << 20
+)
+
+// LocalSendInfo describes a device, it is announced and registered.
+type LocalSendInfo struct {
+	Alias       string `json:"alias"`
+	Version     string `json:"version"`
+	DeviceModel string `json:"deviceModel,omitempty"`
+	DeviceType  string `json:"deviceType,omitempty"`
+	Fingerprint string `json:"fingerprint"`
+	Port        int    `json:"port"`
+	Protocol    string `json:"protocol"`
+	Download    bool   `json:"download"`
+	Announce    bool   `json:"announce"`
+	// Announcement is the name of Announce in older versions.
+	Announcement bool `json:"announcement"`
+}
+
+// LocalSendPeer is a device found on the network.
+type LocalSendPeer struct {
+	LocalSendInfo
+	Host string
+	seen time.Time
+}
+
+func (p LocalSendPeer) Title() string {
+	return p.Alias + " (LocalSend)"
+}
+
+func (p LocalSendPeer) url(endpoint string, query url.Values) string {
+	u := url.URL{
+		Scheme:   p.Protocol,
+		Host:     net.JoinHostPort(p.Host, strconv.Itoa(p.Port)),
+		Path:     localSendAPI + endpoint,
+		RawQuery: query.Encode(),
+	}
+	return u.String()
+}
+
+type localSendFile struct {
+	ID       string `json:"id"`
+	FileName string `json:"fileName"`
+	Size     int64  `json:"size"`
+	FileType string `json:"fileType"`
+	SHA256   string `json:"sha256,omitempty"`
+}
+
+type localSendPrepare struct {
+	Info  LocalSendInfo            `json:"info"`
+	Files map[string]localSendFile `json:"files"`
+}
+
+type localSendPrepared struct {
+	SessionID string            `json:"sessionId"`
+	Files     map[string]string `json:"files"`
+}
+
+// localSendSession is a transfer offered by a device, only one at a time.
+type localSendSession struct {
+	id     string
+	sender string
+	files  map[string]localSendFile
+	tokens map[string]string
+	// dirs holds the directory of every file, routes the index of the
+	// routing rule which picked it or -1.
+	dirs    map[string]string
+	routes  map[string]int
+	policy  ReceivePolicy
+	updated time.Time
+	active  int
+}
+
+// LocalSend serves the LocalSend endpoints and tracks the devices around.
+type LocalSend struct {
+	Directory string
+	// Policy returns the limits and routes for files of the host, like
+	// for a Siphon peer at the address.
+	Policy func(host string) ReceivePolicy
+	// Confirm asks the user whether to take the files offered by the
+	// device, they are taken when it is nil.
+	Confirm func(sender string, count int, size int64) bool
+	// Upload is called when a device starts sending a file, the returned
+	// functions get its progress and its outcome.
+	Upload func(client string, name string, size int64) (progress func(p int), done func(file ReceivedFile, err error))
+
+	info   LocalSendInfo
+	client *http.Client
+	server *http.Server
+	udp    *net.UDPConn
+
+	mu      sync.Mutex
+	peers   map[string]*LocalSendPeer
+	session *localSendSession
+	closed  bool
+}
+
+// NewLocalSend prepares a device with the alias listening on the port, with
+// a fresh self-signed certificate for HTTPS.
+func NewLocalSend(alias string, port int, https bool, dir string) (*LocalSend, error) {
+	l := &LocalSend{
+		Directory: dir,
+		info: LocalSendInfo{
+			Alias:       alias,
+			Version:     localSendVersion,
+			DeviceModel: "Siphon",
+			DeviceType:  "desktop",
+			Port:        port,
+			Protocol:    "http",
+		},
+		peers: make(map[string]*LocalSendPeer),
+	}
+	l.server = &http.Server{Handler: l}
+	if https {
+		cert, err := newSelfSignedCertificate(alias)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(cert.Certificate[0])
+		l.info.Protocol = "https"
+		l.info.Fingerprint = strings.ToUpper(hex.EncodeToString(sum[:]))
+		l.server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	} else {
+		fingerprint, err := randomHex(16)
+		if err != nil {
+			return nil, err
+		}
+		l.info.Fingerprint = fingerprint
+	}
+	l.client = &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			// Devices have self-signed certificates, the fingerprint
+			// they announced is checked instead.
+			InsecureSkipVerify: true,
+		},
+	}}
+	return l, nil
+}
+
+func newSelfSignedCertificate(name string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// Start listens for devices and announces this one.
+func (l *LocalSend) Start() error {
+	port := strconv.Itoa(l.info.Port)
+	ln, err := net.Listen("tcp", net.JoinHostPort("", port))
+	if err != nil {
+		return err
+	}
+	group := &net.UDPAddr{IP: net.ParseIP(localSendGroup), Port: localSendGroupPort}
+	udp, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		//noinspection GoUnhandledErrorResult
+		ln.Close()
+		return err
+	}
+	l.udp = udp
+	go func() {
+		var err error
+		if l.server.TLSConfig != nil {
+			err = l.server.ServeTLS(ln, "", "")
+		} else {
+			err = l.server.Serve(ln)
+		}
+		if err != http.ErrServerClosed {
+			logger.Error("localsend server failed", "error", err)
+		}
+	}()
+	go l.listenAnnouncements()
+	l.Discover()
+	return nil
+}
+
+func (l *LocalSend) Close() error {
+	l.mu.Lock()
+	l.closed = true
+	l.mu.Unlock()
+	err := l.udp.Close()
+	if serr := l.server.Close(); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// Discover announces this device, the others answer with their details.
+func (l *LocalSend) Discover() {
+	info := l.info
+	info.Announce, info.Announcement = true, true
+	l.multicast(info)
+}
+
+func (l *LocalSend) multicast(info LocalSendInfo) {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return
+	}
+	group := &net.UDPAddr{IP: net.ParseIP(localSendGroup), Port: localSendGroupPort}
+	conn, err := net.DialUDP("udp4", nil, group)
+	if err != nil {
+		logger.Warn("unable to announce to localsend devices", "error", err)
+		return
+	}
+	//noinspection GoUnhandledErrorResult
+	defer conn.Close()
+	if _, err = conn.Write(data); err != nil {
+		logger.Warn("unable to announce to localsend devices", "error", err)
+	}
+}
+
+func (l *LocalSend) listenAnnouncements() {
+	buffer := make([]byte, 64<<10)
+	for {
+		n, addr, err := l.udp.ReadFromUDP(buffer)
+		if err != nil {
+			l.mu.Lock()
+			closed := l.closed
+			l.mu.Unlock()
+			if !closed {
+				logger.Error("localsend discovery failed", "error", err)
+			}
+			return
+		}
+		var info LocalSendInfo
+		if err := json.Unmarshal(buffer[:n], &info); err != nil || info.Fingerprint == l.info.Fingerprint {
+			continue
+		}
+		peer := l.addPeer(info, addr.IP.String())
+		if info.Announce || info.Announcement {
+			// Answer by registering at the device, or by multicast if
+			// it can't be reached.
+			go func() {
+				if err := l.register(peer); err != nil {
+					logger.Debug("unable to register at localsend device", "device", peer.Alias, "error", err)
+					l.multicast(l.info)
+				}
+			}()
+		}
+	}
+}
+
+func (l *LocalSend) addPeer(info LocalSendInfo, host string) LocalSendPeer {
+	if info.Protocol != "http" {
+		info.Protocol = "https"
+	}
+	if info.Port == 0 {
+		info.Port = l.info.Port
+	}
+	peer := &LocalSendPeer{LocalSendInfo: info, Host: host, seen: time.Now()}
+	l.mu.Lock()
+	if _, ok := l.peers[info.Fingerprint]; !ok {
+		logger.Info("found localsend device", "device", info.Alias, "host", host)
+	}
+	l.peers[info.Fingerprint] = peer
+	l.mu.Unlock()
+	return *peer
+}
+
+// Peers lists the devices heard from lately by their aliases.
+func (l *LocalSend) Peers() []LocalSendPeer {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var peers []LocalSendPeer
+	for fingerprint, peer := range l.peers {
+		if time.Since(peer.seen) > localSendPeerTTL {
+			delete(l.peers, fingerprint)
+			continue
+		}
+		peers = append(peers, *peer)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Alias < peers[j].Alias
+	})
+	return peers
+}
+
+func (l *LocalSend) register(peer LocalSendPeer) error {
+	var info LocalSendInfo
+	return l.post(peer, "register", nil, l.info, &info)
+}
+
+// post sends the message as JSON and decodes the answer into result, if any.
+func (l *LocalSend) post(peer LocalSendPeer, endpoint string, query url.Values, message interface{}, result interface{}) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	resp, err := l.do(peer, endpoint, query, bytes.NewReader(data), int64(len(data)), "application/json")
+	if err != nil {
+		return err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+	if result == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxLocalSendMessage)).Decode(result)
+}
+
+// do posts the body to the device, checking its certificate against the
+// announced fingerprint. Failed requests are turned into errors.
+func (l *LocalSend) do(peer LocalSendPeer, endpoint string, query url.Values, body io.Reader, size int64, contentType string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, peer.url(endpoint, query), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		sum := sha256.Sum256(resp.TLS.PeerCertificates[0].Raw)
+		if !strings.EqualFold(hex.EncodeToString(sum[:]), peer.Fingerprint) {
+			//noinspection GoUnhandledErrorResult
+			resp.Body.Close()
+			return nil, errors.New("certificate doesn't match the fingerprint")
+		}
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	//noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+	reason, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	switch resp.StatusCode {
+	case http.StatusForbidden:
+		return nil, &RejectedError{Name: peer.Alias, Reason: "declined"}
+	case http.StatusUnauthorized:
+		return nil, errors.New("the device asks for a PIN, which is not supported")
+	case http.StatusConflict:
+		return nil, errors.New("the device is busy with another transfer")
+	}
+	return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(reason)))
+}
+
+// Send offers the files to the device and uploads those it accepts, under
+// their remote paths if given. The result holds an error for every file,
+// nil for the sent ones, a file the device doesn't want gets a
+// *RejectedError.
+func (l *LocalSend) Send(peer LocalSendPeer, names []string, remotes []string, progress func(i int, p int)) ([]error, error) {
+	errs := make([]error, len(names))
+	prepare := localSendPrepare{Info: l.info, Files: make(map[string]localSendFile)}
+	for i, name := range names {
+		stat, err := os.Stat(name)
+		if err != nil {
+			return errs, err
+		}
+		id := strconv.Itoa(i)
+		remote := remotes[i]
+		if remote == "" {
+			remote = filepath.Base(name)
+		}
+		prepare.Files[id] = localSendFile{
+			ID:       id,
+			FileName: remote,
+			Size:     stat.Size(),
+			FileType: localSendFileType(name),
+		}
+	}
+	var prepared localSendPrepared
+	if err := l.post(peer, "prepare-upload", nil, prepare, &prepared); err != nil {
+		return errs, err
+	}
+	logger.Info("localsend upload", "device", peer.Alias, "accepted", len(prepared.Files), "files", len(names))
+	for i, name := range names {
+		id := strconv.Itoa(i)
+		token, ok := prepared.Files[id]
+		if !ok {
+			errs[i] = &RejectedError{Name: filepath.Base(name), Reason: "declined by " + peer.Alias}
+			continue
+		}
+		query := url.Values{"sessionId": {prepared.SessionID}, "fileId": {id}, "token": {token}}
+		errs[i] = l.upload(peer, name, query, func(p int) {
+			progress(i, p)
+		})
+		if errs[i] != nil {
+			// The rest can't go after a failure, the session is over.
+			_ = l.post(peer, "cancel", url.Values{"sessionId": {prepared.SessionID}}, nil, nil)
+			for j := i + 1; j < len(names); j++ {
+				errs[j] = errs[i]
+			}
+			break
+		}
+	}
+	return errs, nil
+}
+
+func (l *LocalSend) upload(peer LocalSendPeer, name string, query url.Values, progress func(p int)) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	started := time.Now()
+	counter := &uploadCounter{size: stat.Size(), progress: progress, bytes: metricBytesSent}
+	resp, err := l.do(peer, "upload", query, io.TeeReader(file, counter), stat.Size(), "application/octet-stream")
+	if err != nil {
+		metricFilesSent.done(resultFailed, stat.Size(), started)
+		return err
+	}
+	//noinspection GoUnhandledErrorResult
+	resp.Body.Close()
+	if stat.Size() == 0 {
+		progress(100)
+	}
+	metricFilesSent.done(resultCompleted, stat.Size(), started)
+	return nil
+}
+
+func localSendFileType(name string) string {
+	if t := mime.TypeByExtension(filepath.Ext(name)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+func (l *LocalSend) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.URL.Path, localSendAPI) {
+		http.NotFound(rw, r)
+		return
+	}
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	switch strings.TrimPrefix(r.URL.Path, localSendAPI) {
+	case "register":
+		var info LocalSendInfo
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxLocalSendMessage)).Decode(&info); err != nil {
+			http.Error(rw, "malformed request", http.StatusBadRequest)
+			return
+		}
+		if info.Fingerprint != l.info.Fingerprint {
+			l.addPeer(info, host)
+		}
+		l.reply(rw, l.info)
+	case "prepare-upload":
+		l.servePrepare(rw, r, host)
+	case "upload":
+		l.serveUpload(rw, r, host)
+	case "cancel":
+		l.mu.Lock()
+		if l.session != nil && l.session.id == r.URL.Query().Get("sessionId") {
+			logger.Info("localsend transfer cancelled", "device", l.session.sender)
+			l.session = nil
+		}
+		l.mu.Unlock()
+	default:
+		http.NotFound(rw, r)
+	}
+}
+
+func (l *LocalSend) reply(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		logger.Warn("unable to reply to localsend device", "error", err)
+	}
+}
+
+// servePrepare accepts the offered files within the limits of the policy,
+// the device uploads them with the returned tokens. Devices aren't
+// authenticated, anyone on the network may offer files.
+func (l *LocalSend) servePrepare(rw http.ResponseWriter, r *http.Request, host string) {
+	var prepare localSendPrepare
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxLocalSendMessage)).Decode(&prepare); err != nil {
+		http.Error(rw, "malformed request", http.StatusBadRequest)
+		return
+	}
+	if l.busy() {
+		http.Error(rw, "blocked by another session", http.StatusConflict)
+		return
+	}
+	session := &localSendSession{
+		sender: prepare.Info.Alias + " at " + host,
+		files:  make(map[string]localSendFile),
+		tokens: make(map[string]string),
+		dirs:   make(map[string]string),
+		routes: make(map[string]int),
+	}
+	if l.Policy != nil {
+		session.policy = l.Policy(host)
+	}
+	ids := make([]string, 0, len(prepare.Files))
+	for id := range prepare.Files {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var total int64
+	for _, id := range ids {
+		file := prepare.Files[id]
+		dir, route, err := l.acceptFile(session, file, total)
+		if err != nil {
+			logger.Warn("localsend file declined", "device", session.sender, "file", file.FileName, "reason", err)
+			continue
+		}
+		token, err := randomHex(16)
+		if err != nil {
+			http.Error(rw, "internal error", http.StatusInternalServerError)
+			return
+		}
+		total += file.Size
+		session.files[id] = file
+		session.tokens[id] = token
+		session.dirs[id] = dir
+		session.routes[id] = route
+	}
+	if len(session.files) == 0 {
+		http.Error(rw, "declined", http.StatusForbidden)
+		return
+	}
+	if l.Confirm != nil && !l.Confirm(session.sender, len(session.files), total) {
+		logger.Info("localsend transfer declined", "device", session.sender)
+		http.Error(rw, "declined", http.StatusForbidden)
+		return
+	}
+	var err error
+	if session.id, err = randomHex(16); err != nil {
+		http.Error(rw, "internal error", http.StatusInternalServerError)
+		return
+	}
+	session.updated = time.Now()
+	l.mu.Lock()
+	if l.busyLocked() {
+		l.mu.Unlock()
+		http.Error(rw, "blocked by another session", http.StatusConflict)
+		return
+	}
+	l.session = session
+	l.mu.Unlock()
+	logger.Info("localsend transfer", "device", session.sender, "files", len(session.files))
+	l.reply(rw, localSendPrepared{SessionID: session.id, Files: session.tokens})
+}
+
+// acceptFile checks the offered file against the policy of the session,
+// the files accepted before it count to the quota with their size in
+// received. It returns the directory of the file and the index of its
+// route.
+func (l *LocalSend) acceptFile(session *localSendSession, file localSendFile, received int64) (string, int, error) {
+	policy := session.policy
+	if _, err := syncPath(l.Directory, file.FileName); err != nil || file.Size < 0 {
+		return "", -1, errors.New("invalid file")
+	}
+	if policy.MaxFileSize > 0 && file.Size > policy.MaxFileSize {
+		return "", -1, errors.New("too large")
+	}
+	if policy.Quota > 0 && received+file.Size > policy.Quota {
+		return "", -1, errors.New("session quota exceeded")
+	}
+	route := MatchRoute(policy.Routes, path.Base(file.FileName), file.Size, policy.Sender, policy.SenderKey)
+	if route < 0 {
+		return l.Directory, route, nil
+	}
+	dir, err := routeDirectory(policy.Routes[route])
+	return dir, route, err
+}
+
+// busy tells if another device is sending, or was until lately.
+func (l *LocalSend) busy() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.busyLocked()
+}
+
+func (l *LocalSend) busyLocked() bool {
+	return l.session != nil && (l.session.active > 0 || time.Since(l.session.updated) < localSendSessionTimeout)
+}
+
+func (l *LocalSend) serveUpload(rw http.ResponseWriter, r *http.Request, host string) {
+	query := r.URL.Query()
+	id := query.Get("fileId")
+	l.mu.Lock()
+	session := l.session
+	var file localSendFile
+	var dir string
+	var route int
+	ok := session != nil && session.id == query.Get("sessionId")
+	if ok {
+		var token string
+		token, ok = session.tokens[id]
+		ok = ok && subtle.ConstantTimeCompare([]byte(token), []byte(query.Get("token"))) == 1
+	}
+	if ok {
+		file = session.files[id]
+		dir, route = session.dirs[id], session.routes[id]
+		session.active++
+		// Every token is good for a single upload.
+		delete(session.tokens, id)
+	}
+	l.mu.Unlock()
+	if !ok {
+		http.Error(rw, "invalid token", http.StatusForbidden)
+		return
+	}
+	defer func() {
+		l.mu.Lock()
+		session.active--
+		session.updated = time.Now()
+		if l.session == session && len(session.tokens) == 0 {
+			l.session = nil
+		}
+		l.mu.Unlock()
+	}()
+
+	target, err := syncTarget(dir, file.FileName)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log := logger.With("device", session.sender)
+	log.Info("receive localsend file", "file", target, "size", file.Size)
+	progress, done := l.Upload(session.sender, file.FileName, file.Size)
+	started := time.Now()
+	target, sum, err := receiveUpload(target, r.Body, file.Size, progress)
+	if err == nil && file.SHA256 != "" && !strings.EqualFold(hex.EncodeToString(sum), file.SHA256) {
+		//noinspection GoUnhandledErrorResult
+		os.Remove(target)
+		err = errors.New("checksum mismatch")
+	}
+	if err != nil {
+		log.Error("localsend file failed", "file", file.FileName, "error", err)
+		metricFilesReceived.done(resultFailed, file.Size, started)
+		done(ReceivedFile{}, err)
+		http.Error(rw, "upload failed", http.StatusInternalServerError)
+		return
+	}
+	metricFilesReceived.done(resultCompleted, file.Size, started)
+	name := path.Join(path.Dir(file.FileName), filepath.Base(target))
+	received := ReceivedFile{Path: target, Name: name, Size: file.Size, Checksum: sum}
+	if route >= 0 {
+		received.Rule = session.policy.Routes[route].Name
+		runAction(session.policy.Routes[route], target)
+	}
+	done(received, nil)
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
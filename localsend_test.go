@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newLocalSendServer serves the endpoints of a device receiving into a
+// temporary directory, without announcing it.
+func newLocalSendServer(t *testing.T) (*LocalSend, *httptest.Server) {
+	l, err := NewLocalSend("receiver", 0, false, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Policy = func(string) ReceivePolicy {
+		return ReceivePolicy{MaxFileSize: 1000}
+	}
+	l.Upload = func(string, string, int64) (func(int), func(ReceivedFile, error)) {
+		return func(int) {}, func(ReceivedFile, error) {}
+	}
+	server := httptest.NewServer(l)
+	t.Cleanup(server.Close)
+	return l, server
+}
+
+func localSendPost(t *testing.T, server *httptest.Server, endpoint string, query url.Values, body []byte) *http.Response {
+	u := server.URL + localSendAPI + endpoint
+	if query != nil {
+		u += "?" + query.Encode()
+	}
+	resp, err := http.Post(u, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = resp.Body.Close()
+	})
+	return resp
+}
+
+func localSendJSON(t *testing.T, v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+var localSendSender = LocalSendInfo{Alias: "sender", Version: localSendVersion, Fingerprint: "f00d", Port: 53317, Protocol: "http"}
+
+func TestLocalSendRegister(t *testing.T) {
+	l, server := newLocalSendServer(t)
+	resp := localSendPost(t, server, "register", nil, localSendJSON(t, localSendSender))
+	var info LocalSendInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Alias != "receiver" || info.Fingerprint != l.info.Fingerprint {
+		t.Errorf("registered at %+v", info)
+	}
+	peers := l.Peers()
+	if len(peers) != 1 || peers[0].Alias != "sender" || peers[0].Host != "127.0.0.1" {
+		t.Errorf("peers = %+v", peers)
+	}
+	if resp = localSendPost(t, server, "register", nil, []byte("{")); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("malformed register: %s", resp.Status)
+	}
+}
+
+func TestLocalSendUpload(t *testing.T) {
+	l, server := newLocalSendServer(t)
+	prepare := localSendPrepare{Info: localSendSender, Files: map[string]localSendFile{
+		"good":     {ID: "good", FileName: "photos/cat.jpg", Size: 5},
+		"parent":   {ID: "parent", FileName: "../evil", Size: 5},
+		"nested":   {ID: "nested", FileName: "photos/../../evil", Size: 5},
+		"absolute": {ID: "absolute", FileName: "/tmp/evil", Size: 5},
+		"large":    {ID: "large", FileName: "large", Size: 1001},
+	}}
+	resp := localSendPost(t, server, "prepare-upload", nil, localSendJSON(t, prepare))
+	var prepared localSendPrepared
+	if err := json.NewDecoder(resp.Body).Decode(&prepared); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := prepared.Files["good"]; !ok || len(prepared.Files) != 1 {
+		t.Fatalf("accepted %v", prepared.Files)
+	}
+
+	// Another device can't send in the meantime.
+	other := localSendPrepare{Info: localSendSender, Files: map[string]localSendFile{
+		"other": {ID: "other", FileName: "other", Size: 1},
+	}}
+	if resp = localSendPost(t, server, "prepare-upload", nil, localSendJSON(t, other)); resp.StatusCode != http.StatusConflict {
+		t.Errorf("prepare during a transfer: %s", resp.Status)
+	}
+
+	query := url.Values{"sessionId": {prepared.SessionID}, "fileId": {"good"}, "token": {"wrong"}}
+	if resp = localSendPost(t, server, "upload", query, []byte("hello")); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("upload with a wrong token: %s", resp.Status)
+	}
+	query.Set("token", prepared.Files["good"])
+	if resp = localSendPost(t, server, "upload", query, []byte("hello")); resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload: %s", resp.Status)
+	}
+	data, err := os.ReadFile(filepath.Join(l.Directory, "photos", "cat.jpg"))
+	if err != nil || string(data) != "hello" {
+		t.Errorf("received %q, %v", data, err)
+	}
+	// Every token is good for one upload.
+	if resp = localSendPost(t, server, "upload", query, []byte("again")); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("upload with a used token: %s", resp.Status)
+	}
+	if _, err = os.Stat(filepath.Join(filepath.Dir(l.Directory), "evil")); !os.IsNotExist(err) {
+		t.Error("file was written outside of the directory")
+	}
+}
+
+func TestLocalSendPrepareDeclined(t *testing.T) {
+	_, server := newLocalSendServer(t)
+	prepare := localSendPrepare{Info: localSendSender, Files: map[string]localSendFile{
+		"parent": {ID: "parent", FileName: "..", Size: 1},
+		"large":  {ID: "large", FileName: "large", Size: 1001},
+	}}
+	if resp := localSendPost(t, server, "prepare-upload", nil, localSendJSON(t, prepare)); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("prepare without acceptable files: %s", resp.Status)
+	}
+}
+
+func TestLocalSendSend(t *testing.T) {
+	receiver, server := newLocalSendServer(t)
+	sender, err := NewLocalSend("sender", 0, false, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	peer := LocalSendPeer{LocalSendInfo: receiver.info, Host: host}
+	peer.Port, _ = strconv.Atoi(port)
+	small := filepath.Join(sender.Directory, "small.txt")
+	large := filepath.Join(sender.Directory, "large.bin")
+	if err = os.WriteFile(small, []byte("small"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(large, make([]byte, 1001), 0644); err != nil {
+		t.Fatal(err)
+	}
+	errs, err := sender.Send(peer, []string{small, large}, []string{"", "big/large.bin"}, func(int, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs[0] != nil {
+		t.Error(errs[0])
+	}
+	if _, ok := errs[1].(*RejectedError); !ok {
+		t.Errorf("large file: %v, want a rejection", errs[1])
+	}
+	if data, err := os.ReadFile(filepath.Join(receiver.Directory, "small.txt")); err != nil || string(data) != "small" {
+		t.Errorf("received %q, %v", data, err)
+	}
+}
+
+func TestLocalSendConfirm(t *testing.T) {
+	l, server := newLocalSendServer(t)
+	var asked int
+	l.Confirm = func(sender string, count int, size int64) bool {
+		asked++
+		if sender != "sender at 127.0.0.1" || count != 2 || size != 30 {
+			t.Errorf("asked for %d files (%d bytes) of %s", count, size, sender)
+		}
+		return false
+	}
+	prepare := localSendPrepare{Info: localSendSender, Files: map[string]localSendFile{
+		"a": {ID: "a", FileName: "a", Size: 10},
+		"b": {ID: "b", FileName: "b", Size: 20},
+	}}
+	if resp := localSendPost(t, server, "prepare-upload", nil, localSendJSON(t, prepare)); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("declined prepare: %s", resp.Status)
+	}
+	if asked != 1 {
+		t.Errorf("asked %d times", asked)
+	}
+	l.Confirm = func(string, int, int64) bool {
+		return true
+	}
+	if resp := localSendPost(t, server, "prepare-upload", nil, localSendJSON(t, prepare)); resp.StatusCode != http.StatusOK {
+		t.Errorf("accepted prepare: %s", resp.Status)
+	}
+}
+
+func TestLocalSendPolicy(t *testing.T) {
+	l, server := newLocalSendServer(t)
+	routed := filepath.Join(t.TempDir(), "pictures")
+	l.Policy = func(host string) ReceivePolicy {
+		return ReceivePolicy{
+			Quota:  25,
+			Routes: []Route{{Name: "pictures", Extensions: []string{"jpg"}, Directory: routed}},
+		}
+	}
+	prepare := localSendPrepare{Info: localSendSender, Files: map[string]localSendFile{
+		"a": {ID: "a", FileName: "photos/cat.jpg", Size: 10},
+		"b": {ID: "b", FileName: "notes.txt", Size: 10},
+		"c": {ID: "c", FileName: "over-quota.txt", Size: 10},
+	}}
+	resp := localSendPost(t, server, "prepare-upload", nil, localSendJSON(t, prepare))
+	var prepared localSendPrepared
+	if err := json.NewDecoder(resp.Body).Decode(&prepared); err != nil {
+		t.Fatal(err)
+	}
+	if len(prepared.Files) != 2 || prepared.Files["c"] != "" {
+		t.Fatalf("accepted %v", prepared.Files)
+	}
+	for _, id := range []string{"a", "b"} {
+		query := url.Values{"sessionId": {prepared.SessionID}, "fileId": {id}, "token": {prepared.Files[id]}}
+		if resp = localSendPost(t, server, "upload", query, make([]byte, 10)); resp.StatusCode != http.StatusOK {
+			t.Fatalf("upload of %s: %s", id, resp.Status)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(routed, "photos", "cat.jpg")); err != nil {
+		t.Errorf("routed file: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(l.Directory, "notes.txt")); err != nil {
+		t.Errorf("file in the incoming directory: %v", err)
+	}
+}
+
+func TestLocalSendExistingFile(t *testing.T) {
+	l, server := newLocalSendServer(t)
+	writeFile(t, filepath.Join(l.Directory, "cat.jpg"), []byte("old"))
+	writeFile(t, filepath.Join(l.Directory, "cat (1).jpg"), []byte("older"))
+	prepare := localSendPrepare{Info: localSendSender, Files: map[string]localSendFile{
+		"cat": {ID: "cat", FileName: "cat.jpg", Size: 3},
+	}}
+	resp := localSendPost(t, server, "prepare-upload", nil, localSendJSON(t, prepare))
+	var prepared localSendPrepared
+	if err := json.NewDecoder(resp.Body).Decode(&prepared); err != nil {
+		t.Fatal(err)
+	}
+	query := url.Values{"sessionId": {prepared.SessionID}, "fileId": {"cat"}, "token": {prepared.Files["cat"]}}
+	if resp = localSendPost(t, server, "upload", query, []byte("new")); resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload: %s", resp.Status)
+	}
+	checkFile(t, filepath.Join(l.Directory, "cat.jpg"), []byte("old"))
+	checkFile(t, filepath.Join(l.Directory, "cat (1).jpg"), []byte("older"))
+	checkFile(t, filepath.Join(l.Directory, "cat (2).jpg"), []byte("new"))
+}
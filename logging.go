@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+const (
+	logFileName = "siphon.log"
+	// maxLogRecent is the number of records kept for the log panel.
+	maxLogRecent = 1000
+
+	defaultLogMaxSize = 10
+	defaultLogKeep    = 3
+)
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+func parseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if n == strings.ToLower(name) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown level %q", name)
+}
+
+// Logger writes records in the logfmt format: the time, level and message
+// followed by the fields of the logger and those of the call as key=value
+// pairs, like "time=... level=info msg="receive file" peer=... file=...".
+type Logger struct {
+	fields []interface{}
+}
+
+// logger is the root logger, sessions derive their own with the peer field.
+var logger Logger
+
+var logMu sync.Mutex
+var logLevel = LevelInfo
+var logFile *rotatingFile
+var logRecent []string
+
+// logListener gets every record written, it is called with logMu unlocked.
+var logListener func(record string)
+
+func init() {
+	// Messages of the standard logger become records too.
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{})
+}
+
+// With returns a logger adding the key and value pairs to every record.
+func (l Logger) With(fields ...interface{}) Logger {
+	return Logger{fields: append(append([]interface{}(nil), l.fields...), fields...)}
+}
+
+func (l Logger) Debug(msg string, fields ...interface{}) {
+	l.log(LevelDebug, msg, fields)
+}
+
+func (l Logger) Info(msg string, fields ...interface{}) {
+	l.log(LevelInfo, msg, fields)
+}
+
+func (l Logger) Warn(msg string, fields ...interface{}) {
+	l.log(LevelWarn, msg, fields)
+}
+
+func (l Logger) Error(msg string, fields ...interface{}) {
+	l.log(LevelError, msg, fields)
+}
+
+func (l Logger) log(level Level, msg string, fields []interface{}) {
+	logMu.Lock()
+	enabled := level >= logLevel
+	logMu.Unlock()
+	if !enabled {
+		return
+	}
+	var b strings.Builder
+	b.WriteString("time=")
+	b.WriteString(time.Now().Format("2006-01-02T15:04:05.000Z07:00"))
+	b.WriteString(" level=")
+	b.WriteString(level.String())
+	b.WriteString(" msg=")
+	b.WriteString(logValue(msg))
+	all := append(append([]interface{}(nil), l.fields...), fields...)
+	for i := 0; i < len(all); i += 2 {
+		var value interface{} = "!MISSING"
+		if i+1 < len(all) {
+			value = all[i+1]
+		}
+		b.WriteByte(' ')
+		b.WriteString(fmt.Sprint(all[i]))
+		b.WriteByte('=')
+		b.WriteString(logValue(value))
+	}
+	b.WriteByte('\n')
+	writeRecord(b.String())
+}
+
+// logValue quotes the values which would break the key=value format.
+func logValue(value interface{}) string {
+	s := fmt.Sprint(value)
+	if s == "" {
+		return `""`
+	}
+	for _, c := range s {
+		if c == '=' || c == '"' || unicode.IsSpace(c) || !unicode.IsPrint(c) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+func writeRecord(record string) {
+	logMu.Lock()
+	_, _ = os.Stderr.WriteString(record)
+	if logFile != nil {
+		if _, err := logFile.Write([]byte(record)); err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, "unable to write log file:", err)
+		}
+	}
+	logRecent = append(logRecent, record)
+	if len(logRecent) > maxLogRecent {
+		logRecent = append([]string(nil), logRecent[len(logRecent)-maxLogRecent:]...)
+	}
+	listener := logListener
+	logMu.Unlock()
+	if listener != nil {
+		listener(record)
+	}
+}
+
+// watchLog passes the kept records and every new one to the listener.
+func watchLog(listener func(record string)) []string {
+	logMu.Lock()
+	defer logMu.Unlock()
+	logListener = listener
+	return append([]string(nil), logRecent...)
+}
+
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	logger.Info(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+func setLogLevel(level Level) {
+	logMu.Lock()
+	logLevel = level
+	logMu.Unlock()
+}
+
+// configureLogging sets the level and the log file, an empty file name
+// turns the file off. The size is in MiB.
+func configureLogging(level string, file string, maxSize int, keep int) error {
+	l, err := parseLevel(level)
+	if err != nil {
+		return err
+	}
+	var f *rotatingFile
+	if file != "" {
+		if f, err = openRotatingFile(file, int64(maxSize)<<20, keep); err != nil {
+			return err
+		}
+	}
+	logMu.Lock()
+	old := logFile
+	logLevel = l
+	logFile = f
+	logMu.Unlock()
+	if old != nil {
+		return old.Close()
+	}
+	return nil
+}
+
+// defaultLogFile returns $XDG_CACHE_HOME/siphon/siphon.log.
+func defaultLogFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, configDirName, logFileName)
+}
+
+// rotatingFile appends to the log file and renames it to name.1 once it
+// reaches the maximum size, older files shift to name.2 and so on, keeping
+// the given number of them.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	keep    int
+	file    *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64, keep int) (*rotatingFile, error) {
+	if maxSize <= 0 {
+		return nil, errors.New("invalid log file size")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		//noinspection GoUnhandledErrorResult
+		file.Close()
+		return nil, err
+	}
+	return &rotatingFile{path: path, maxSize: maxSize, keep: keep, file: file, size: stat.Size()}, nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	for i := r.keep - 1; i >= 1; i-- {
+		old := r.path + "." + strconv.Itoa(i)
+		if fileExists(old) {
+			if err := os.Rename(old, r.path+"."+strconv.Itoa(i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	var err error
+	if r.keep > 0 {
+		err = os.Rename(r.path, r.path+".1")
+	} else {
+		err = os.Remove(r.path)
+	}
+	if err != nil {
+		return err
+	}
+	r.file, err = os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0600)
+	r.size = 0
+	return err
+}
+
+func (r *rotatingFile) Close() error {
+	return r.file.Close()
+}
@@ -2,16 +2,25 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"embed"
 	"errors"
 	"fmt"
+	"github.com/gotk3/gotk3/gdk"
 	"github.com/gotk3/gotk3/glib"
 	"github.com/gotk3/gotk3/gtk"
-	"gopkg.in/yaml.v3"
+	"github.com/skip2/go-qrcode"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unsafe"
 )
 
 const (
@@ -20,55 +29,88 @@ const (
 	ColumnProgress
 )
 
-const appId = "com.github.gotk3.gotk3-examples.glade"
+const qrCodeSize = 256
+
+// maxPreviewLines bounds the changes listed in the sync preview and the
+// hook output shown in the file list.
+const maxPreviewLines = 20
+
+const appId = "com.github.solkin.siphon"
+
+// uiFiles are built into the binary, desktop entries and file managers
+// start it in any directory.
+//
+//go:embed ui/*.ui
+var uiFiles embed.FS
+
+// sendFlag hands the files following it to the running instance, or to a
+// new one, which also opens the peer chooser. File managers run it for
+// the "Send with Siphon" action.
+const sendFlag = "--send"
+
+// openHintSend is the hint of the open signal for the send flag.
+const openHintSend = "send"
 
 type OutFile struct {
-	Name   string
+	Name string
+	// Remote is the path of a file of a queued folder on the peer, relative
+	// to its incoming files directory.
+	Remote string
 	Iter   *gtk.TreeIter
 	IsDone bool
 }
 
+// Title is the name of the file on the peer.
+func (f OutFile) Title() string {
+	if f.Remote != "" {
+		return f.Remote
+	}
+	return filepath.Base(f.Name)
+}
+
 var files = make([]OutFile, 0)
 
 var win *gtk.ApplicationWindow
-var treeStore *gtk.ListStore
+var treeStore *gtk.TreeStore
+var treeFiles *gtk.TreeView
 var buttonConnect *gtk.Button
 var buttonCancel *gtk.Button
 var buttonSettings *gtk.Button
+var buttonShare *gtk.Button
 var headerBar *gtk.HeaderBar
 
-var config Config
-
-type Config struct {
-	Client struct {
-		Host string `yaml:"host"`
-		Port string `yaml:"port"`
-	} `yaml:"client"`
-	Server struct {
-		Listen    bool   `yaml:"listen"`
-		Port      string `yaml:"port"`
-		Directory string `yaml:"directory"`
-	} `yaml:"server"`
-}
-
 func main() {
 	loadConfig()
+	if err := configureLogging(config.Log.Level, config.Log.File, config.Log.MaxSize, config.Log.Keep); err != nil {
+		reportConfigProblem("unable to open log file: %v", err)
+	}
+	if err := loadIdentity(); err != nil {
+		reportConfigProblem("unable to load identity: %v", err)
+	}
+	logger.Info("identity", "key", LocalFingerprint())
 
-	// Create a new application.
-	application, err := gtk.ApplicationNew(appId, glib.APPLICATION_FLAGS_NONE)
+	// Create a new application. Files and siphon:// links given on the command
+	// line or by the desktop are forwarded to the running instance, if any.
+	application, err := gtk.ApplicationNew(appId, glib.APPLICATION_HANDLES_OPEN)
 	failOnError(err)
 
 	// Connect function to application startup event, this is not required.
 	_ = application.Connect("startup", func() {
-		log.Println("application startup")
+		logger.Debug("application startup")
 	})
 
 	// Connect function to application activate event
-	_ = application.Connect("activate", func() {
-		log.Println("application activate")
+	activate := func() {
+		logger.Debug("application activate")
+
+		// Activation of the running instance just raises its window.
+		if win != nil {
+			win.Present()
+			return
+		}
 
 		// Get the GtkBuilder UI definition in the glade file.
-		builder, err := gtk.BuilderNewFromFile("ui/sfn-main.ui")
+		builder, err := newBuilder("sfn-main.ui")
 		failOnError(err)
 
 		// Map the handlers to callback functions, and connect the signals
@@ -111,24 +153,108 @@ func main() {
 		buttonSettings, err = isButton(obj)
 		failOnError(err)
 
+		obj, err = builder.GetObject("button_share")
+		failOnError(err)
+		buttonShare, err = isButton(obj)
+		failOnError(err)
+
+		obj, err = builder.GetObject("button_limits")
+		failOnError(err)
+		buttonLimits, err := isButton(obj)
+		failOnError(err)
+
+		obj, err = builder.GetObject("stack_main")
+		failOnError(err)
+		stackMain, err := isStack(obj)
+		failOnError(err)
+
+		obj, err = builder.GetObject("button_log")
+		failOnError(err)
+		buttonLog, err := isButton(obj)
+		failOnError(err)
+
+		obj, err = builder.GetObject("log_view")
+		failOnError(err)
+		logView, err := isTextView(obj)
+		failOnError(err)
+
+		obj, err = builder.GetObject("log_level")
+		failOnError(err)
+		logLevelCombo, err := isComboBoxText(obj)
+		failOnError(err)
+
+		obj, err = builder.GetObject("log_copy")
+		failOnError(err)
+		logCopyButton, err := isButton(obj)
+		failOnError(err)
+
 		obj, err = builder.GetObject("tree_files")
 		failOnError(err)
-		tree, err := isTreeView(obj)
+		treeFiles, err = isTreeView(obj)
 		failOnError(err)
 
-		tree.AppendColumn(createTextColumn("File Name", ColumnName))
-		tree.AppendColumn(createTextColumn("File Size", ColumnSize))
-		tree.AppendColumn(createProgressColumn("Progress", ColumnProgress))
+		treeFiles.AppendColumn(createTextColumn("File Name", ColumnName))
+		treeFiles.AppendColumn(createTextColumn("File Size", ColumnSize))
+		treeFiles.AppendColumn(createProgressColumn("Progress", ColumnProgress))
 
 		// Creating a tree store. This is what holds the data that will be shown on our tree view.
-		treeStore, err = gtk.ListStoreNew(glib.TYPE_STRING, glib.TYPE_STRING, glib.TYPE_INT)
+		// Queued files are toplevel rows, every peer gets a section with the files received from it.
+		treeStore, err = gtk.TreeStoreNew(glib.TYPE_STRING, glib.TYPE_STRING, glib.TYPE_INT)
 		if err != nil {
 			log.Fatal("Unable to create tree store:", err)
 		}
-		tree.SetModel(treeStore)
+		treeFiles.SetModel(treeStore)
+
+		// The log panel shows the kept records and follows the new ones.
+		logBuffer, err := logView.GetBuffer()
+		failOnError(err)
+		logEnd := logBuffer.CreateMark("end", logBuffer.GetEndIter(), false)
+		appendLog := func(record string) {
+			logBuffer.Insert(logBuffer.GetEndIter(), record)
+			if extra := logBuffer.GetLineCount() - 1 - maxLogRecent; extra > 0 {
+				logBuffer.Delete(logBuffer.GetStartIter(), logBuffer.GetIterAtLine(extra))
+			}
+			logView.ScrollToMark(logEnd, 0, false, 0, 0)
+		}
+		for _, record := range watchLog(func(record string) {
+			glib.IdleAdd(func() {
+				appendLog(record)
+			})
+		}) {
+			appendLog(record)
+		}
+
+		_ = buttonLog.Connect("clicked", func() {
+			if stackMain.GetVisibleChildName() == "log" {
+				stackMain.SetVisibleChildName("files")
+				buttonLog.SetTooltipText("Show log")
+			} else {
+				stackMain.SetVisibleChildName("log")
+				buttonLog.SetTooltipText("Show files")
+			}
+		})
+
+		logLevelCombo.SetActiveID(config.Log.Level)
+		_ = logLevelCombo.Connect("changed", func() {
+			level, err := parseLevel(logLevelCombo.GetActiveID())
+			if err != nil {
+				return
+			}
+			setLogLevel(level)
+			config.Log.Level = level.String()
+			saveConfigAsync()
+		})
+
+		_ = logCopyButton.Connect("clicked", func() {
+			text, err := logBuffer.GetText(logBuffer.GetStartIter(), logBuffer.GetEndIter(), false)
+			failOnError(err)
+			clipboard, err := gtk.ClipboardGet(gdk.SELECTION_CLIPBOARD)
+			failOnError(err)
+			clipboard.SetText(text)
+		})
 
 		_ = buttonConnect.Connect("clicked", func() {
-			builder, err := gtk.BuilderNewFromFile("ui/sfn-popover.ui")
+			builder, err := newBuilder("sfn-popover.ui")
 			failOnError(err)
 
 			obj, err = builder.GetObject("connect_popover")
@@ -148,40 +274,275 @@ func main() {
 			failOnError(err)
 			portEntry.SetText(config.Client.Port)
 
-			obj, err = builder.GetObject("connect_button")
+			obj, err = builder.GetObject("connect_secret")
 			failOnError(err)
-			button, err := isButton(obj)
+			secretEntry, err := isEntry(obj)
 			failOnError(err)
-			_ = button.Connect("clicked", func() {
+
+			obj, err = builder.GetObject("connect_key")
+			failOnError(err)
+			keyEntry, err := isEntry(obj)
+			failOnError(err)
+
+			// destination is the peer typed into the entries.
+			destination := func() Profile {
 				host, err := hostEntry.GetText()
 				failOnError(err)
 				port, err := portEntry.GetText()
 				failOnError(err)
+				secret, err := secretEntry.GetText()
+				failOnError(err)
+				key, err := keyEntry.GetText()
+				failOnError(err)
+				return Profile{Host: host, Port: port, Secret: secret, Key: strings.TrimSpace(key)}
+			}
+			// fillDestination loads the profile into the entries.
+			fillDestination := func(profile Profile) {
+				hostEntry.SetText(profile.Host)
+				portEntry.SetText(profile.Port)
+				secretEntry.SetText(profile.Secret)
+				keyEntry.SetText(profile.Key)
+			}
+
+			obj, err = builder.GetObject("connect_button")
+			failOnError(err)
+			button, err := isButton(obj)
+			failOnError(err)
+			_ = button.Connect("clicked", func() {
+				ConnectAsync(destination())
+			})
+
+			obj, err = builder.GetObject("sync_button")
+			failOnError(err)
+			syncButton, err := isButton(obj)
+			failOnError(err)
+			_ = syncButton.Connect("clicked", func() {
+				dialog, err := gtk.FileChooserDialogNewWith2Buttons(
+					"Select folder to sync",
+					win,
+					gtk.FILE_CHOOSER_ACTION_SELECT_FOLDER,
+					"Sync",
+					gtk.RESPONSE_ACCEPT,
+					"Cancel",
+					gtk.RESPONSE_CANCEL,
+				)
+				failOnError(err)
+				dialog.SetModal(true)
+				v := dialog.Run()
+				dir := dialog.GetFilename()
+				dialog.Destroy()
+				if v == gtk.RESPONSE_ACCEPT {
+					popover.Hide()
+					SyncAsync(destination(), dir)
+				}
+			})
 
-				go func() {
-					config.Client.Host = host
-					config.Client.Port = port
-					saveConfig()
+			obj, err = builder.GetObject("profile_name")
+			failOnError(err)
+			nameEntry, err := isEntry(obj)
+			failOnError(err)
 
-					SwitchConnectionButton(true)
-					err := RunClient(host, port)
-					if err != nil {
-						showError("Failed to connect to %s:%s", host, port)
+			obj, err = builder.GetObject("profile_save")
+			failOnError(err)
+			saveButton, err := isButton(obj)
+			failOnError(err)
+
+			obj, err = builder.GetObject("profiles_list")
+			failOnError(err)
+			profilesList, err := isListBox(obj)
+			failOnError(err)
+
+			obj, err = builder.GetObject("broadcast_button")
+			failOnError(err)
+			broadcastButton, err := isButton(obj)
+			failOnError(err)
+
+			// Name of the profile loaded into the entries for editing.
+			editing := ""
+			// Destinations ticked for sending to several peers at once.
+			selected := make(map[Profile]bool)
+			selectFunc := func(profile Profile) func(active bool) {
+				return func(active bool) {
+					if active {
+						selected[profile] = true
+					} else {
+						delete(selected, profile)
 					}
-				}()
+					broadcastButton.SetSensitive(len(selected) > 0)
+				}
+			}
+
+			var fillProfiles func()
+			fillProfiles = func() {
+				if children := profilesList.GetChildren(); children != nil {
+					children.Foreach(func(item interface{}) {
+						profilesList.Remove(item.(*gtk.Widget))
+					})
+				}
+				selected = make(map[Profile]bool)
+				for _, profile := range config.Client.Profiles {
+					profile := profile
+					addProfileRow(profilesList, profile.Title(), selectFunc(profile), func() {
+						ConnectAsync(profile)
+					}, func() {
+						editing = profile.Name
+						nameEntry.SetText(profile.Name)
+						fillDestination(profile)
+					}, func() {
+						deleteProfile(profile.Name)
+						saveConfigAsync()
+						fillProfiles()
+					})
+				}
+				for _, recent := range config.Client.Recent {
+					recent := recent
+					addProfileRow(profilesList, recent.Title(), selectFunc(recent), func() {
+						ConnectAsync(recent)
+					}, func() {
+						editing = ""
+						nameEntry.SetText("")
+						fillDestination(recent)
+					}, func() {
+						deleteRecent(recent.Host, recent.Port)
+						saveConfigAsync()
+						fillProfiles()
+					})
+				}
+				count := len(config.Client.Profiles) + len(config.Client.Recent)
+				profilesList.SetVisible(count > 0)
+				broadcastButton.SetVisible(count > 1)
+				broadcastButton.SetSensitive(false)
+			}
+			fillProfiles()
+
+			_ = broadcastButton.Connect("clicked", func() {
+				var destinations []Profile
+				for profile := range selected {
+					destinations = append(destinations, profile)
+				}
+				BroadcastAsync(destinations)
+			})
+
+			_ = saveButton.Connect("clicked", func() {
+				name, err := nameEntry.GetText()
+				failOnError(err)
+				profile := destination()
+				profile.Name = name
+
+				err = putProfile(editing, profile)
+				if err != nil {
+					showError("Unable to save profile: %s", err)
+					return
+				}
+				editing = ""
+				nameEntry.SetText("")
+				saveConfigAsync()
+				fillProfiles()
+			})
+
+			obj, err = builder.GetObject("relay_box")
+			failOnError(err)
+			relayBox, err := isBox(obj)
+			failOnError(err)
+			relayBox.SetVisible(config.Relay.Address != "")
+			// A pasted link may point to another relay than the configured one.
+			relayAddress := config.Relay.Address
+
+			obj, err = builder.GetObject("relay_code")
+			failOnError(err)
+			relayCodeEntry, err := isEntry(obj)
+			failOnError(err)
+
+			obj, err = builder.GetObject("relay_connect")
+			failOnError(err)
+			relayConnectButton, err := isButton(obj)
+			failOnError(err)
+			_ = relayConnectButton.Connect("clicked", func() {
+				code, err := relayCodeEntry.GetText()
+				failOnError(err)
+				if _, err := normalizeRelayCode(code); err != nil {
+					showError("Unable to use the code: %s", err)
+					return
+				}
+				key, err := keyEntry.GetText()
+				failOnError(err)
+				RelayAsync(relayAddress, code, strings.TrimSpace(key), RoleSender)
+			})
+
+			obj, err = builder.GetObject("relay_wait")
+			failOnError(err)
+			relayWaitButton, err := isButton(obj)
+			failOnError(err)
+			_ = relayWaitButton.Connect("clicked", func() {
+				code, err := NewRelayCode()
+				if err != nil {
+					showError("Unable to generate a code: %s", err)
+					return
+				}
+				relayCodeEntry.SetText(code)
+				RelayAsync(relayAddress, code, "", RoleReceiver)
 			})
 
+			obj, err = builder.GetObject("localsend_list")
+			failOnError(err)
+			localSendList, err := isListBox(obj)
+			failOnError(err)
+			var devices []LocalSendPeer
+			if localSend != nil {
+				localSend.Discover()
+				devices = localSend.Peers()
+			}
+			for _, device := range devices {
+				device := device
+				addDeviceRow(localSendList, device.Title(), func() {
+					popover.Hide()
+					LocalSendAsync(device)
+				})
+			}
+			localSendList.SetVisible(len(devices) > 0)
+
 			validateFunc := func() {
-				log.Println("host/port changed")
+				logger.Debug("host/port changed")
 				h, err := hostEntry.GetText()
 				failOnError(err)
 				p, err := portEntry.GetText()
 				failOnError(err)
-				button.SetSensitive(len(h) > 0 && len(p) > 0)
+				n, err := nameEntry.GetText()
+				failOnError(err)
+				// Unix sockets and the like are addressed without a port.
+				needsPort := NeedsPort(h)
+				portEntry.SetSensitive(needsPort)
+				valid := len(h) > 0 && (len(p) > 0 || !needsPort)
+				button.SetSensitive(valid)
+				saveButton.SetSensitive(valid && len(n) > 0)
 			}
 			validateFunc()
-			_ = hostEntry.Connect("changed", validateFunc)
+			_ = hostEntry.Connect("changed", func() {
+				text, err := hostEntry.GetText()
+				failOnError(err)
+				if IsConnectionURI(text) {
+					uri, err := ParseConnectionURI(text)
+					if err != nil {
+						logger.Warn("unable to parse link", "error", err)
+					} else {
+						// Setting the text re-enters this handler with a plain host.
+						hostEntry.SetText(uri.Host)
+						if uri.Port != "" {
+							portEntry.SetText(uri.Port)
+						}
+						secretEntry.SetText(uri.Secret)
+						keyEntry.SetText(uri.Key)
+						if uri.Relay != "" {
+							relayAddress = uri.Relay
+							relayCodeEntry.SetText(uri.Code)
+							relayBox.SetVisible(true)
+						}
+					}
+				}
+				validateFunc()
+			})
 			_ = portEntry.Connect("changed", validateFunc)
+			_ = nameEntry.Connect("changed", validateFunc)
 
 			popover.SetRelativeTo(buttonConnect)
 
@@ -190,14 +551,10 @@ func main() {
 		})
 
 		_ = buttonCancel.Connect("clicked", func() {
-			err := Disconnect()
+			err := DisconnectAll()
 			if err != nil {
 				showError("Unable to disconnect")
-				return
 			}
-			SetSubtitle("")
-			SwitchConnectionButton(false)
-			StartServerAsync()
 		})
 
 		_ = buttonImport.Connect("clicked", func() {
@@ -215,25 +572,117 @@ func main() {
 			if v == int(gtk.RESPONSE_ACCEPT) {
 				list, err := dialog.GetFilenames()
 				if err != nil {
-					log.Println("unable to choose files")
+					logger.Warn("unable to choose files")
 					return
 				}
 				for _, name := range list {
-					log.Println("open:", name)
-					base := filepath.Base(name)
-					stat, err := os.Stat(name)
-					if err != nil {
-						log.Println("unable to get file info")
+					if err := QueueFile(name); err != nil {
+						logger.Warn("unable to get file info")
 						return
 					}
-					iter := addRow(treeStore, base, ByteCountBinary(stat.Size()))
-					files = append(files, OutFile{Name: name, Iter: iter, IsDone: false})
 				}
 			}
 		})
 
+		_ = buttonShare.Connect("clicked", func() {
+			builder, err := newBuilder("sfn-share.ui")
+			failOnError(err)
+
+			obj, err = builder.GetObject("share_popover")
+			failOnError(err)
+			popover, err := isPopover(obj)
+			failOnError(err)
+
+			obj, err = builder.GetObject("share_address")
+			failOnError(err)
+			addressCombo, err := isComboBoxText(obj)
+			failOnError(err)
+
+			obj, err = builder.GetObject("share_qr")
+			failOnError(err)
+			qrImage, err := isImage(obj)
+			failOnError(err)
+
+			obj, err = builder.GetObject("share_uri")
+			failOnError(err)
+			uriLabel, err := isLabel(obj)
+			failOnError(err)
+
+			var links []string
+			for _, uri := range ConnectionURIs() {
+				title := uri.Relay + " (relay)"
+				if uri.Host != "" {
+					title = net.JoinHostPort(uri.Host, uri.Port)
+				}
+				addressCombo.Append(strconv.Itoa(len(links)), title)
+				links = append(links, uri.String())
+			}
+			for _, link := range WebLinks() {
+				addressCombo.Append(strconv.Itoa(len(links)), link.Address+" (browser)")
+				links = append(links, link.URL)
+			}
+			_ = addressCombo.Connect("changed", func() {
+				i, err := strconv.Atoi(addressCombo.GetActiveID())
+				if err != nil || i >= len(links) {
+					return
+				}
+				uri := links[i]
+				uriLabel.SetText(uri)
+				pixbuf, err := qrPixbuf(uri)
+				if err != nil {
+					logger.Error("unable to render QR code", "error", err)
+					qrImage.Clear()
+					return
+				}
+				qrImage.SetFromPixbuf(pixbuf)
+			})
+			addressCombo.SetActiveID("0")
+
+			popover.SetRelativeTo(buttonShare)
+
+			popover.Show()
+		})
+
+		_ = buttonLimits.Connect("clicked", func() {
+			builder, err := newBuilder("sfn-limits.ui")
+			failOnError(err)
+
+			obj, err = builder.GetObject("limits_popover")
+			failOnError(err)
+			popover, err := isPopover(obj)
+			failOnError(err)
+
+			// Limits apply as soon as they are changed, also to running transfers.
+			limits := map[string]*int{
+				"limit_upload":        &config.Limits.Upload,
+				"limit_download":      &config.Limits.Download,
+				"limit_peer_upload":   &config.Limits.PeerUpload,
+				"limit_peer_download": &config.Limits.PeerDownload,
+			}
+			for id, limit := range limits {
+				obj, err = builder.GetObject(id)
+				failOnError(err)
+				spin, err := isSpinButton(obj)
+				failOnError(err)
+				spin.SetValue(float64(*limit))
+				limit := limit
+				_ = spin.Connect("value-changed", func() {
+					*limit = spin.GetValueAsInt()
+					ApplyRateLimits()
+				})
+			}
+
+			_ = popover.Connect("closed", func() {
+				saveConfigAsync()
+			})
+
+			popover.SetRelativeTo(buttonLimits)
+
+			popover.Show()
+		})
+
 		_ = buttonSettings.Connect("clicked", func() {
-			builder, err := gtk.BuilderNewFromFile("ui/sfn-settings.ui")
+			builder, err := newBuilder("sfn-settings.ui")
 			failOnError(err)
 
 			obj, err = builder.GetObject("settings_popover")
@@ -254,6 +703,80 @@ func main() {
 			portEntry.SetText(config.Server.Port)
 			portEntry.SetSensitive(config.Server.Listen)
 
+			obj, err = builder.GetObject("host_bind")
+			failOnError(err)
+			bindEntry, err := isEntry(obj)
+			failOnError(err)
+			bindEntry.SetText(config.Server.Bind)
+			bindEntry.SetSensitive(config.Server.Listen)
+
+			obj, err = builder.GetObject("host_network")
+			failOnError(err)
+			networkCombo, err := isComboBoxText(obj)
+			failOnError(err)
+			networkCombo.SetActiveID(config.Server.Network)
+			networkCombo.SetSensitive(config.Server.Listen)
+
+			obj, err = builder.GetObject("host_max_peers")
+			failOnError(err)
+			maxPeersSpin, err := isSpinButton(obj)
+			failOnError(err)
+			maxPeersSpin.SetValue(float64(config.Server.MaxPeers))
+			maxPeersSpin.SetSensitive(config.Server.Listen)
+
+			obj, err = builder.GetObject("host_map_port")
+			failOnError(err)
+			mapPortSwitch, err := isSwitch(obj)
+			failOnError(err)
+			mapPortSwitch.SetActive(config.Server.MapPort)
+			mapPortSwitch.SetSensitive(config.Server.Listen)
+
+			obj, err = builder.GetObject("host_secret")
+			failOnError(err)
+			secretEntry, err := isEntry(obj)
+			failOnError(err)
+			secretEntry.SetText(config.Server.Secret)
+			secretEntry.SetSensitive(config.Server.Listen)
+
+			obj, err = builder.GetObject("max_file_size")
+			failOnError(err)
+			maxFileSizeSpin, err := isSpinButton(obj)
+			failOnError(err)
+			maxFileSizeSpin.SetValue(float64(config.Server.MaxFileSize))
+
+			obj, err = builder.GetObject("session_quota")
+			failOnError(err)
+			quotaSpin, err := isSpinButton(obj)
+			failOnError(err)
+			quotaSpin.SetValue(float64(config.Server.Quota))
+
+			obj, err = builder.GetObject("preallocate")
+			failOnError(err)
+			preallocateSwitch, err := isSwitch(obj)
+			failOnError(err)
+			preallocateSwitch.SetActive(config.Server.Preallocate)
+
+			obj, err = builder.GetObject("relay_address")
+			failOnError(err)
+			relayEntry, err := isEntry(obj)
+			failOnError(err)
+			relayEntry.SetText(config.Relay.Address)
+
+			obj, err = builder.GetObject("watch_dir")
+			failOnError(err)
+			watchEntry, err := isEntry(obj)
+			failOnError(err)
+			watchEntry.SetText(config.Watch.Directory)
+
+			obj, err = builder.GetObject("watch_profile")
+			failOnError(err)
+			watchCombo, err := isComboBoxText(obj)
+			failOnError(err)
+			for _, profile := range config.Client.Profiles {
+				watchCombo.Append(profile.Name, profile.Title())
+			}
+			watchCombo.SetActiveID(config.Watch.Profile)
+
 			obj, err = builder.GetObject("incoming_dir")
 			failOnError(err)
 			dirEntry, err := isEntry(obj)
@@ -272,16 +795,34 @@ func main() {
 				v := dialog.Run()
 				if v == int(gtk.RESPONSE_ACCEPT) {
 					name := dialog.GetFilename()
-					log.Println("select dir:", name)
+					logger.Info("select dir", "dir", name)
+					if err := validateDirectory(name); err != nil {
+						showError("Unable to use incoming files directory: %s", err)
+						return
+					}
 					config.Server.Directory = name
 					dirEntry.SetText(config.Server.Directory)
-					go func() { saveConfig() }()
+					saveConfigAsync()
 				}
 			})
 
+			obj, err = builder.GetObject("rules_button")
+			failOnError(err)
+			rulesButton, err := isButton(obj)
+			failOnError(err)
+			_ = rulesButton.Connect("clicked", func() {
+				popover.Hide()
+				showRules()
+			})
+
 			_ = hostSwitch.Connect("state-set", func() {
 				active := hostSwitch.GetActive()
 				portEntry.SetSensitive(active)
+				bindEntry.SetSensitive(active)
+				networkCombo.SetSensitive(active)
+				maxPeersSpin.SetSensitive(active)
+				mapPortSwitch.SetSensitive(active)
+				secretEntry.SetSensitive(active)
 				if !active {
 					go func() {
 						time.Sleep(250 * time.Millisecond)
@@ -291,27 +832,86 @@ func main() {
 			})
 
 			_ = popover.Connect("closed", func() {
-				log.Println("settings closed")
+				logger.Debug("settings closed")
 				l := hostSwitch.GetActive()
 				p, err := portEntry.GetText()
 				failOnError(err)
 
 				dir, err := dirEntry.GetText()
 				failOnError(err)
-				config.Server.Directory = dir
+				if err := validateDirectory(dir); err != nil {
+					showError("Unable to use incoming files directory: %s", err)
+				} else {
+					config.Server.Directory = dir
+				}
+
+				if err := validatePort(p); err != nil {
+					showError("Invalid port: %s", err)
+					p = config.Server.Port
+				}
+
+				b, err := bindEntry.GetText()
+				failOnError(err)
+				b = strings.Trim(strings.TrimSpace(b), "[]")
+				n := networkCombo.GetActiveID()
+				if err := validateNetwork(n, b); err != nil {
+					showError("Invalid listen address: %s", err)
+					n, b = config.Server.Network, config.Server.Bind
+				}
+
+				r, err := relayEntry.GetText()
+				failOnError(err)
+				r = strings.TrimSpace(r)
+				if err := validateRelay(r); err != nil {
+					showError("Invalid relay address: %s", err)
+				} else {
+					config.Relay.Address = r
+				}
+
+				wd, err := watchEntry.GetText()
+				failOnError(err)
+				wd = strings.TrimSpace(wd)
+				wp := watchCombo.GetActiveID()
+				if err := validateWatch(wd, wp, config.Client.Profiles); err != nil {
+					showError("Unable to use outbox: %s", err)
+				} else if wd != config.Watch.Directory || wp != config.Watch.Profile {
+					config.Watch.Directory = wd
+					config.Watch.Profile = wp
+					go func() {
+						StopWatcher()
+						StartWatcher()
+					}()
+				}
+
+				// Receive limits apply to the next connected peers.
+				config.Server.MaxFileSize = maxFileSizeSpin.GetValueAsInt()
+				config.Server.Quota = quotaSpin.GetValueAsInt()
+				config.Server.Preallocate = preallocateSwitch.GetActive()
+
+				m := maxPeersSpin.GetValueAsInt()
+				mp := mapPortSwitch.GetActive()
+				sec, err := secretEntry.GetText()
+				failOnError(err)
 
-				if l != config.Server.Listen || p != config.Server.Port {
+				if l != config.Server.Listen || p != config.Server.Port ||
+					n != config.Server.Network || b != config.Server.Bind ||
+					m != config.Server.MaxPeers || mp != config.Server.MapPort ||
+					sec != config.Server.Secret {
 					config.Server.Listen = l
 					config.Server.Port = p
+					config.Server.Network = n
+					config.Server.Bind = b
+					config.Server.MaxPeers = m
+					config.Server.MapPort = mp
+					config.Server.Secret = sec
 					go func() {
 						StopServer()
-						SwitchConnectionButton(false)
 						if config.Server.Listen {
 							StartServerAsync()
 						}
 					}()
 				}
-				go func() { saveConfig() }()
+				saveConfigAsync()
 			})
 
 			popover.SetRelativeTo(buttonSettings)
@@ -324,135 +924,496 @@ func main() {
 		win.Show()
 		application.AddWindow(win)
 
-		StartServerAsync()
-	})
-
-	// Connect function to application shutdown event, this is not required.
-	_ = application.Connect("shutdown", func() {
-		log.Println("application shutdown")
-	})
+		for _, problem := range configProblems {
+			showError("Settings problem: %s", problem)
+		}
 
-	// Launch the application
-	os.Exit(application.Run(os.Args))
-}
+		ApplyRateLimits()
+		StartServerAsync()
+		StartWatcher()
+		StartMetrics()
+		StartControl()
+		StartLocalSend()
+	}
+	_ = application.Connect("activate", activate)
+
+	// Connect function to application open event, the arguments are
+	// files to queue and siphon:// links to connect to.
+	_ = application.Connect("open", func(_ interface{}, list unsafe.Pointer, n int, hint string) {
+		logger.Debug("application open")
+		activate()
+		var links []ConnectionURI
+		for _, uri := range fileURIs(list, n) {
+			if IsConnectionURI(uri) {
+				link, err := ParseConnectionURI(uri)
+				if err != nil {
+					showError("Invalid link %s: %s", uri, err)
+					continue
+				}
+				links = append(links, link)
+				continue
+			}
+			name, err := pathFromURI(uri)
+			if err != nil {
+				showError("Unable to open %s: %s", uri, err)
+				continue
+			}
+			if err := QueueFile(name); err != nil {
+				showError("Unable to open %s: %s", name, err)
+			}
+		}
+		// Queued files go to the peers as soon as they connect.
+		for _, link := range links {
+			OpenConnectionURI(link)
+		}
+		if hint == openHintSend && len(links) == 0 {
+			showPeerChooser()
+		}
+	})
 
-func loadConfig() {
-	loaded := false
-	f, err := os.Open("config.yml")
-	if err == nil {
-		//noinspection GoUnhandledErrorResult
-		defer f.Close()
+	// Connect function to application shutdown event, this is not required.
+	_ = application.Connect("shutdown", func() {
+		logger.Debug("application shutdown")
+		StopControl()
+		StopLocalSend()
+	})
 
-		var cfg Config
-		decoder := yaml.NewDecoder(f)
-		err = decoder.Decode(&cfg)
-		if err == nil {
-			config = cfg
-			loaded = true
+	if len(os.Args) > 1 && os.Args[1] == sendFlag {
+		if len(os.Args) > 2 {
+			remote, err := openFiles(&application.Application, os.Args[2:], openHintSend)
+			failOnError(err)
+			if remote {
+				return
+			}
 		}
+		// The files are queued already, or none were given.
+		os.Args = os.Args[:1]
 	}
-	if !loaded {
-		ex, err := os.Executable()
-		if err != nil {
-			panic(err)
-		}
-		current := filepath.Dir(ex)
 
-		config.Client.Host = ""
-		config.Client.Port = "3214"
-		config.Server.Listen = false
-		config.Server.Port = "3214"
-		config.Server.Directory = current
-	}
+	// Launch the application
+	os.Exit(application.Run(os.Args))
 }
 
-func saveConfig() {
-	f, err := os.Create("config.yml")
+// QueueFile adds the file, or every file of the folder, to the list of
+// files to send. The files of a folder keep their paths on the peer.
+func QueueFile(name string) error {
+	logger.Info("queue file", "file", name)
+	stat, err := os.Stat(name)
 	if err != nil {
-		log.Println("unable to create config file")
-		return
+		return err
 	}
-	//noinspection GoUnhandledErrorResult
-	defer f.Close()
+	if !stat.IsDir() {
+		queueFile(OutFile{Name: name}, stat.Size())
+		return nil
+	}
+	base := filepath.Base(filepath.Clean(name))
+	queued := 0
+	err = walkFolder(name, func(local string, rel string, info os.FileInfo) error {
+		queueFile(OutFile{Name: local, Remote: base + "/" + rel}, info.Size())
+		queued++
+		return nil
+	})
+	if err == nil && queued == 0 {
+		err = errors.New("folder is empty")
+	}
+	return err
+}
 
-	encoder := yaml.NewEncoder(f)
-	err = encoder.Encode(config)
-	//noinspection GoUnhandledErrorResult
-	defer encoder.Close()
-	if err != nil {
-		log.Println("unable to save config file")
+func queueFile(f OutFile, size int64) {
+	f.Iter = addRow(treeStore, nil, f.Title(), ByteCountBinary(size))
+	filesMu.Lock()
+	files = append(files, f)
+	filesMu.Unlock()
+}
+
+// showPeerChooser opens the connect popover, unless connected already.
+func showPeerChooser() {
+	glib.IdleAdd(func() {
+		win.Present()
+		if buttonConnect.GetVisible() {
+			buttonConnect.Clicked()
+		}
+	})
+}
+
+// OpenConnectionURI connects to the peer of a siphon:// link,
+// directly or by meeting it on the relay.
+func OpenConnectionURI(link ConnectionURI) {
+	if link.Host != "" {
+		ConnectAsync(Profile{Host: link.Host, Port: link.Port, Secret: link.Secret, Key: link.Key})
 		return
 	}
+	RelayAsync(link.Relay, link.Code, link.Key, RoleSender)
+}
+
+func ConnectAsync(destination Profile) {
+	// IPv6 literals may be typed in URL form, brackets are added back by net.JoinHostPort.
+	destination.Host = strings.Trim(strings.TrimSpace(destination.Host), "[]")
+	config.Client.Host = destination.Host
+	config.Client.Port = destination.Port
+	addRecent(destination)
+	saveConfigAsync()
+
+	go func() {
+		err := RunClient(destination)
+		if err != nil {
+			showError("Failed to connect to %s: %s", destination.Address(), err)
+		}
+	}()
 }
 
-func StartServerAsync() {
+func SyncAsync(destination Profile, dir string) {
+	destination.Host = strings.Trim(strings.TrimSpace(destination.Host), "[]")
 	go func() {
-		log.Println("server start")
-		for StartServer() {
-			log.Println("restart server")
+		err := RunSync(destination, dir, func(plan SyncPlan) (bool, bool) {
+			var proceed, deletions bool
+			runOnMain(func() {
+				proceed, deletions = showSyncPreview(plan)
+			})
+			return proceed, deletions
+		})
+		if err != nil {
+			showError("Failed to sync %s to %s: %s", dir, destination.Address(), err)
 		}
-		log.Println("server stopped")
-		SetSubtitle("")
 	}()
 }
 
-func StartServer() bool {
-	if !config.Server.Listen {
-		return false
+// showSyncPreview lists the changes of a sync and asks to apply them,
+// deleting files on the peer is opt-in.
+func showSyncPreview(plan SyncPlan) (bool, bool) {
+	if len(plan.Send) == 0 && len(plan.Delete) == 0 {
+		showInfo("%s is up to date", plan.Folder)
+		return false, false
 	}
-	ip, err := GetIpAddr()
-	if err != nil {
-		ip = "Listening on port " + config.Server.Port
-	} else {
-		ip = "Listening on " + ip + ":" + config.Server.Port
+	var lines []string
+	var total int64
+	for _, e := range plan.Send {
+		total += e.Size
+		lines = append(lines, "+ "+e.Path)
 	}
-	log.Println("server ip", ip)
-	SetSubtitle(ip)
-	ip, err = Listen(config.Server.Port)
-	if err != nil {
-		log.Println("listening failed")
-		return false
-	}
-	ip = "Connected to " + ip
-	SetSubtitle(ip)
-	SwitchConnectionButton(true)
-	ReceiveFiles()
-	SendFiles()
-	_ = Disconnect()
-	StopServer()
-	SwitchConnectionButton(false)
-	return true
-}
-
-func StopServer() {
-	err := Disconnect()
-	if err != nil {
-		log.Println("unable to disconnect")
+	for _, p := range plan.Delete {
+		lines = append(lines, "- "+p)
 	}
-	err = StopListen()
+	if len(lines) > maxPreviewLines {
+		lines = append(lines[:maxPreviewLines], fmt.Sprintf("and %d more", len(lines)-maxPreviewLines))
+	}
+	dialog := gtk.MessageDialogNew(win, gtk.DIALOG_MODAL, gtk.MESSAGE_QUESTION, gtk.BUTTONS_OK_CANCEL,
+		"Sync %s: send %d files (%s), %d files are missing here",
+		plan.Folder, len(plan.Send), ByteCountBinary(total), len(plan.Delete))
+	dialog.FormatSecondaryText("%s", strings.Join(lines, "\n"))
+	deleteCheck, err := gtk.CheckButtonNewWithLabel("Delete them on the peer")
+	failOnError(err)
+	if !plan.AllowDelete {
+		deleteCheck.SetLabel("Delete them on the peer (not allowed by the peer)")
+		deleteCheck.SetSensitive(false)
+	}
+	if len(plan.Delete) > 0 {
+		area, err := dialog.GetMessageArea()
+		failOnError(err)
+		area.PackStart(deleteCheck, false, false, 0)
+		deleteCheck.Show()
+	}
+	response := dialog.Run()
+	deletions := deleteCheck.GetActive()
+	dialog.Destroy()
+	return response == gtk.RESPONSE_OK, deletions
+}
+
+// newBuilder loads the interface definition of the Glade file.
+func newBuilder(name string) (*gtk.Builder, error) {
+	data, err := uiFiles.ReadFile("ui/" + name)
 	if err != nil {
-		log.Println("unable to stop listening")
+		return nil, err
 	}
+	return gtk.BuilderNewFromString(string(data))
+}
+
+// showLocalSendRequest asks the user to take the files a LocalSend device
+// offers.
+func showLocalSendRequest(sender string, count int, size int64) bool {
+	dialog := gtk.MessageDialogNew(win, gtk.DIALOG_MODAL, gtk.MESSAGE_QUESTION, gtk.BUTTONS_OK_CANCEL,
+		"Receive %d files (%s) from %s via LocalSend?", count, ByteCountBinary(size), sender)
+	dialog.FormatSecondaryText("%s", "LocalSend devices don't know the pairing secret, anyone on the network may send.")
+	response := dialog.Run()
+	dialog.Destroy()
+	return response == gtk.RESPONSE_OK
 }
 
-func RunClient(host string, port string) error {
-	StopServer()
-	address := host + ":" + port
-	log.Println("connect to", address)
-	SetSubtitle("Connecting to " + address)
-	ip, err := Connect(address)
+// showRules opens the editor of the incoming files routing rules.
+func showRules() {
+	builder, err := newBuilder("sfn-rules.ui")
+	failOnError(err)
+
+	obj, err := builder.GetObject("rules_popover")
+	failOnError(err)
+	popover, err := isPopover(obj)
+	failOnError(err)
+
+	obj, err = builder.GetObject("rules_list")
+	failOnError(err)
+	rulesList, err := isListBox(obj)
+	failOnError(err)
+
+	obj, err = builder.GetObject("rule_name")
+	failOnError(err)
+	nameEntry, err := isEntry(obj)
+	failOnError(err)
+
+	obj, err = builder.GetObject("rule_extensions")
+	failOnError(err)
+	extensionsEntry, err := isEntry(obj)
+	failOnError(err)
+
+	obj, err = builder.GetObject("rule_mime_types")
+	failOnError(err)
+	mimeTypesEntry, err := isEntry(obj)
+	failOnError(err)
+
+	obj, err = builder.GetObject("rule_glob")
+	failOnError(err)
+	globEntry, err := isEntry(obj)
+	failOnError(err)
+
+	obj, err = builder.GetObject("rule_sender")
+	failOnError(err)
+	senderCombo, err := isComboBoxText(obj)
+	failOnError(err)
+	for _, profile := range config.Client.Profiles {
+		senderCombo.Append(profile.Name, profile.Title())
+	}
+
+	obj, err = builder.GetObject("rule_key")
+	failOnError(err)
+	keyEntry, err := isEntry(obj)
+	failOnError(err)
+
+	obj, err = builder.GetObject("rule_min_size")
+	failOnError(err)
+	minSizeSpin, err := isSpinButton(obj)
+	failOnError(err)
+
+	obj, err = builder.GetObject("rule_max_size")
+	failOnError(err)
+	maxSizeSpin, err := isSpinButton(obj)
+	failOnError(err)
+
+	obj, err = builder.GetObject("rule_directory")
+	failOnError(err)
+	dirEntry, err := isEntry(obj)
+	failOnError(err)
+
+	obj, err = builder.GetObject("rule_select_dir")
+	failOnError(err)
+	selectDirButton, err := isButton(obj)
+	failOnError(err)
+
+	obj, err = builder.GetObject("rule_action")
+	failOnError(err)
+	actionCombo, err := isComboBoxText(obj)
+	failOnError(err)
+
+	obj, err = builder.GetObject("rule_save")
+	failOnError(err)
+	saveButton, err := isButton(obj)
+	failOnError(err)
+
+	obj, err = builder.GetObject("rule_test")
+	failOnError(err)
+	testEntry, err := isEntry(obj)
+	failOnError(err)
+
+	obj, err = builder.GetObject("rule_test_result")
+	failOnError(err)
+	testLabel, err := isLabel(obj)
+	failOnError(err)
+
+	// Name of the rule loaded into the fields for editing.
+	editing := ""
+	load := func(route Route) {
+		editing = route.Name
+		nameEntry.SetText(route.Name)
+		extensionsEntry.SetText(strings.Join(route.Extensions, ", "))
+		mimeTypesEntry.SetText(strings.Join(route.MimeTypes, ", "))
+		globEntry.SetText(route.Glob)
+		if route.Sender == "" || !senderCombo.SetActiveID(route.Sender) {
+			senderCombo.SetActiveID("any")
+		}
+		keyEntry.SetText(route.Key)
+		minSizeSpin.SetValue(float64(route.MinSize))
+		maxSizeSpin.SetValue(float64(route.MaxSize))
+		dirEntry.SetText(route.Directory)
+		if route.Action == ActionNone {
+			actionCombo.SetActiveID("none")
+		} else {
+			actionCombo.SetActiveID(route.Action)
+		}
+	}
+	load(Route{Directory: config.Server.Directory})
+
+	test := func() {
+		name, err := testEntry.GetText()
+		failOnError(err)
+		testLabel.SetText(DescribeRoutes(config.Routes, strings.TrimSpace(name)))
+	}
+	_ = testEntry.Connect("changed", test)
+
+	var fillRules func()
+	fillRules = func() {
+		if children := rulesList.GetChildren(); children != nil {
+			children.Foreach(func(item interface{}) {
+				rulesList.Remove(item.(*gtk.Widget))
+			})
+		}
+		for i, route := range config.Routes {
+			route := route
+			addRuleRow(rulesList, route.Name+" → "+route.Directory, i > 0, func() {
+				raiseRoute(route.Name)
+				saveConfigAsync()
+				fillRules()
+			}, func() {
+				load(route)
+			}, func() {
+				deleteRoute(route.Name)
+				saveConfigAsync()
+				fillRules()
+			})
+		}
+		rulesList.SetVisible(len(config.Routes) > 0)
+		test()
+	}
+	fillRules()
+
+	_ = selectDirButton.Connect("clicked", func() {
+		dialog, err := gtk.FileChooserNativeDialogNew("Select rule directory", win, gtk.FILE_CHOOSER_ACTION_SELECT_FOLDER, "Select", "Cancel")
+		failOnError(err)
+		dialog.SetModal(true)
+		v := dialog.Run()
+		if v == int(gtk.RESPONSE_ACCEPT) {
+			dirEntry.SetText(dialog.GetFilename())
+		}
+	})
+
+	_ = saveButton.Connect("clicked", func() {
+		var route Route
+		var err error
+		var extensions, mimeTypes string
+		route.Name, err = nameEntry.GetText()
+		failOnError(err)
+		extensions, err = extensionsEntry.GetText()
+		failOnError(err)
+		route.Extensions = splitList(extensions)
+		mimeTypes, err = mimeTypesEntry.GetText()
+		failOnError(err)
+		route.MimeTypes = splitList(mimeTypes)
+		route.Glob, err = globEntry.GetText()
+		failOnError(err)
+		route.Glob = strings.TrimSpace(route.Glob)
+		if sender := senderCombo.GetActiveID(); sender != "any" {
+			route.Sender = sender
+		}
+		route.Key, err = keyEntry.GetText()
+		failOnError(err)
+		route.Key = strings.TrimSpace(route.Key)
+		route.MinSize = minSizeSpin.GetValueAsInt()
+		route.MaxSize = maxSizeSpin.GetValueAsInt()
+		route.Directory, err = dirEntry.GetText()
+		failOnError(err)
+		route.Directory = strings.TrimSpace(route.Directory)
+		if action := actionCombo.GetActiveID(); action != "none" {
+			route.Action = action
+		}
+
+		if err := putRoute(editing, route); err != nil {
+			showError("Unable to save rule: %s", err)
+			return
+		}
+		load(Route{Directory: config.Server.Directory})
+		saveConfigAsync()
+		fillRules()
+	})
+
+	popover.SetRelativeTo(buttonSettings)
+	popover.Show()
+}
+
+func BroadcastAsync(destinations []Profile) {
+	sort.Slice(destinations, func(i, j int) bool {
+		return destinations[i].Title() < destinations[j].Title()
+	})
+	for _, d := range destinations {
+		addRecent(d)
+	}
+	saveConfigAsync()
+
+	go func() {
+		errs := RunBroadcast(destinations)
+		sent := 0
+		lines := make([]string, len(destinations))
+		for i, d := range destinations {
+			if errs[i] == nil {
+				sent++
+				lines[i] = d.Title() + ": sent"
+			} else {
+				lines[i] = d.Title() + ": failed, " + errs[i].Error()
+			}
+		}
+		summary := strings.Join(lines, "\n")
+		if sent == len(destinations) {
+			showInfo("Sent to all %d destinations\n\n%s", sent, summary)
+		} else {
+			showError("Sent to %d of %d destinations\n\n%s", sent, len(destinations), summary)
+		}
+	}()
+}
+
+func LocalSendAsync(device LocalSendPeer) {
+	l := localSend
+	go func() {
+		if err := SendLocalSend(l, device); err != nil {
+			showError("Failed to send to %s: %s", device.Title(), err)
+		}
+	}()
+}
+
+func RelayAsync(address string, code string, key string, role byte) {
+	go func() {
+		err := RunRelay(address, code, key, role)
+		if err != nil && err != context.Canceled {
+			showError("Relay connection failed: %s", err)
+		}
+	}()
+}
+
+// configWriteMu orders the config writes, configSnapshots counts the
+// encoded configs and configWritten is the last one written.
+var configWriteMu sync.Mutex
+var configSnapshots, configWritten uint64
+
+// saveConfigAsync encodes the config on the main thread, which changes it,
+// and writes it in the background. A snapshot older than the one written
+// already is dropped.
+func saveConfigAsync() {
+	data, err := encodeConfig(&config)
 	if err != nil {
-		log.Println("unable to connect")
-	} else {
-		ip = "Connected to " + address
-		SetSubtitle(ip)
-		SendFiles()
-		ReceiveFiles()
-		_ = Disconnect()
-	}
-	SwitchConnectionButton(false)
-	StartServerAsync()
-	return err
+		logger.Error("unable to encode config", "error", err)
+		showError("Unable to save settings: %s", err)
+		return
+	}
+	configSnapshots++
+	snapshot := configSnapshots
+	go func() {
+		configWriteMu.Lock()
+		defer configWriteMu.Unlock()
+		if snapshot < configWritten {
+			return
+		}
+		if err := writeConfig(data); err != nil {
+			logger.Error("unable to save config file", "error", err)
+			showError("Unable to save settings: %s", err)
+			return
+		}
+		configWritten = snapshot
+	}()
 }
 
 func GetIpAddr() (string, error) {
@@ -471,54 +1432,8 @@ func GetIpAddr() (string, error) {
 	return string(line), nil
 }
 
-func ReceiveFiles() {
-	var iter *gtk.TreeIter
-	for {
-		more, err := ReadFile(config.Server.Directory, func(name string, size int64) {
-			iter = addRow(treeStore, name, ByteCountBinary(size))
-		}, func(p int) {
-			err := treeStore.SetValue(iter, ColumnProgress, p)
-			if err != nil {
-				log.Fatal("unable set value:", err)
-			}
-		})
-		if err != nil {
-			showError("File receiving error")
-			break
-		}
-		if !more {
-			log.Println("done receiving files")
-			break
-		}
-		log.Println("receive next file")
-	}
-}
-
-func SendFiles() {
-	var err error
-	if len(files) > 0 {
-		for _, outFile := range files {
-			if outFile.IsDone {
-				continue
-			}
-			err = SendFile(outFile.Name, func(p int) {
-				err := treeStore.SetValue(outFile.Iter, ColumnProgress, p)
-				if err != nil {
-					log.Fatal("unable set value:", err)
-				}
-			})
-			if err != nil {
-				break
-			}
-			outFile.IsDone = true
-		}
-	}
-	if err == nil {
-		err = SendDone()
-	}
-	if err != nil {
-		showError("File sending error")
-	}
+func SwitchShareButton(visible bool) {
+	glib.IdleAdd(func() { buttonShare.SetVisible(visible) })
 }
 
 func SwitchConnectionButton(connected bool) {
@@ -555,6 +1470,22 @@ func isPopover(obj glib.IObject) (*gtk.Popover, error) {
 	return nil, errors.New("not a *gtk.Popover")
 }
 
+func isStack(obj glib.IObject) (*gtk.Stack, error) {
+	// Make type assertion (as per gtk.go).
+	if stack, ok := obj.(*gtk.Stack); ok {
+		return stack, nil
+	}
+	return nil, errors.New("not a *gtk.Stack")
+}
+
+func isTextView(obj glib.IObject) (*gtk.TextView, error) {
+	// Make type assertion (as per gtk.go).
+	if textView, ok := obj.(*gtk.TextView); ok {
+		return textView, nil
+	}
+	return nil, errors.New("not a *gtk.TextView")
+}
+
 func isSwitch(obj glib.IObject) (*gtk.Switch, error) {
 	// Make type assertion (as per gtk.go).
 	if switchWidget, ok := obj.(*gtk.Switch); ok {
@@ -579,6 +1510,54 @@ func isButton(obj glib.IObject) (*gtk.Button, error) {
 	return nil, errors.New("not a *gtk.Button")
 }
 
+func isComboBoxText(obj glib.IObject) (*gtk.ComboBoxText, error) {
+	// Make type assertion (as per gtk.go).
+	if combo, ok := obj.(*gtk.ComboBoxText); ok {
+		return combo, nil
+	}
+	return nil, errors.New("not a *gtk.ComboBoxText")
+}
+
+func isSpinButton(obj glib.IObject) (*gtk.SpinButton, error) {
+	// Make type assertion (as per gtk.go).
+	if spin, ok := obj.(*gtk.SpinButton); ok {
+		return spin, nil
+	}
+	return nil, errors.New("not a *gtk.SpinButton")
+}
+
+func isBox(obj glib.IObject) (*gtk.Box, error) {
+	// Make type assertion (as per gtk.go).
+	if box, ok := obj.(*gtk.Box); ok {
+		return box, nil
+	}
+	return nil, errors.New("not a *gtk.Box")
+}
+
+func isImage(obj glib.IObject) (*gtk.Image, error) {
+	// Make type assertion (as per gtk.go).
+	if image, ok := obj.(*gtk.Image); ok {
+		return image, nil
+	}
+	return nil, errors.New("not a *gtk.Image")
+}
+
+func isLabel(obj glib.IObject) (*gtk.Label, error) {
+	// Make type assertion (as per gtk.go).
+	if label, ok := obj.(*gtk.Label); ok {
+		return label, nil
+	}
+	return nil, errors.New("not a *gtk.Label")
+}
+
+func isListBox(obj glib.IObject) (*gtk.ListBox, error) {
+	// Make type assertion (as per gtk.go).
+	if list, ok := obj.(*gtk.ListBox); ok {
+		return list, nil
+	}
+	return nil, errors.New("not a *gtk.ListBox")
+}
+
 func isTreeView(obj glib.IObject) (*gtk.TreeView, error) {
 	// Make type assertion (as per gtk.go).
 	if tree, ok := obj.(*gtk.TreeView); ok {
@@ -622,10 +1601,121 @@ func createProgressColumn(title string, id int) *gtk.TreeViewColumn {
 	return column
 }
 
-// Append a toplevel row to the tree store for the tree view
-func addRow(treeStore *gtk.ListStore, name string, size string) *gtk.TreeIter {
-	// Get an iterator for a new row at the end of the list store
-	i := treeStore.Append()
+// Append a connection destination row with select, connect, edit and delete actions
+func addProfileRow(list *gtk.ListBox, title string, onSelect func(active bool), onConnect func(), onEdit func(), onDelete func()) {
+	row, err := gtk.ListBoxRowNew()
+	failOnError(err)
+	box, err := gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, 2)
+	failOnError(err)
+
+	check, err := gtk.CheckButtonNew()
+	failOnError(err)
+	check.SetTooltipText("Select for sending to several destinations")
+	_ = check.Connect("toggled", func() {
+		onSelect(check.GetActive())
+	})
+	box.PackStart(check, false, false, 0)
+
+	label, err := gtk.LabelNew(title)
+	failOnError(err)
+	label.SetXAlign(0)
+	connectButton, err := gtk.ButtonNew()
+	failOnError(err)
+	connectButton.SetRelief(gtk.RELIEF_NONE)
+	connectButton.SetTooltipText("Connect")
+	connectButton.Add(label)
+	_ = connectButton.Connect("clicked", onConnect)
+	box.PackStart(connectButton, true, true, 0)
+
+	editButton, err := gtk.ButtonNewFromIconName("document-edit-symbolic", gtk.ICON_SIZE_BUTTON)
+	failOnError(err)
+	editButton.SetRelief(gtk.RELIEF_NONE)
+	editButton.SetTooltipText("Edit")
+	_ = editButton.Connect("clicked", onEdit)
+	box.PackStart(editButton, false, false, 0)
+
+	deleteButton, err := gtk.ButtonNewFromIconName("edit-delete-symbolic", gtk.ICON_SIZE_BUTTON)
+	failOnError(err)
+	deleteButton.SetRelief(gtk.RELIEF_NONE)
+	deleteButton.SetTooltipText("Delete")
+	_ = deleteButton.Connect("clicked", onDelete)
+	box.PackStart(deleteButton, false, false, 0)
+
+	row.Add(box)
+	row.ShowAll()
+	list.Add(row)
+}
+
+// Append a nearby device row sending the queued files to it
+func addDeviceRow(list *gtk.ListBox, title string, onSend func()) {
+	row, err := gtk.ListBoxRowNew()
+	failOnError(err)
+	box, err := gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, 2)
+	failOnError(err)
+
+	icon, err := gtk.ImageNewFromIconName("network-wireless-symbolic", gtk.ICON_SIZE_BUTTON)
+	failOnError(err)
+	box.PackStart(icon, false, false, 0)
+
+	label, err := gtk.LabelNew(title)
+	failOnError(err)
+	label.SetXAlign(0)
+	sendButton, err := gtk.ButtonNew()
+	failOnError(err)
+	sendButton.SetRelief(gtk.RELIEF_NONE)
+	sendButton.SetTooltipText("Send the queued files")
+	sendButton.Add(label)
+	_ = sendButton.Connect("clicked", onSend)
+	box.PackStart(sendButton, true, true, 0)
+
+	row.Add(box)
+	row.ShowAll()
+	list.Add(row)
+}
+
+// Append a routing rule row with raise, edit and delete actions
+func addRuleRow(list *gtk.ListBox, title string, canRaise bool, onRaise func(), onEdit func(), onDelete func()) {
+	row, err := gtk.ListBoxRowNew()
+	failOnError(err)
+	box, err := gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, 2)
+	failOnError(err)
+
+	label, err := gtk.LabelNew(title)
+	failOnError(err)
+	label.SetXAlign(0)
+	box.PackStart(label, true, true, 4)
+
+	raiseButton, err := gtk.ButtonNewFromIconName("go-up-symbolic", gtk.ICON_SIZE_BUTTON)
+	failOnError(err)
+	raiseButton.SetRelief(gtk.RELIEF_NONE)
+	raiseButton.SetTooltipText("Check before the previous rule")
+	raiseButton.SetSensitive(canRaise)
+	_ = raiseButton.Connect("clicked", onRaise)
+	box.PackStart(raiseButton, false, false, 0)
+
+	editButton, err := gtk.ButtonNewFromIconName("document-edit-symbolic", gtk.ICON_SIZE_BUTTON)
+	failOnError(err)
+	editButton.SetRelief(gtk.RELIEF_NONE)
+	editButton.SetTooltipText("Edit")
+	_ = editButton.Connect("clicked", onEdit)
+	box.PackStart(editButton, false, false, 0)
+
+	deleteButton, err := gtk.ButtonNewFromIconName("edit-delete-symbolic", gtk.ICON_SIZE_BUTTON)
+	failOnError(err)
+	deleteButton.SetRelief(gtk.RELIEF_NONE)
+	deleteButton.SetTooltipText("Delete")
+	_ = deleteButton.Connect("clicked", onDelete)
+	box.PackStart(deleteButton, false, false, 0)
+
+	row.Add(box)
+	row.ShowAll()
+	list.Add(row)
+}
+
+// Append a row to the tree store for the tree view, toplevel for nil parent
+func addRow(treeStore *gtk.TreeStore, parent *gtk.TreeIter, name string, size string) *gtk.TreeIter {
+	// Get an iterator for a new row at the end of the tree store
+	i := treeStore.Append(parent)
 
 	// Set the contents of the tree store row that the iterator represents
 	err := treeStore.SetValue(i, ColumnName, name)
@@ -640,9 +1730,23 @@ func addRow(treeStore *gtk.ListStore, name string, size string) *gtk.TreeIter {
 	if err != nil {
 		log.Fatal("Unable set value:", err)
 	}
+	publishControl(ControlEvent{Event: eventAdded, Path: rowPath(i), Name: name, Size: size})
 	return i
 }
 
+// Render the text as a QR code image
+func qrPixbuf(text string) (*gdk.Pixbuf, error) {
+	png, err := qrcode.Encode(text, qrcode.Medium, qrCodeSize)
+	if err != nil {
+		return nil, err
+	}
+	loader, err := gdk.PixbufLoaderNew()
+	if err != nil {
+		return nil, err
+	}
+	return loader.WriteAndReturnPixbuf(png)
+}
+
 func failOnError(e error) {
 	if e != nil {
 		// panic for any errors.
@@ -660,11 +1764,21 @@ func showError(format string, a ...interface{}) {
 	})
 }
 
+func showInfo(format string, a ...interface{}) {
+	glib.IdleAdd(func() {
+		dialog := gtk.MessageDialogNew(win, gtk.DIALOG_MODAL, gtk.MESSAGE_INFO, gtk.BUTTONS_CLOSE, format, a...)
+		_ = dialog.Connect("response", func() {
+			dialog.Hide()
+		})
+		dialog.Show()
+	})
+}
+
 // onMainWindowDestroy is the callback that is linked to the
 // on_main_window_destroy handler. It is not required to map this,
 // and is here to simply demo how to hook-up custom callbacks.
 func onMainWindowDestroy() {
-	log.Println("onMainWindowDestroy")
+	logger.Debug("main window destroyed")
 }
 
 func ByteCountBinary(b int64) string {
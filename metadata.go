@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// Bounds of the extended attributes carried in a file header.
+const (
+	maxXattrs      = 256
+	maxXattrsBytes = 65536
+	// maxXattrName is XATTR_NAME_MAX of Linux.
+	maxXattrName = 255
+)
+
+// FileMeta is the metadata sent after the size in the file header: the
+// modification time in Unix nanoseconds, the permission bits and the
+// extended attributes, each one a name line with a length-prefixed value.
+type FileMeta struct {
+	ModTime time.Time
+	Mode    os.FileMode
+	Xattrs  map[string][]byte
+}
+
+// statMeta collects the metadata of the file to send.
+func statMeta(name string, stat os.FileInfo) FileMeta {
+	meta := FileMeta{
+		ModTime: stat.ModTime(),
+		Mode:    stat.Mode() & os.ModePerm,
+	}
+	xattrs, err := readXattrs(name)
+	if err != nil {
+		logger.Warn("unable to read extended attributes", "file", name, "error", err)
+	}
+	size := 0
+	for key, value := range xattrs {
+		size += len(key) + len(value)
+		if len(meta.Xattrs) == maxXattrs || size > maxXattrsBytes {
+			logger.Warn("too many extended attributes, the rest are not sent", "file", name)
+			break
+		}
+		if meta.Xattrs == nil {
+			meta.Xattrs = make(map[string][]byte)
+		}
+		meta.Xattrs[key] = value
+	}
+	return meta
+}
+
+func writeMeta(w *bufio.Writer, meta FileMeta) error {
+	fields := []interface{}{
+		meta.ModTime.UnixNano(),
+		uint32(meta.Mode & os.ModePerm),
+		uint16(len(meta.Xattrs)),
+	}
+	for _, field := range fields {
+		if err := binary.Write(w, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	for key, value := range meta.Xattrs {
+		if _, err := w.WriteString(key + "\n"); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, uint32(len(value))); err != nil {
+			return err
+		}
+		if _, err := w.Write(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readMeta(r *bufio.Reader) (FileMeta, error) {
+	var meta FileMeta
+	var mtime int64
+	var mode uint32
+	var count uint16
+	for _, field := range []interface{}{&mtime, &mode, &count} {
+		if err := binary.Read(r, binary.LittleEndian, field); err != nil {
+			return meta, err
+		}
+	}
+	meta.ModTime = time.Unix(0, mtime)
+	meta.Mode = os.FileMode(mode) & os.ModePerm
+	if count > maxXattrs {
+		return meta, errors.New("too many extended attributes")
+	}
+	size := 0
+	for i := 0; i < int(count); i++ {
+		key, err := readBoundedLine(r, maxXattrName)
+		if err != nil {
+			return meta, err
+		}
+		var length uint32
+		if err = binary.Read(r, binary.LittleEndian, &length); err != nil {
+			return meta, err
+		}
+		size += len(key) + int(length)
+		if size > maxXattrsBytes {
+			return meta, errors.New("extended attributes are too large")
+		}
+		value := make([]byte, length)
+		if _, err = io.ReadFull(r, value); err != nil {
+			return meta, err
+		}
+		if meta.Xattrs == nil {
+			meta.Xattrs = make(map[string][]byte)
+		}
+		meta.Xattrs[key] = value
+	}
+	return meta, nil
+}
+
+// readBoundedLine reads a line of at most max bytes, without the newline.
+func readBoundedLine(r *bufio.Reader, max int) (string, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == '\n' {
+			return string(line), nil
+		}
+		if len(line) == max {
+			return "", errors.New("line is too long")
+		}
+		line = append(line, b)
+	}
+}
+
+// receivedMode limits the permission bits of the sender to those the file
+// got from the receiver's umask, so nothing becomes writable or readable
+// by more users than usual. Executable bits stay for those who may read.
+func receivedMode(sent os.FileMode, created os.FileMode) os.FileMode {
+	mode := sent & created & 0666
+	return mode | sent&0111&(mode>>2)
+}
+
+// applyMeta sets the metadata the policy honours on the received file.
+// Failures are logged only, the content is there already.
+func applyMeta(target string, meta FileMeta, policy ReceivePolicy) {
+	if policy.KeepXattrs && len(meta.Xattrs) > 0 {
+		assertError(writeXattrs(target, meta.Xattrs), "unable to set extended attributes")
+	}
+	if policy.KeepMode {
+		if stat, err := os.Stat(target); !assertError(err, "unable to get file info") {
+			assertError(os.Chmod(target, receivedMode(meta.Mode, stat.Mode())), "unable to set file mode")
+		}
+	}
+	// The modification time goes last, the other changes may touch it.
+	if policy.KeepModTime {
+		assertError(os.Chtimes(target, time.Now(), meta.ModTime), "unable to set modification time")
+	}
+}
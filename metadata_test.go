@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReceivedMode(t *testing.T) {
+	cases := []struct {
+		sent, created, want os.FileMode
+	}{
+		{0777, 0644, 0755},
+		{0666, 0644, 0644},
+		{0700, 0644, 0700},
+		{0755, 0600, 0700},
+		{0640, 0644, 0640},
+		{0111, 0644, 0000},
+	}
+	for _, c := range cases {
+		if got := receivedMode(c.sent, c.created); got != c.want {
+			t.Errorf("receivedMode(%o, %o) = %o, want %o", c.sent, c.created, got, c.want)
+		}
+	}
+}
+
+func TestMetaRoundTrip(t *testing.T) {
+	meta := FileMeta{
+		ModTime: time.Unix(1600000000, 42),
+		Mode:    0754,
+		Xattrs:  map[string][]byte{"user.a": []byte("1"), "user.b": nil},
+	}
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := writeMeta(w, meta); err != nil {
+		t.Fatal(err)
+	}
+	_ = w.Flush()
+	got, err := readMeta(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.ModTime.Equal(meta.ModTime) || got.Mode != meta.Mode || len(got.Xattrs) != 2 || string(got.Xattrs["user.a"]) != "1" {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestReadMetaLongXattrName(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	meta := FileMeta{Xattrs: map[string][]byte{"user." + strings.Repeat("x", maxXattrName): nil}}
+	if err := writeMeta(w, meta); err != nil {
+		t.Fatal(err)
+	}
+	_ = w.Flush()
+	if _, err := readMeta(bufio.NewReader(&buf)); err == nil {
+		t.Error("a too long name is accepted")
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics of the protocol layer, exposed in the Prometheus text format.
+// Every session counts into them, whatever started it.
+
+// Counter only goes up.
+type Counter struct {
+	value uint64
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+func (c *Counter) write(w io.Writer, name string, labels string) {
+	_, _ = fmt.Fprintf(w, "%s%s %d\n", name, labelSet(labels), atomic.LoadUint64(&c.value))
+}
+
+// Gauge goes up and down.
+type Gauge struct {
+	value int64
+}
+
+func (g *Gauge) Add(n int64) {
+	atomic.AddInt64(&g.value, n)
+}
+
+func (g *Gauge) write(w io.Writer, name string, labels string) {
+	_, _ = fmt.Fprintf(w, "%s%s %d\n", name, labelSet(labels), atomic.LoadInt64(&g.value))
+}
+
+// Histogram counts the observations into buckets of upper bounds.
+type Histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds ...float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) write(w io.Writer, name string, labels string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		le := `le="` + strconv.FormatFloat(bound, 'g', -1, 64) + `"`
+		_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", name, labelSet(labels, le), h.counts[i])
+	}
+	_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", name, labelSet(labels, `le="+Inf"`), h.count)
+	_, _ = fmt.Fprintf(w, "%s_sum%s %s\n", name, labelSet(labels), strconv.FormatFloat(h.sum, 'g', -1, 64))
+	_, _ = fmt.Fprintf(w, "%s_count%s %d\n", name, labelSet(labels), h.count)
+}
+
+func labelSet(labels ...string) string {
+	var set []string
+	for _, l := range labels {
+		if l != "" {
+			set = append(set, l)
+		}
+	}
+	if len(set) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(set, ",") + "}"
+}
+
+// Results of a file transfer.
+const (
+	resultCompleted = "completed"
+	resultFailed    = "failed"
+	resultRejected  = "rejected"
+)
+
+// fileMetrics are the metrics of files going one way.
+type fileMetrics struct {
+	results    map[string]*Counter
+	throughput *Histogram
+}
+
+func newFileMetrics() fileMetrics {
+	return fileMetrics{
+		results: map[string]*Counter{
+			resultCompleted: {},
+			resultFailed:    {},
+			resultRejected:  {},
+		},
+		// Bytes per second, from 64 KiB/s to 1 GiB/s.
+		throughput: newHistogram(1<<16, 1<<18, 1<<20, 1<<22, 1<<24, 1<<26, 1<<28, 1<<30),
+	}
+}
+
+// done counts a file, the throughput only for the completed ones.
+func (m fileMetrics) done(result string, size int64, started time.Time) {
+	m.results[result].Add(1)
+	if elapsed := time.Since(started).Seconds(); result == resultCompleted && size > 0 && elapsed > 0 {
+		m.throughput.Observe(float64(size) / elapsed)
+	}
+}
+
+var (
+	metricBytesSent     = &Counter{}
+	metricBytesReceived = &Counter{}
+	metricFilesSent     = newFileMetrics()
+	metricFilesReceived = newFileMetrics()
+	metricSessions      = map[string]*Counter{
+		resultCompleted: {},
+		resultFailed:    {},
+	}
+	metricActiveSessions = &Gauge{}
+	// Seconds, from a second to a day.
+	metricSessionDuration = newHistogram(1, 5, 30, 60, 300, 900, 3600, 4*3600, 24*3600)
+)
+
+type metricWriter interface {
+	write(w io.Writer, name string, labels string)
+}
+
+type metricSeries struct {
+	labels string
+	metric metricWriter
+}
+
+type metricFamily struct {
+	name   string
+	help   string
+	kind   string
+	series []metricSeries
+}
+
+func metricFamilies() []metricFamily {
+	files := func(m fileMetrics) []metricSeries {
+		return []metricSeries{
+			{`result="` + resultCompleted + `"`, m.results[resultCompleted]},
+			{`result="` + resultFailed + `"`, m.results[resultFailed]},
+			{`result="` + resultRejected + `"`, m.results[resultRejected]},
+		}
+	}
+	return []metricFamily{
+		{"siphon_sent_bytes_total", "Bytes written to peers.", "counter",
+			[]metricSeries{{"", metricBytesSent}}},
+		{"siphon_received_bytes_total", "Bytes read from peers.", "counter",
+			[]metricSeries{{"", metricBytesReceived}}},
+		{"siphon_sent_files_total", "Files sent by result.", "counter",
+			files(metricFilesSent)},
+		{"siphon_received_files_total", "Files received by result.", "counter",
+			files(metricFilesReceived)},
+		{"siphon_sent_file_throughput_bytes_per_second", "Throughput of the completed sent files.", "histogram",
+			[]metricSeries{{"", metricFilesSent.throughput}}},
+		{"siphon_received_file_throughput_bytes_per_second", "Throughput of the completed received files.", "histogram",
+			[]metricSeries{{"", metricFilesReceived.throughput}}},
+		{"siphon_sessions_total", "Finished sessions by result.", "counter", []metricSeries{
+			{`result="` + resultCompleted + `"`, metricSessions[resultCompleted]},
+			{`result="` + resultFailed + `"`, metricSessions[resultFailed]},
+		}},
+		{"siphon_active_sessions", "Sessions connected now.", "gauge",
+			[]metricSeries{{"", metricActiveSessions}}},
+		{"siphon_session_duration_seconds", "Duration of the finished sessions.", "histogram",
+			[]metricSeries{{"", metricSessionDuration}}},
+	}
+}
+
+// WriteMetrics writes all the metrics in the Prometheus text format.
+func WriteMetrics(w io.Writer) {
+	for _, family := range metricFamilies() {
+		_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind)
+		for _, series := range family.series {
+			series.metric.write(w, family.name, series.labels)
+		}
+	}
+}
+
+// MetricsServer serves the metrics at /metrics.
+type MetricsServer struct {
+	server *http.Server
+}
+
+func StartMetricsServer(address string) (*MetricsServer, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteMetrics(w)
+	})
+	m := &MetricsServer{server: &http.Server{Handler: mux}}
+	go func() {
+		if err := m.server.Serve(ln); err != http.ErrServerClosed {
+			logger.Error("metrics server failed", "error", err)
+		}
+	}()
+	logger.Info("serving metrics", "address", ln.Addr().String())
+	return m, nil
+}
+
+func (m *MetricsServer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return m.server.Shutdown(ctx)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// NAT-PMP (RFC 6886) and PCP (RFC 6887) share the gateway port
+// and the retransmission scheme.
+const (
+	natpmpPort     = 5351
+	natpmpRetries  = 4
+	natpmpInterval = 250 * time.Millisecond
+
+	natpmpVersion = 0
+	pcpVersion    = 2
+
+	natpmpOpExternalAddress = 0
+	natpmpOpMapTCP          = 2
+	pcpOpMap                = 1
+	pcpProtocolTCP          = 6
+)
+
+// gatewayRequest sends the request to the gateway and waits for a reply
+// with the same version and opcode, retransmitting with doubling timeouts.
+func gatewayRequest(gateway *net.UDPAddr, request []byte, opcode byte) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, gateway)
+	if err != nil {
+		return nil, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer conn.Close()
+
+	response := make([]byte, 1100)
+	timeout := natpmpInterval
+	for i := 0; i < natpmpRetries; i++ {
+		if _, err = conn.Write(request); err != nil {
+			return nil, err
+		}
+		if err = conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+		for {
+			n, err := conn.Read(response)
+			if err != nil {
+				break
+			}
+			if n >= 4 && response[0] == request[0] && response[1] == 0x80|opcode {
+				return response[:n], nil
+			}
+			if n >= 4 && response[0] != request[0] {
+				return nil, fmt.Errorf("gateway speaks version %d", response[0])
+			}
+		}
+		timeout *= 2
+	}
+	return nil, errors.New("no reply from gateway")
+}
+
+// natpmpMapper and pcpMapper talk to the gateway at its NAT-PMP port.
+type natpmpMapper struct {
+	gateway *net.UDPAddr
+}
+
+func (m *natpmpMapper) Name() string {
+	return "NAT-PMP"
+}
+
+func (m *natpmpMapper) Add(internal int, external int, lifetime time.Duration) (net.IP, int, time.Duration, error) {
+	response, err := gatewayRequest(m.gateway, []byte{natpmpVersion, natpmpOpExternalAddress}, natpmpOpExternalAddress)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if len(response) < 12 {
+		return nil, 0, 0, errors.New("short reply")
+	}
+	if result := binary.BigEndian.Uint16(response[2:]); result != 0 {
+		return nil, 0, 0, fmt.Errorf("result code %d", result)
+	}
+	ip := net.IP(append([]byte(nil), response[8:12]...))
+
+	port, lease, err := m.mapTCP(internal, external, lifetime)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return ip, port, lease, nil
+}
+
+func (m *natpmpMapper) Remove(internal int, external int) error {
+	_, _, err := m.mapTCP(internal, 0, 0)
+	return err
+}
+
+func (m *natpmpMapper) mapTCP(internal int, external int, lifetime time.Duration) (int, time.Duration, error) {
+	request := make([]byte, 12)
+	request[0] = natpmpVersion
+	request[1] = natpmpOpMapTCP
+	binary.BigEndian.PutUint16(request[4:], uint16(internal))
+	binary.BigEndian.PutUint16(request[6:], uint16(external))
+	binary.BigEndian.PutUint32(request[8:], uint32(lifetime/time.Second))
+	response, err := gatewayRequest(m.gateway, request, natpmpOpMapTCP)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(response) < 16 {
+		return 0, 0, errors.New("short reply")
+	}
+	if result := binary.BigEndian.Uint16(response[2:]); result != 0 {
+		return 0, 0, fmt.Errorf("result code %d", result)
+	}
+	port := int(binary.BigEndian.Uint16(response[10:]))
+	lease := time.Duration(binary.BigEndian.Uint32(response[12:])) * time.Second
+	return port, lease, nil
+}
+
+type pcpMapper struct {
+	gateway *net.UDPAddr
+	nonce   []byte
+}
+
+func (m *pcpMapper) Name() string {
+	return "PCP"
+}
+
+func (m *pcpMapper) Add(internal int, external int, lifetime time.Duration) (net.IP, int, time.Duration, error) {
+	if m.nonce == nil {
+		m.nonce = make([]byte, 12)
+		if _, err := rand.Read(m.nonce); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	return m.request(internal, external, lifetime)
+}
+
+func (m *pcpMapper) Remove(internal int, external int) error {
+	_, _, _, err := m.request(internal, external, 0)
+	return err
+}
+
+func (m *pcpMapper) request(internal int, external int, lifetime time.Duration) (net.IP, int, time.Duration, error) {
+	local, err := localAddressTo(m.gateway.IP.String())
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	request := make([]byte, 60)
+	request[0] = pcpVersion
+	request[1] = pcpOpMap
+	binary.BigEndian.PutUint32(request[4:], uint32(lifetime/time.Second))
+	copy(request[8:24], local.To16())
+	copy(request[24:36], m.nonce)
+	request[36] = pcpProtocolTCP
+	binary.BigEndian.PutUint16(request[40:], uint16(internal))
+	binary.BigEndian.PutUint16(request[42:], uint16(external))
+	// Any IPv4 address as the suggested external one.
+	copy(request[44:60], net.IPv4zero.To16())
+
+	response, err := gatewayRequest(m.gateway, request, pcpOpMap)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if len(response) < 60 {
+		return nil, 0, 0, errors.New("short reply")
+	}
+	if result := response[3]; result != 0 {
+		return nil, 0, 0, fmt.Errorf("result code %d", result)
+	}
+	lease := time.Duration(binary.BigEndian.Uint32(response[4:])) * time.Second
+	port := int(binary.BigEndian.Uint16(response[42:]))
+	ip := net.IP(append([]byte(nil), response[44:60]...))
+	return ip, port, lease, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// Listener address families, used as the network argument of net.Listen.
+const (
+	NetworkDualStack = "tcp"
+	NetworkIPv4      = "tcp4"
+	NetworkIPv6      = "tcp6"
+)
+
+func validateNetwork(network string, bind string) error {
+	switch network {
+	case NetworkDualStack, NetworkIPv4, NetworkIPv6:
+	default:
+		return fmt.Errorf("unknown network %q", network)
+	}
+	if bind == "" {
+		return nil
+	}
+	ip := net.ParseIP(bind)
+	if ip == nil {
+		return fmt.Errorf("%q is not an IP address", bind)
+	}
+	if network == NetworkIPv4 && ip.To4() == nil {
+		return fmt.Errorf("%s is not an IPv4 address", bind)
+	}
+	if network == NetworkIPv6 && ip.To4() != nil {
+		return fmt.Errorf("%s is not an IPv6 address", bind)
+	}
+	return nil
+}
+
+// ListenAddresses returns host:port pairs the listener is reachable on.
+// For an unspecified bind address every local interface address of the
+// matching family is listed.
+func ListenAddresses(network string, bind string, port string) []string {
+	if bind != "" && !net.ParseIP(bind).IsUnspecified() {
+		return []string{net.JoinHostPort(bind, port)}
+	}
+	var addresses []string
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		logger.Warn("unable to get interface addresses", "error", err)
+		return addresses
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		isIPv4 := ipNet.IP.To4() != nil
+		if network == NetworkIPv4 && !isIPv4 || network == NetworkIPv6 && isIPv4 {
+			continue
+		}
+		addresses = append(addresses, net.JoinHostPort(ipNet.IP.String(), port))
+	}
+	return addresses
+}
@@ -0,0 +1,70 @@
+package main
+
+// #cgo pkg-config: gio-2.0
+// #include <stdlib.h>
+// #include <gio/gio.h>
+import "C"
+
+import (
+	"errors"
+	"net/url"
+	"unsafe"
+
+	"github.com/gotk3/gotk3/glib"
+)
+
+// fileURIs reads the URIs of the GFile array passed to the "open" signal.
+func fileURIs(list unsafe.Pointer, n int) []string {
+	var uris []string
+	files := (*[1 << 20]*C.GFile)(list)[:n:n]
+	for _, file := range files {
+		uri := C.g_file_get_uri(file)
+		uris = append(uris, C.GoString(uri))
+		C.g_free(C.gpointer(unsafe.Pointer(uri)))
+	}
+	return uris
+}
+
+// pathFromURI turns a file:// URI back into a local path.
+func pathFromURI(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" || (u.Host != "" && u.Host != "localhost") {
+		return "", errors.New("not a local file")
+	}
+	return u.Path, nil
+}
+
+// openFiles registers the application and opens the files, at least one,
+// with the hint in the running instance if there is one, which is reported.
+// Relative names are resolved against the working directory.
+func openFiles(app *glib.Application, names []string, hint string) (bool, error) {
+	native := (*C.GApplication)(unsafe.Pointer(app.Native()))
+	var gerr *C.GError
+	if C.g_application_register(native, nil, &gerr) == 0 {
+		defer C.g_error_free(gerr)
+		return false, errors.New(C.GoString((*C.char)(gerr.message)))
+	}
+	files := make([]*C.GFile, len(names))
+	for i, name := range names {
+		cname := C.CString(name)
+		files[i] = C.g_file_new_for_commandline_arg(cname)
+		C.free(unsafe.Pointer(cname))
+	}
+	chint := C.CString(hint)
+	C.g_application_open(native, &files[0], C.gint(len(files)), chint)
+	C.free(unsafe.Pointer(chint))
+	for _, file := range files {
+		C.g_object_unref(C.gpointer(unsafe.Pointer(file)))
+	}
+	remote := C.g_application_get_is_remote(native) != 0
+	if remote {
+		// The call to the running instance is sent once the bus is flushed.
+		if conn := C.g_application_get_dbus_connection(native); conn != nil {
+			C.g_dbus_connection_flush_sync(conn, nil, nil)
+		}
+	}
+	return remote, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// portMappingLifetime is the lease requested from the gateway,
+// mappings are renewed when half of the granted lease is over.
+const portMappingLifetime = time.Hour
+
+// portMapper adds and removes a TCP port forwarding on the gateway.
+type portMapper interface {
+	Name() string
+	// Add maps the external port to the internal one and returns the
+	// external address, the port and the lease actually granted.
+	// A zero lease means the mapping is permanent.
+	Add(internal int, external int, lifetime time.Duration) (net.IP, int, time.Duration, error)
+	Remove(internal int, external int) error
+}
+
+// PortMapping is an active port forwarding kept alive until closed.
+type PortMapping struct {
+	Method       string
+	ExternalIP   net.IP
+	ExternalPort int
+
+	mapper   portMapper
+	internal int
+	stop     chan struct{}
+	done     sync.WaitGroup
+}
+
+// MapPort asks the gateway to forward the port to this host trying
+// PCP, NAT-PMP and UPnP IGD in turn.
+func MapPort(port int) (*PortMapping, error) {
+	var gateway *net.UDPAddr
+	var errs []string
+	if ip, err := defaultGateway(); err == nil {
+		gateway = &net.UDPAddr{IP: ip, Port: natpmpPort}
+	} else {
+		errs = append(errs, "gateway: "+err.Error())
+	}
+	m, err := mapPort(port, gateway, ssdpAddress)
+	if err != nil {
+		return nil, errors.New(strings.Join(append(errs, err.Error()), "; "))
+	}
+	return m, nil
+}
+
+// mapPort tries PCP and NAT-PMP on the gateway, when there is one. The
+// search for UPnP devices at the SSDP address takes a while, it is done
+// only when both fail.
+func mapPort(port int, gateway *net.UDPAddr, ssdp string) (*PortMapping, error) {
+	var errs []string
+	if gateway != nil {
+		for _, mapper := range []portMapper{&pcpMapper{gateway: gateway}, &natpmpMapper{gateway: gateway}} {
+			m, err := addPortMapping(mapper, port)
+			if err == nil {
+				return m, nil
+			}
+			errs = append(errs, mapper.Name()+": "+err.Error())
+		}
+	}
+	upnp, err := discoverUPnP(ssdp)
+	if err == nil {
+		var m *PortMapping
+		if m, err = addPortMapping(upnp, port); err == nil {
+			return m, nil
+		}
+	}
+	errs = append(errs, "UPnP IGD: "+err.Error())
+	return nil, errors.New(strings.Join(errs, "; "))
+}
+
+// addPortMapping maps the port with the mapper and keeps the mapping alive.
+func addPortMapping(mapper portMapper, port int) (*PortMapping, error) {
+	ip, external, lease, err := mapper.Add(port, port, portMappingLifetime)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("port mapped", "port", port, "external", net.JoinHostPort(ip.String(), fmt.Sprint(external)), "via", mapper.Name(), "lease", lease)
+	m := &PortMapping{
+		Method:       mapper.Name(),
+		ExternalIP:   ip,
+		ExternalPort: external,
+		mapper:       mapper,
+		internal:     port,
+		stop:         make(chan struct{}),
+	}
+	if lease > 0 {
+		m.done.Add(1)
+		go m.renew(lease)
+	}
+	return m, nil
+}
+
+func (m *PortMapping) Address() string {
+	return net.JoinHostPort(m.ExternalIP.String(), fmt.Sprint(m.ExternalPort))
+}
+
+func (m *PortMapping) renew(lease time.Duration) {
+	defer m.done.Done()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-time.After(lease / 2):
+		}
+		_, _, granted, err := m.mapper.Add(m.internal, m.ExternalPort, portMappingLifetime)
+		if err != nil {
+			logger.Warn("port mapping renewal failed", "error", err)
+			// Try again before the lease runs out.
+			lease /= 2
+			if lease < 10*time.Second {
+				lease = 10 * time.Second
+			}
+			continue
+		}
+		if granted == 0 {
+			return
+		}
+		lease = granted
+	}
+}
+
+// Close stops renewing and removes the mapping from the gateway.
+func (m *PortMapping) Close() error {
+	close(m.stop)
+	m.done.Wait()
+	return m.mapper.Remove(m.internal, m.ExternalPort)
+}
+
+// defaultGateway reads the IPv4 default route from the kernel routing table.
+func defaultGateway() (net.IP, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != 4 {
+			continue
+		}
+		// The routing table holds addresses in host (little endian) order.
+		return net.IPv4(b[3], b[2], b[1], b[0]), nil
+	}
+	return nil, errors.New("no default route")
+}
+
+// localAddressTo returns the local address used to reach the host.
+func localAddressTo(host string) (net.IP, error) {
+	conn, err := net.Dial("udp4", net.JoinHostPort(host, "9"))
+	if err != nil {
+		return nil, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var fakeExternalIP = net.IPv4(203, 0, 113, 7).To4()
+
+// fakeGateway answers NAT-PMP requests, and PCP ones when pcp is set, like a
+// gateway mapping ports. Without PCP it answers those with the unsupported
+// version result of NAT-PMP.
+type fakeGateway struct {
+	conn net.PacketConn
+	pcp  bool
+
+	mu sync.Mutex
+	// mapped holds the lifetime of every mapped external port.
+	mapped map[int]uint32
+}
+
+func newFakeGateway(t *testing.T, pcp bool) *fakeGateway {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &fakeGateway{conn: conn, pcp: pcp, mapped: make(map[int]uint32)}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	go g.serve()
+	return g
+}
+
+func (g *fakeGateway) address() *net.UDPAddr {
+	return g.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (g *fakeGateway) lifetime(port int) (uint32, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	lifetime, ok := g.mapped[port]
+	return lifetime, ok
+}
+
+func (g *fakeGateway) serve() {
+	buffer := make([]byte, 1100)
+	for {
+		n, addr, err := g.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		if response := g.answer(buffer[:n]); response != nil {
+			_, _ = g.conn.WriteTo(response, addr)
+		}
+	}
+}
+
+func (g *fakeGateway) mapPort(port int, lifetime uint32) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if lifetime == 0 {
+		delete(g.mapped, port)
+	} else {
+		g.mapped[port] = lifetime
+	}
+}
+
+func (g *fakeGateway) answer(request []byte) []byte {
+	if len(request) < 2 {
+		return nil
+	}
+	switch {
+	case request[0] == pcpVersion && !g.pcp:
+		return []byte{natpmpVersion, 0x80 | request[1], 0, 1, 0, 0, 0, 0}
+	case request[0] == pcpVersion && request[1] == pcpOpMap && len(request) >= 60:
+		response := make([]byte, 60)
+		response[0] = pcpVersion
+		response[1] = 0x80 | pcpOpMap
+		copy(response[4:8], request[4:8])
+		copy(response[24:44], request[24:44])
+		copy(response[44:60], fakeExternalIP.To16())
+		g.mapPort(int(binary.BigEndian.Uint16(request[42:])), binary.BigEndian.Uint32(request[4:]))
+		return response
+	case request[0] == natpmpVersion && request[1] == natpmpOpExternalAddress:
+		response := make([]byte, 12)
+		response[1] = 0x80 | natpmpOpExternalAddress
+		copy(response[8:12], fakeExternalIP)
+		return response
+	case request[0] == natpmpVersion && request[1] == natpmpOpMapTCP && len(request) >= 12:
+		response := make([]byte, 16)
+		response[1] = 0x80 | natpmpOpMapTCP
+		copy(response[8:12], request[4:8])
+		copy(response[12:16], request[8:12])
+		external := int(binary.BigEndian.Uint16(request[6:]))
+		if external == 0 {
+			external = int(binary.BigEndian.Uint16(request[4:]))
+		}
+		g.mapPort(external, binary.BigEndian.Uint32(request[8:]))
+		return response
+	}
+	return nil
+}
+
+// fakeIGD is an internet gateway device found with SSDP and controlled over
+// HTTP. With permanentOnly it refuses mappings which expire, like some
+// routers do.
+type fakeIGD struct {
+	ssdp          net.PacketConn
+	http          *httptest.Server
+	permanentOnly bool
+
+	mu       sync.Mutex
+	searches int
+	mapped   map[string]string
+}
+
+func newFakeIGD(t *testing.T) *fakeIGD {
+	ssdp, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakeIGD{ssdp: ssdp, mapped: make(map[string]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rootDesc.xml", d.serveDescription)
+	mux.HandleFunc("/ctl/IPConn", d.serveControl)
+	d.http = httptest.NewServer(mux)
+	t.Cleanup(func() {
+		_ = ssdp.Close()
+		d.http.Close()
+	})
+	go d.serveSSDP()
+	return d
+}
+
+func (d *fakeIGD) ssdpAddress() string {
+	return d.ssdp.LocalAddr().String()
+}
+
+func (d *fakeIGD) searchCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.searches
+}
+
+func (d *fakeIGD) lease(port int) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	lease, ok := d.mapped[fmt.Sprint(port)]
+	return lease, ok
+}
+
+func (d *fakeIGD) serveSSDP() {
+	buffer := make([]byte, 2048)
+	for {
+		n, addr, err := d.ssdp.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		if !strings.HasPrefix(string(buffer[:n]), "M-SEARCH") {
+			continue
+		}
+		d.mu.Lock()
+		d.searches++
+		d.mu.Unlock()
+		// Some other device answers first.
+		_, _ = d.ssdp.WriteTo([]byte("HTTP/1.1 200 OK\r\nST: upnp:rootdevice\r\n\r\n"), addr)
+		_, _ = d.ssdp.WriteTo([]byte("HTTP/1.1 200 OK\r\n"+
+			"ST: "+upnpGatewayType+"\r\n"+
+			"LOCATION: "+d.http.URL+"/rootDesc.xml\r\n\r\n"), addr)
+	}
+}
+
+func (d *fakeIGD) serveDescription(w http.ResponseWriter, _ *http.Request) {
+	_, _ = w.Write([]byte(`<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<device>
+<deviceType>` + upnpGatewayType + `</deviceType>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<serviceList><service>
+<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+<controlURL>/ctl/IPConn</controlURL>
+</service></serviceList>
+</device></deviceList>
+</device></deviceList>
+</device>
+</root>`))
+}
+
+func (d *fakeIGD) serveControl(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	action := r.Header.Get("SOAPAction")
+	action = strings.Trim(action[strings.Index(action, "#")+1:], `"`)
+	port := xmlValue(body, "NewExternalPort")
+	result := ""
+	switch action {
+	case "GetExternalIPAddress":
+		result = "<NewExternalIPAddress>" + fakeExternalIP.String() + "</NewExternalIPAddress>"
+	case "AddPortMapping":
+		lease := xmlValue(body, "NewLeaseDuration")
+		if d.permanentOnly && lease != "0" {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(fmt.Sprintf("<s:Envelope><s:Body><s:Fault><detail><UPnPError>"+
+				"<errorCode>%d</errorCode><errorDescription>OnlyPermanentLeasesSupported</errorDescription>"+
+				"</UPnPError></detail></s:Fault></s:Body></s:Envelope>", upnpOnlyPermanentLeases)))
+			return
+		}
+		d.mu.Lock()
+		d.mapped[port] = lease
+		d.mu.Unlock()
+	case "DeletePortMapping":
+		d.mu.Lock()
+		delete(d.mapped, port)
+		d.mu.Unlock()
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write([]byte("<s:Envelope><s:Body><u:" + action + "Response>" + result +
+		"</u:" + action + "Response></s:Body></s:Envelope>"))
+}
+
+func TestMapPortPCP(t *testing.T) {
+	gateway := newFakeGateway(t, true)
+	igd := newFakeIGD(t)
+	start := time.Now()
+	m, err := mapPort(3214, gateway.address(), igd.ssdpAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Method != "PCP" || !m.ExternalIP.Equal(fakeExternalIP) || m.ExternalPort != 3214 {
+		t.Errorf("mapped %s via %s", m.Address(), m.Method)
+	}
+	// The gateway mapped the port, no need to wait for UPnP devices.
+	if igd.searchCount() != 0 || time.Since(start) >= ssdpSearchTime {
+		t.Errorf("searched for UPnP devices after PCP succeeded")
+	}
+	if lifetime, ok := gateway.lifetime(3214); !ok || lifetime != uint32(portMappingLifetime/time.Second) {
+		t.Errorf("gateway lifetime = %d, mapped %v", lifetime, ok)
+	}
+	if err = m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := gateway.lifetime(3214); ok {
+		t.Error("mapping wasn't removed")
+	}
+}
+
+func TestMapPortNATPMP(t *testing.T) {
+	gateway := newFakeGateway(t, false)
+	igd := newFakeIGD(t)
+	m, err := mapPort(3214, gateway.address(), igd.ssdpAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Method != "NAT-PMP" || !m.ExternalIP.Equal(fakeExternalIP) || m.ExternalPort != 3214 {
+		t.Errorf("mapped %s via %s", m.Address(), m.Method)
+	}
+	if igd.searchCount() != 0 {
+		t.Errorf("searched for UPnP devices after NAT-PMP succeeded")
+	}
+	if err = m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := gateway.lifetime(3214); ok {
+		t.Error("mapping wasn't removed")
+	}
+}
+
+func TestMapPortUPnP(t *testing.T) {
+	for _, permanentOnly := range []bool{false, true} {
+		igd := newFakeIGD(t)
+		igd.permanentOnly = permanentOnly
+		m, err := mapPort(3214, nil, igd.ssdpAddress())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Method != "UPnP IGD" || !m.ExternalIP.Equal(fakeExternalIP) || m.ExternalPort != 3214 {
+			t.Errorf("mapped %s via %s", m.Address(), m.Method)
+		}
+		want := fmt.Sprint(int(portMappingLifetime / time.Second))
+		if permanentOnly {
+			want = "0"
+		}
+		if lease, ok := igd.lease(3214); !ok || lease != want {
+			t.Errorf("permanent only %v: lease = %q, mapped %v", permanentOnly, lease, ok)
+		}
+		if err = m.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := igd.lease(3214); ok {
+			t.Error("mapping wasn't removed")
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// maxRecent is how many recent connections are remembered.
+const maxRecent = 8
+
+// Profile is a named connection destination saved in the config.
+// Recent connections are stored as profiles without a name.
+type Profile struct {
+	Name string `yaml:"name,omitempty" json:"name,omitempty"`
+	Host string `yaml:"host" json:"host"`
+	Port string `yaml:"port" json:"port"`
+	// Secret is the pairing secret of the peer, Key the fingerprint of
+	// its identity, which it must have when set. The secret stays out of
+	// the control socket.
+	Secret string `yaml:"secret,omitempty" json:"-"`
+	Key    string `yaml:"key,omitempty" json:"key,omitempty"`
+}
+
+func (p Profile) Address() string {
+	return JoinAddress(p.Host, p.Port)
+}
+
+func (p Profile) Pairing() Pairing {
+	return Pairing{Secret: p.Secret, Key: p.Key}
+}
+
+// Title is a human readable profile description for lists.
+func (p Profile) Title() string {
+	if p.Name == "" {
+		return p.Address()
+	}
+	return p.Name + " (" + p.Address() + ")"
+}
+
+func (p Profile) validate() error {
+	if strings.TrimSpace(p.Host) == "" {
+		return errors.New("host is empty")
+	}
+	if p.Key != "" {
+		if _, err := normalizeFingerprint(p.Key); err != nil {
+			return err
+		}
+	}
+	// Addresses of other transports may do without a port.
+	if HasTransport(p.Host) {
+		if err := validateTransportAddress(p.Host); err != nil {
+			return err
+		}
+		if p.Port == "" {
+			return nil
+		}
+	}
+	return validatePort(p.Port)
+}
+
+func findProfile(name string) int {
+	for i, p := range config.Client.Profiles {
+		if p.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// putProfile adds the profile or replaces the one with the same name.
+// When an existing profile is renamed, its old name is passed as previous.
+func putProfile(previous string, profile Profile) error {
+	profile.Name = strings.TrimSpace(profile.Name)
+	if profile.Name == "" {
+		return errors.New("profile name is empty")
+	}
+	if err := profile.validate(); err != nil {
+		return err
+	}
+	if profile.Key != "" {
+		profile.Key, _ = normalizeFingerprint(profile.Key)
+	}
+	if previous != profile.Name && findProfile(profile.Name) >= 0 {
+		return fmt.Errorf("profile %q already exists", profile.Name)
+	}
+	i := findProfile(profile.Name)
+	if previous != "" {
+		i = findProfile(previous)
+	}
+	if i >= 0 {
+		config.Client.Profiles[i] = profile
+	} else {
+		config.Client.Profiles = append(config.Client.Profiles, profile)
+	}
+	return nil
+}
+
+func deleteProfile(name string) {
+	if i := findProfile(name); i >= 0 {
+		config.Client.Profiles = append(config.Client.Profiles[:i], config.Client.Profiles[i+1:]...)
+	}
+}
+
+// addRecent moves the destination to the top of the recent connections.
+func addRecent(destination Profile) {
+	destination.Name = ""
+	recent := []Profile{destination}
+	for _, p := range config.Client.Recent {
+		if p.Host == destination.Host && p.Port == destination.Port {
+			continue
+		}
+		if len(recent) == maxRecent {
+			break
+		}
+		recent = append(recent, p)
+	}
+	config.Client.Recent = recent
+}
+
+func deleteRecent(host string, port string) {
+	recent := config.Client.Recent[:0]
+	for _, p := range config.Client.Recent {
+		if p.Host != host || p.Port != port {
+			recent = append(recent, p)
+		}
+	}
+	config.Client.Recent = recent
+}
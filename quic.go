@@ -0,0 +1,425 @@
+//go:build quic
+// +build quic
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	quicALPN = "siphon"
+	// quicHandshakeTimeout is how long connecting may take before TCP is
+	// tried, some networks block UDP.
+	quicHandshakeTimeout = 5 * time.Second
+	quicIdleTimeout      = time.Minute
+	quicKeepAlive        = 15 * time.Second
+	// quicCloseTimeout bounds the wait for the peer to take the last data.
+	quicCloseTimeout = 5 * time.Second
+	// quicRouteInterval is how often a client checks if the route to the
+	// peer goes from another local address, like after switching networks.
+	quicRouteInterval = 2 * time.Second
+	quicProbeTimeout  = 5 * time.Second
+)
+
+var errQUICStreams = errors.New("quic connection carries data on streams only")
+
+func init() {
+	RegisterTransport("quic", quicTransport{})
+}
+
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout: quicHandshakeTimeout,
+		MaxIdleTimeout:       quicIdleTimeout,
+		KeepAlivePeriod:      quicKeepAlive,
+	}
+}
+
+// quicTransport goes over QUIC, every event of a session on a stream of its
+// own, one after the other. Peers have self-signed certificates, like TCP
+// it encrypts without authenticating them. Peers which can't reach the
+// listener over UDP fall back to TCP on the same port. It is built with the
+// quic tag only.
+type quicTransport struct{}
+
+func (quicTransport) HostPort() bool {
+	return true
+}
+
+// Listen listens on UDP and on TCP of the same port.
+func (quicTransport) Listen(address string) (net.Listener, error) {
+	cert, err := newSelfSignedCertificate(quicALPN)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	tr := &quic.Transport{Conn: udp}
+	ln, err := tr.Listen(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{quicALPN},
+		MinVersion:   tls.VersionTLS13,
+	}, quicConfig())
+	if err != nil {
+		//noinspection GoUnhandledErrorResult
+		udp.Close()
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(address)
+	_, port, _ := net.SplitHostPort(udp.LocalAddr().String())
+	tcp, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		//noinspection GoUnhandledErrorResult
+		tr.Close()
+		//noinspection GoUnhandledErrorResult
+		udp.Close()
+		return nil, err
+	}
+	l := &quicListener{
+		udp:      udp,
+		tr:       tr,
+		quic:     ln,
+		tcp:      tcp,
+		accepted: make(chan quicAccepted),
+		closed:   make(chan struct{}),
+	}
+	go l.acceptQUIC()
+	go l.acceptTCP()
+	return l, nil
+}
+
+// Dial connects over QUIC, over TCP when the handshake fails.
+func (quicTransport) Dial(address string) (net.Conn, error) {
+	conn, err := dialQUIC(address)
+	if err != nil {
+		logger.Warn("quic connection failed, falling back to tcp", "address", address, "error", err)
+		return net.Dial("tcp", address)
+	}
+	return conn, nil
+}
+
+func dialQUIC(address string) (*quicConn, error) {
+	remote, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	tr := &quic.Transport{Conn: udp}
+	ctx, cancel := context.WithTimeout(context.Background(), quicHandshakeTimeout)
+	defer cancel()
+	conn, err := tr.Dial(ctx, remote, &tls.Config{
+		// Peers have self-signed certificates.
+		InsecureSkipVerify: true,
+		NextProtos:         []string{quicALPN},
+		MinVersion:         tls.VersionTLS13,
+	}, quicConfig())
+	if err != nil {
+		//noinspection GoUnhandledErrorResult
+		tr.Close()
+		//noinspection GoUnhandledErrorResult
+		udp.Close()
+		return nil, err
+	}
+	c := &quicConn{conn: conn, sockets: []net.PacketConn{udp}, transports: []*quic.Transport{tr}}
+	go c.followRoute(remote)
+	return c, nil
+}
+
+type quicAccepted struct {
+	conn net.Conn
+	err  error
+}
+
+// quicListener accepts peers over QUIC and those falling back to TCP.
+type quicListener struct {
+	udp      net.PacketConn
+	tr       *quic.Transport
+	quic     *quic.Listener
+	tcp      net.Listener
+	accepted chan quicAccepted
+	once     sync.Once
+	closed   chan struct{}
+}
+
+func (l *quicListener) acceptQUIC() {
+	for {
+		conn, err := l.quic.Accept(context.Background())
+		var accepted quicAccepted
+		if err != nil {
+			accepted.err = err
+		} else {
+			accepted.conn = &quicConn{conn: conn}
+		}
+		if !l.pass(accepted) || err != nil {
+			return
+		}
+	}
+}
+
+func (l *quicListener) acceptTCP() {
+	for {
+		conn, err := l.tcp.Accept()
+		if !l.pass(quicAccepted{conn: conn, err: err}) || err != nil {
+			return
+		}
+	}
+}
+
+// pass hands the peer to Accept, it reports false once the listener is closed.
+func (l *quicListener) pass(accepted quicAccepted) bool {
+	select {
+	case l.accepted <- accepted:
+		return true
+	case <-l.closed:
+		if accepted.conn != nil {
+			//noinspection GoUnhandledErrorResult
+			accepted.conn.Close()
+		}
+		return false
+	}
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	select {
+	case accepted := <-l.accepted:
+		return accepted.conn, accepted.err
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *quicListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.closed)
+		err = l.tcp.Close()
+		//noinspection GoUnhandledErrorResult
+		l.quic.Close()
+		//noinspection GoUnhandledErrorResult
+		l.tr.Close()
+		//noinspection GoUnhandledErrorResult
+		l.udp.Close()
+	})
+	return err
+}
+
+func (l *quicListener) Addr() net.Addr {
+	return l.udp.LocalAddr()
+}
+
+// quicConn is a QUIC connection, sessions go over its streams. A client
+// owns the UDP sockets of its paths, a listener those of accepted peers.
+type quicConn struct {
+	conn *quic.Conn
+
+	mu         sync.Mutex
+	sockets    []net.PacketConn
+	transports []*quic.Transport
+	// written tells if data went to the peer last, it may still be on the
+	// way when closing.
+	written bool
+}
+
+func (c *quicConn) OpenStream() (net.Conn, error) {
+	stream, err := c.conn.OpenStreamSync(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &quicStream{Stream: stream, conn: c}, nil
+}
+
+func (c *quicConn) AcceptStream() (net.Conn, error) {
+	stream, err := c.conn.AcceptStream(context.Background())
+	if err != nil {
+		var appErr *quic.ApplicationError
+		if errors.As(err, &appErr) && appErr.ErrorCode == 0 {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	return &quicStream{Stream: stream, conn: c}, nil
+}
+
+func (c *quicConn) Read([]byte) (int, error) {
+	return 0, errQUICStreams
+}
+
+func (c *quicConn) Write([]byte) (int, error) {
+	return 0, errQUICStreams
+}
+
+// Close lets the peer take the data written last before closing, in the
+// background.
+func (c *quicConn) Close() error {
+	c.mu.Lock()
+	written := c.written
+	c.mu.Unlock()
+	go func() {
+		if written {
+			select {
+			case <-c.conn.Context().Done():
+			case <-time.After(quicCloseTimeout):
+			}
+		}
+		//noinspection GoUnhandledErrorResult
+		c.conn.CloseWithError(0, "")
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, tr := range c.transports {
+			//noinspection GoUnhandledErrorResult
+			tr.Close()
+		}
+		for _, socket := range c.sockets {
+			//noinspection GoUnhandledErrorResult
+			socket.Close()
+		}
+	}()
+	return nil
+}
+
+func (c *quicConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *quicConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *quicConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (c *quicConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (c *quicConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// followRoute moves the connection to a new path once the route to the peer
+// goes from another local address, like after switching from Wi-Fi to a
+// wired network.
+func (c *quicConn) followRoute(remote *net.UDPAddr) {
+	local := routeIP(remote)
+	ticker := time.NewTicker(quicRouteInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.conn.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		ip := routeIP(remote)
+		if ip == nil || ip.Equal(local) {
+			continue
+		}
+		logger.Info("network changed, migrating connection", "peer", remote, "from", local, "to", ip)
+		if err := c.migrate(ip); err != nil {
+			logger.Warn("connection migration failed", "peer", remote, "error", err)
+			continue
+		}
+		local = ip
+	}
+}
+
+func (c *quicConn) migrate(ip net.IP) error {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		return err
+	}
+	tr := &quic.Transport{Conn: udp}
+	fail := func(err error) error {
+		//noinspection GoUnhandledErrorResult
+		tr.Close()
+		//noinspection GoUnhandledErrorResult
+		udp.Close()
+		return err
+	}
+	path, err := c.conn.AddPath(tr)
+	if err != nil {
+		return fail(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), quicProbeTimeout)
+	defer cancel()
+	if err := path.Probe(ctx); err != nil {
+		//noinspection GoUnhandledErrorResult
+		path.Close()
+		return fail(err)
+	}
+	if err := path.Switch(); err != nil {
+		//noinspection GoUnhandledErrorResult
+		path.Close()
+		return fail(err)
+	}
+	// The old path may still carry packets in flight, its socket goes
+	// with the connection.
+	c.mu.Lock()
+	c.sockets = append(c.sockets, udp)
+	c.transports = append(c.transports, tr)
+	c.mu.Unlock()
+	return nil
+}
+
+// routeIP returns the local address the route to the peer goes from.
+func routeIP(remote *net.UDPAddr) net.IP {
+	conn, err := net.DialUDP("udp", nil, remote)
+	if err != nil {
+		return nil
+	}
+	//noinspection GoUnhandledErrorResult
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+// quicStream is a stream of an event, it tells the connection which way
+// the data went last.
+type quicStream struct {
+	*quic.Stream
+	conn *quicConn
+}
+
+func (s *quicStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	if n > 0 {
+		s.conn.mu.Lock()
+		s.conn.written = false
+		s.conn.mu.Unlock()
+	}
+	return n, err
+}
+
+func (s *quicStream) Write(b []byte) (int, error) {
+	s.conn.mu.Lock()
+	s.conn.written = true
+	s.conn.mu.Unlock()
+	return s.Stream.Write(b)
+}
+
+// Close ends both directions, the event is over.
+func (s *quicStream) Close() error {
+	s.CancelRead(0)
+	return s.Stream.Close()
+}
+
+func (s *quicStream) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *quicStream) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
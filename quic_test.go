@@ -0,0 +1,43 @@
+//go:build quic
+// +build quic
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestQUICSession sends files over QUIC, and over the TCP the listener
+// takes on the same port.
+func TestQUICSession(t *testing.T) {
+	for _, scheme := range []string{"quic", NetworkDualStack} {
+		ln, err := Listen(NetworkDualStack, "quic://127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sender, receiver := connectPair(t, ln, scheme+"://"+ln.Addr().String(), ReceivePolicy{})
+		src, dst := t.TempDir(), t.TempDir()
+		first := randomData(30, 3*BufferSize+17)
+		second := randomData(31, 1000)
+		names := []string{
+			writeFile(t, filepath.Join(src, "first"), first),
+			writeFile(t, filepath.Join(src, "second"), second),
+		}
+
+		result := receiveAll(receiver, dst)
+		for _, name := range names {
+			if err = sender.SendFile(name, func(int) {}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = sender.SendDone(); err != nil {
+			t.Fatal(err)
+		}
+		if r := <-result; r.err != nil || len(r.files) != 2 {
+			t.Fatalf("%s: received %d files, error %v", scheme, len(r.files), r.err)
+		}
+		checkFile(t, filepath.Join(dst, "first"), first)
+		checkFile(t, filepath.Join(dst, "second"), second)
+	}
+}
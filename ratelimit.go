@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// rateChunk bounds the bytes paid for at once, so a changed rate
+	// takes effect quickly even at low rates.
+	rateChunk = 4096
+	// rateBurst is the idle time a limiter may catch up on.
+	rateBurst = 100 * time.Millisecond
+)
+
+// Limits shared by all sessions, on top of the limits of every session.
+var (
+	GlobalUpload   = &RateLimiter{}
+	GlobalDownload = &RateLimiter{}
+)
+
+// RateLimiter paces a byte stream to a rate in bytes per second, a zero
+// rate means unlimited. The rate may be changed during a transfer.
+type RateLimiter struct {
+	mu   sync.Mutex
+	rate int64
+	// next is when the bytes taken so far are paid off.
+	next time.Time
+}
+
+func (l *RateLimiter) SetRate(rate int64) {
+	l.mu.Lock()
+	l.rate = rate
+	l.mu.Unlock()
+}
+
+func (l *RateLimiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// Wait blocks until n more bytes fit in the rate.
+func (l *RateLimiter) Wait(n int) {
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.next = time.Time{}
+		l.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	if l.next.Before(now.Add(-rateBurst)) {
+		l.next = now.Add(-rateBurst)
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// rateConn paces reads and writes of the connection with its limiters.
+type rateConn struct {
+	net.Conn
+	upload   []*RateLimiter
+	download []*RateLimiter
+}
+
+// limited tells if any of the limiters has a rate, the data goes through
+// in one piece otherwise.
+func limited(limiters []*RateLimiter) bool {
+	for _, l := range limiters {
+		if l.Rate() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *rateConn) Read(b []byte) (int, error) {
+	if !limited(c.download) {
+		n, err := c.Conn.Read(b)
+		metricBytesReceived.Add(uint64(n))
+		return n, err
+	}
+	if len(b) > rateChunk {
+		b = b[:rateChunk]
+	}
+	n, err := c.Conn.Read(b)
+	metricBytesReceived.Add(uint64(n))
+	for _, l := range c.download {
+		l.Wait(n)
+	}
+	return n, err
+}
+
+func (c *rateConn) Write(b []byte) (int, error) {
+	if !limited(c.upload) {
+		n, err := c.Conn.Write(b)
+		metricBytesSent.Add(uint64(n))
+		return n, err
+	}
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > rateChunk {
+			chunk = chunk[:rateChunk]
+		}
+		for _, l := range c.upload {
+			l.Wait(len(chunk))
+		}
+		n, err := c.Conn.Write(chunk)
+		metricBytesSent.Add(uint64(n))
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
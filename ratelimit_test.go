@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// countingConn records the size of every write.
+type countingConn struct {
+	net.Conn
+	writes []int
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	c.writes = append(c.writes, len(b))
+	return len(b), nil
+}
+
+func TestRateConnChunks(t *testing.T) {
+	conn := &countingConn{}
+	limiter := &RateLimiter{}
+	c := &rateConn{Conn: conn, upload: []*RateLimiter{limiter}}
+	data := make([]byte, 3*rateChunk)
+	if n, err := c.Write(data); err != nil || n != len(data) {
+		t.Fatalf("wrote %d, %v", n, err)
+	}
+	// Without a rate the data isn't split.
+	if len(conn.writes) != 1 {
+		t.Errorf("unlimited write split into %d", len(conn.writes))
+	}
+	conn.writes = nil
+	limiter.SetRate(1 << 30)
+	if n, err := c.Write(data); err != nil || n != len(data) {
+		t.Fatalf("wrote %d, %v", n, err)
+	}
+	if len(conn.writes) != 3 {
+		t.Errorf("limited write split into %d, want 3", len(conn.writes))
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Relay rendezvous, see cmd/siphon-relay. The relay only learns a hash of
+// the rendezvous code, the code itself keys the end-to-end encryption.
+const (
+	relayHelloPrefix = "SIPHON-RELAY 1 "
+	relayCodeBytes   = 10
+	relayCodeGroup   = 4
+	handshakeTimeout = 30 * time.Second
+)
+
+// Peer roles on a relayed connection. The sender connects like a client,
+// the receiver serves the session like the listener does.
+const (
+	RoleSender   byte = 0
+	RoleReceiver byte = 1
+)
+
+var relayCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewRelayCode generates a random rendezvous code like "abcd-efgh-ijkl-mnop".
+func NewRelayCode() (string, error) {
+	b := make([]byte, relayCodeBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(relayCodeEncoding.EncodeToString(b))
+	var groups []string
+	for len(code) > relayCodeGroup {
+		groups = append(groups, code[:relayCodeGroup])
+		code = code[relayCodeGroup:]
+	}
+	groups = append(groups, code)
+	return strings.Join(groups, "-"), nil
+}
+
+// normalizeRelayCode strips separators and case so typed codes match.
+func normalizeRelayCode(code string) (string, error) {
+	code = strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(code))
+	b, err := relayCodeEncoding.DecodeString(code)
+	if err != nil || len(b) != relayCodeBytes {
+		return "", errors.New("invalid rendezvous code")
+	}
+	return code, nil
+}
+
+func relayChannel(code string) string {
+	sum := sha256.Sum256([]byte("siphon relay channel\x00" + code))
+	return hex.EncodeToString(sum[:])
+}
+
+// DialRelay meets the peer with the same rendezvous code on the relay and
+// returns an end-to-end encrypted connection to it. It blocks until the
+// peer shows up, the relay gives up waiting or ctx is cancelled.
+func DialRelay(ctx context.Context, address string, code string, role byte) (net.Conn, error) {
+	code, err := normalizeRelayCode(code)
+	if err != nil {
+		return nil, err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	paired := make(chan struct{})
+	defer close(paired)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-paired:
+		}
+	}()
+
+	logger.Info("waiting for peer on relay", "relay", address)
+	_, err = io.WriteString(conn, relayHelloPrefix+relayChannel(code)+"\n")
+	if err == nil {
+		err = expectRelayOK(conn)
+	}
+	if err != nil {
+		_ = conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	logger.Info("paired on relay, securing connection")
+	secure, err := secureHandshake(conn, code, role)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return secure, nil
+}
+
+// expectRelayOK reads the relay reply byte by byte,
+// so nothing the peer sends afterwards gets buffered here.
+func expectRelayOK(conn net.Conn) error {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < 64 {
+		if _, err := io.ReadFull(conn, b); err != nil {
+			if err == io.EOF {
+				return errors.New("relay closed the connection, no peer showed up")
+			}
+			return err
+		}
+		if b[0] == '\n' {
+			if string(line) != "OK" {
+				return fmt.Errorf("unexpected relay reply %q", line)
+			}
+			return nil
+		}
+		line = append(line, b[0])
+	}
+	return errors.New("relay reply is too long")
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions run on a file once a route received it.
+const (
+	ActionNone = ""
+	ActionOpen = "open"
+)
+
+// Route sends received files matching all of its conditions to its
+// directory, the first matching route of the list wins. Empty conditions
+// match everything, a file matches the type condition when either its
+// extension or its MIME type is listed.
+type Route struct {
+	Name       string   `yaml:"name"`
+	Extensions []string `yaml:"extensions,omitempty"`
+	// MimeTypes may end with "/*" to match a whole group like "image/*".
+	MimeTypes []string `yaml:"mime_types,omitempty"`
+	Glob      string   `yaml:"glob,omitempty"`
+	// Sender is the name of the profile the peer connects from, Key the
+	// fingerprint of its identity.
+	Sender string `yaml:"sender,omitempty"`
+	Key    string `yaml:"key,omitempty"`
+	// MinSize and MaxSize are in MiB, zero means no bound.
+	MinSize   int    `yaml:"min_size,omitempty"`
+	MaxSize   int    `yaml:"max_size,omitempty"`
+	Directory string `yaml:"directory"`
+	Action    string `yaml:"action,omitempty"`
+}
+
+func (r Route) validate() error {
+	if strings.TrimSpace(r.Name) == "" {
+		return errors.New("name is empty")
+	}
+	if !filepath.IsAbs(r.Directory) {
+		return errors.New("directory is not an absolute path")
+	}
+	if _, err := filepath.Match(r.Glob, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q", r.Glob)
+	}
+	if r.MinSize < 0 || r.MaxSize < 0 {
+		return errors.New("size is negative")
+	}
+	if r.MaxSize > 0 && r.MaxSize < r.MinSize {
+		return errors.New("maximum size is below the minimum one")
+	}
+	if r.Action != ActionNone && r.Action != ActionOpen {
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	if r.Key != "" {
+		if _, err := normalizeFingerprint(r.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchesName checks the conditions known from the file name alone.
+func (r Route) matchesName(name string) bool {
+	if r.Glob != "" {
+		if ok, _ := filepath.Match(r.Glob, name); !ok {
+			return false
+		}
+	}
+	if len(r.Extensions) == 0 && len(r.MimeTypes) == 0 {
+		return true
+	}
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+	for _, e := range r.Extensions {
+		if ext != "" && strings.ToLower(strings.TrimPrefix(e, ".")) == ext {
+			return true
+		}
+	}
+	mimeType, _, _ := mime.ParseMediaType(mime.TypeByExtension(filepath.Ext(name)))
+	if mimeType == "" {
+		return false
+	}
+	for _, m := range r.MimeTypes {
+		m = strings.ToLower(m)
+		if m == mimeType || strings.HasSuffix(m, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(m, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Route) matchesSize(size int64) bool {
+	return size >= int64(r.MinSize)<<20 && (r.MaxSize == 0 || size <= int64(r.MaxSize)<<20)
+}
+
+func (r Route) matchesSender(sender string, key string) bool {
+	if r.Sender != "" && r.Sender != sender {
+		return false
+	}
+	if r.Key == "" {
+		return true
+	}
+	fingerprint, err := normalizeFingerprint(r.Key)
+	return err == nil && fingerprint == key
+}
+
+// Matches checks the file against all the conditions of the route, the
+// sender is the profile name of the peer and key its fingerprint.
+func (r Route) Matches(name string, size int64, sender string, key string) bool {
+	return r.matchesName(name) && r.matchesSize(size) && r.matchesSender(sender, key)
+}
+
+// MatchRoute returns the index of the route for the file or -1 when the
+// file goes to the incoming files directory.
+func MatchRoute(routes []Route, name string, size int64, sender string, key string) int {
+	for i, r := range routes {
+		if r.Matches(name, size, sender, key) {
+			return i
+		}
+	}
+	return -1
+}
+
+// DescribeRoutes tells where a file of the name would go, for testing the
+// rules. Sender and size aren't known, so the routes limited by them are
+// listed as well, up to the first one matching any file of the name.
+func DescribeRoutes(routes []Route, name string) string {
+	if name == "" {
+		return ""
+	}
+	var lines []string
+	for _, r := range routes {
+		if !r.matchesName(name) {
+			continue
+		}
+		var conditions []string
+		if r.Sender != "" {
+			conditions = append(conditions, "from "+r.Sender)
+		}
+		if r.Key != "" {
+			conditions = append(conditions, "with key "+r.Key)
+		}
+		if r.MinSize > 0 {
+			conditions = append(conditions, fmt.Sprintf("at least %d MiB", r.MinSize))
+		}
+		if r.MaxSize > 0 {
+			conditions = append(conditions, fmt.Sprintf("at most %d MiB", r.MaxSize))
+		}
+		line := fmt.Sprintf("%q: %s", r.Name, r.Directory)
+		if len(conditions) == 0 {
+			return strings.Join(append(lines, line), "\n")
+		}
+		lines = append(lines, line+" ("+strings.Join(conditions, ", ")+")")
+	}
+	return strings.Join(append(lines, "Incoming files directory"), "\n")
+}
+
+func findRoute(name string) int {
+	for i, r := range config.Routes {
+		if r.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// putRoute adds the route or replaces the one with the same name, a renamed
+// route passes its old name as previous. The list is copied, sessions keep
+// the one they started with.
+func putRoute(previous string, route Route) error {
+	route.Name = strings.TrimSpace(route.Name)
+	if err := route.validate(); err != nil {
+		return err
+	}
+	if route.Key != "" {
+		route.Key, _ = normalizeFingerprint(route.Key)
+	}
+	if previous != route.Name && findRoute(route.Name) >= 0 {
+		return fmt.Errorf("rule %q already exists", route.Name)
+	}
+	i := findRoute(route.Name)
+	if previous != "" {
+		i = findRoute(previous)
+	}
+	routes := append([]Route(nil), config.Routes...)
+	if i >= 0 {
+		routes[i] = route
+	} else {
+		routes = append(routes, route)
+	}
+	config.Routes = routes
+	return nil
+}
+
+func deleteRoute(name string) {
+	if i := findRoute(name); i >= 0 {
+		routes := append([]Route(nil), config.Routes[:i]...)
+		config.Routes = append(routes, config.Routes[i+1:]...)
+	}
+}
+
+// raiseRoute moves the route one place up, before the rules it was after.
+func raiseRoute(name string) {
+	if i := findRoute(name); i > 0 {
+		routes := append([]Route(nil), config.Routes...)
+		routes[i-1], routes[i] = routes[i], routes[i-1]
+		config.Routes = routes
+	}
+}
+
+// splitList splits a comma separated field of the rules editor.
+func splitList(text string) []string {
+	var items []string
+	for _, item := range strings.Split(text, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// senderProfile finds the profile the peer connects from, by the key it
+// proved or else by its address.
+func senderProfile(addr net.Addr, key string, profiles []Profile) string {
+	for _, p := range profiles {
+		if p.Name == "" || p.Key == "" {
+			continue
+		}
+		if fingerprint, err := normalizeFingerprint(p.Key); err == nil && fingerprint == key {
+			return p.Name
+		}
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	remote := net.ParseIP(host)
+	if remote == nil {
+		return ""
+	}
+	for _, p := range profiles {
+		if p.Name == "" || HasTransport(p.Host) {
+			continue
+		}
+		for _, ip := range lookupProfileHost(p.Host) {
+			if ip.Equal(remote) {
+				return p.Name
+			}
+		}
+	}
+	return ""
+}
+
+// lookupTTL is how long the addresses of a profile host are kept, so that
+// sessions don't wait for the resolver every time.
+const lookupTTL = 5 * time.Minute
+
+type hostLookup struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+var lookupMu sync.Mutex
+var lookups = make(map[string]hostLookup)
+
+// lookupProfileHost returns the addresses of the host, failed lookups are
+// kept as well.
+func lookupProfileHost(host string) []net.IP {
+	lookupMu.Lock()
+	cached, ok := lookups[host]
+	lookupMu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.ips
+	}
+	result := hostLookup{expires: time.Now().Add(lookupTTL)}
+	addresses, err := net.LookupHost(host)
+	if err != nil {
+		logger.Debug("unable to look up profile host", "host", host, "error", err)
+	}
+	for _, a := range addresses {
+		if ip := net.ParseIP(a); ip != nil {
+			result.ips = append(result.ips, ip)
+		}
+	}
+	lookupMu.Lock()
+	lookups[host] = result
+	lookupMu.Unlock()
+	return result.ips
+}
+
+// routeDirectory creates the directory of the route if missing.
+func routeDirectory(r Route) (string, error) {
+	if err := os.MkdirAll(r.Directory, 0755); err != nil {
+		return "", fmt.Errorf("unable to create directory of rule %q", r.Name)
+	}
+	return r.Directory, nil
+}
+
+// runAction starts the action of the route on the received file.
+func runAction(r Route, target string) {
+	switch r.Action {
+	case ActionOpen:
+		logger.Info("open received file", "file", target)
+		cmd := exec.Command("xdg-open", target)
+		if assertError(cmd.Start(), "unable to open file") {
+			return
+		}
+		go func() {
+			_ = cmd.Wait()
+		}()
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRouteMatchesKey(t *testing.T) {
+	key := "0123:4567:89ab:cdef:0123:4567:89ab:cdef"
+	routes := []Route{
+		{Name: "phone", Key: "0123456789ABCDEF0123456789ABCDEF", Directory: "/phone"},
+		{Name: "laptop", Sender: "laptop", Extensions: []string{"pdf"}, Directory: "/laptop"},
+	}
+	cases := []struct {
+		name, sender, key string
+		want              int
+	}{
+		{"a.jpg", "", key, 0},
+		{"a.pdf", "laptop", key, 0},
+		{"a.pdf", "laptop", "", 1},
+		{"a.jpg", "laptop", "", -1},
+		{"a.pdf", "", "ffff:4567:89ab:cdef:0123:4567:89ab:cdef", -1},
+	}
+	for _, c := range cases {
+		if got := MatchRoute(routes, c.name, 1, c.sender, c.key); got != c.want {
+			t.Errorf("MatchRoute(%s, %q, %q) = %d, want %d", c.name, c.sender, c.key, got, c.want)
+		}
+	}
+}
+
+func TestSenderProfile(t *testing.T) {
+	key := "0123:4567:89ab:cdef:0123:4567:89ab:cdef"
+	profiles := []Profile{
+		{Host: "127.0.0.1", Port: "3214"},
+		{Name: "pinned", Host: "192.0.2.1", Port: "3214", Key: key},
+		{Name: "local", Host: "127.0.0.1", Port: "3214"},
+		{Name: "socket", Host: "unix:///tmp/siphon.sock"},
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000}
+	if got := senderProfile(addr, key, profiles); got != "pinned" {
+		t.Errorf("sender with the pinned key = %q", got)
+	}
+	if got := senderProfile(addr, "", profiles); got != "local" {
+		t.Errorf("sender by address = %q", got)
+	}
+	if got := senderProfile(memAddr("test"), "", profiles); got != "" {
+		t.Errorf("sender without an address = %q", got)
+	}
+	lookupMu.Lock()
+	_, cached := lookups["127.0.0.1"]
+	lookupMu.Unlock()
+	if !cached {
+		t.Error("lookup of the profile host isn't cached")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxFrameSize limits the plaintext carried by a single encrypted frame.
+const maxFrameSize = 64 * 1024
+
+// secureHandshake runs an ephemeral ECDH exchange over conn and
+// authenticates it with the shared code, so a party in the middle which
+// doesn't know the code (like the relay) can neither read nor alter it.
+func secureHandshake(conn net.Conn, code string, role byte) (net.Conn, error) {
+	if err := conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return nil, err
+	}
+	curve := ecdh.P256()
+	priv, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	own := priv.PublicKey().Bytes()
+	if _, err = conn.Write(append([]byte{role}, own...)); err != nil {
+		return nil, err
+	}
+	peer := make([]byte, 1+len(own))
+	if _, err = io.ReadFull(conn, peer); err != nil {
+		return nil, err
+	}
+	peerRole, peerKey := peer[0], peer[1:]
+	if peerRole == role {
+		return nil, errors.New("both peers have the same role")
+	}
+	pub, err := curve.NewPublicKey(peerKey)
+	if err != nil {
+		return nil, errors.New("invalid peer key")
+	}
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	senderKey, receiverKey := own, peerKey
+	if role == RoleReceiver {
+		senderKey, receiverKey = peerKey, own
+	}
+	codeKey := sha256.Sum256([]byte("siphon relay key\x00" + code))
+	derive := func(label string, extra ...byte) []byte {
+		mac := hmac.New(sha256.New, codeKey[:])
+		mac.Write([]byte(label))
+		mac.Write(shared)
+		mac.Write(senderKey)
+		mac.Write(receiverKey)
+		mac.Write(extra)
+		return mac.Sum(nil)
+	}
+
+	if _, err = conn.Write(derive("confirm", role)); err != nil {
+		return nil, err
+	}
+	confirm := make([]byte, sha256.Size)
+	if _, err = io.ReadFull(conn, confirm); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(confirm, derive("confirm", peerRole)) {
+		return nil, errors.New("peer failed to prove the rendezvous code")
+	}
+
+	send, err := newAEAD(derive("key", role))
+	if err != nil {
+		return nil, err
+	}
+	recv, err := newAEAD(derive("key", peerRole))
+	if err != nil {
+		return nil, err
+	}
+	if err = conn.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return &secureConn{Conn: conn, send: send, recv: recv}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// secureConn encrypts the stream in length prefixed AES-GCM frames,
+// nonces are frame counters kept separately for each direction.
+type secureConn struct {
+	net.Conn
+	send, recv       cipher.AEAD
+	sendSeq, recvSeq uint64
+	pending          []byte
+	writeMu          sync.Mutex
+}
+
+func (c *secureConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxFrameSize {
+			chunk = chunk[:maxFrameSize]
+		}
+		frame := make([]byte, 4, 4+len(chunk)+c.send.Overhead())
+		frame = c.send.Seal(frame, c.nonce(c.sendSeq), chunk, nil)
+		binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+		c.sendSeq++
+		if _, err := c.Conn.Write(frame); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func (c *secureConn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(c.Conn, header); err != nil {
+			return 0, err
+		}
+		size := binary.BigEndian.Uint32(header)
+		if size > maxFrameSize+uint32(c.recv.Overhead()) {
+			return 0, errors.New("encrypted frame is too large")
+		}
+		frame := make([]byte, size)
+		if _, err := io.ReadFull(c.Conn, frame); err != nil {
+			return 0, err
+		}
+		plain, err := c.recv.Open(frame[:0], c.nonce(c.recvSeq), frame, nil)
+		if err != nil {
+			return 0, errors.New("encrypted frame is corrupted")
+		}
+		c.recvSeq++
+		c.pending = plain
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *secureConn) nonce(seq uint64) []byte {
+	nonce := make([]byte, c.send.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+type handshakeResult struct {
+	conn net.Conn
+	err  error
+}
+
+// securePair runs the handshake over a loopback connection, the sender with
+// one code and the receiver with the other.
+func securePair(t *testing.T, senderCode, receiverCode string) (handshakeResult, handshakeResult) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//noinspection GoUnhandledErrorResult
+	defer ln.Close()
+	accepted := make(chan handshakeResult, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			accepted <- handshakeResult{err: err}
+			return
+		}
+		secure, err := secureHandshake(conn, receiverCode, RoleReceiver)
+		if err != nil {
+			_ = conn.Close()
+		}
+		accepted <- handshakeResult{secure, err}
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sender handshakeResult
+	sender.conn, sender.err = secureHandshake(conn, senderCode, RoleSender)
+	if sender.err != nil {
+		_ = conn.Close()
+	}
+	receiver := <-accepted
+	t.Cleanup(func() {
+		for _, c := range []net.Conn{sender.conn, receiver.conn} {
+			if c != nil {
+				_ = c.Close()
+			}
+		}
+	})
+	return sender, receiver
+}
+
+func TestSecureHandshake(t *testing.T) {
+	sender, receiver := securePair(t, "4711-tango", "4711-tango")
+	if sender.err != nil || receiver.err != nil {
+		t.Fatalf("handshake failed: %v, %v", sender.err, receiver.err)
+	}
+	// Larger than a frame, in both directions.
+	data := randomData(20, 3*maxFrameSize+5)
+	go func() {
+		_, _ = sender.conn.Write(data)
+		_, _ = receiver.conn.Write([]byte("thanks"))
+	}()
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(receiver.conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("received data differs from the sent one")
+	}
+	answer := make([]byte, 6)
+	if _, err := io.ReadFull(sender.conn, answer); err != nil || string(answer) != "thanks" {
+		t.Errorf("answer = %q, %v", answer, err)
+	}
+}
+
+func TestSecureHandshakeWrongCode(t *testing.T) {
+	sender, receiver := securePair(t, "4711-tango", "4712-tango")
+	if sender.err == nil || receiver.err == nil {
+		t.Fatalf("handshake with different codes: %v, %v", sender.err, receiver.err)
+	}
+}
+
+// frameBuffer is a connection writing into a buffer and reading from it.
+type frameBuffer struct {
+	net.Conn
+	buf *bytes.Buffer
+}
+
+func (c frameBuffer) Read(p []byte) (int, error) {
+	return c.buf.Read(p)
+}
+
+func (c frameBuffer) Write(p []byte) (int, error) {
+	return c.buf.Write(p)
+}
+
+// frameConns returns connections encrypting into the buffer and decrypting
+// from it with the same key.
+func frameConns(t *testing.T, buf *bytes.Buffer) (*secureConn, *secureConn) {
+	aead, err := newAEAD(randomData(21, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := frameBuffer{buf: buf}
+	return &secureConn{Conn: conn, send: aead, recv: aead}, &secureConn{Conn: conn, send: aead, recv: aead}
+}
+
+// frames splits the buffer into the frames written to it.
+func frames(buf *bytes.Buffer) [][]byte {
+	var frames [][]byte
+	data := buf.Bytes()
+	for len(data) >= 4 {
+		size := 4 + int(binary.BigEndian.Uint32(data))
+		frames = append(frames, append([]byte(nil), data[:size]...))
+		data = data[size:]
+	}
+	return frames
+}
+
+func TestSecureConnTamperedFrame(t *testing.T) {
+	var buf bytes.Buffer
+	writer, reader := frameConns(t, &buf)
+	if _, err := writer.Write([]byte("transfer 100 to alice")); err != nil {
+		t.Fatal(err)
+	}
+	buf.Bytes()[4+9] ^= 1
+	if _, err := reader.Read(make([]byte, 64)); err == nil {
+		t.Error("tampered frame was read")
+	}
+}
+
+func TestSecureConnNonces(t *testing.T) {
+	var buf bytes.Buffer
+	writer, _ := frameConns(t, &buf)
+	for _, message := range []string{"first", "second"} {
+		if _, err := writer.Write([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	written := frames(&buf)
+	if len(written) != 2 || bytes.Equal(written[0][4:], written[1][4:]) {
+		t.Fatalf("%d frames written", len(written))
+	}
+	cases := []struct {
+		name   string
+		frames [][]byte
+	}{
+		{"replayed", [][]byte{written[0], written[0]}},
+		{"reordered", [][]byte{written[1], written[0]}},
+		{"dropped", [][]byte{written[1]}},
+	}
+	for _, c := range cases {
+		buf.Reset()
+		for _, frame := range c.frames {
+			buf.Write(frame)
+		}
+		_, reader := frameConns(t, &buf)
+		var err error
+		for range c.frames {
+			if _, err = reader.Read(make([]byte, 64)); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			t.Errorf("%s frames were read", c.name)
+		}
+	}
+	buf.Reset()
+	buf.Write(written[0])
+	buf.Write(written[1])
+	_, reader := frameConns(t, &buf)
+	got, err := io.ReadAll(io.LimitReader(reader, 11))
+	if err != nil || string(got) != "firstsecond" {
+		t.Errorf("read %q, %v", got, err)
+	}
+}
+
+func TestSecureConnFrameSize(t *testing.T) {
+	var buf bytes.Buffer
+	_, reader := frameConns(t, &buf)
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, maxFrameSize+uint32(reader.recv.Overhead())+1)
+	buf.Write(header)
+	if _, err := reader.Read(make([]byte, 64)); err == nil {
+		t.Error("oversized frame was read")
+	}
+}
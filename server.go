@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// Server accepts peers on a long-lived listener and serves each of them
+// in its own goroutine, up to MaxPeers at a time.
+type Server struct {
+	MaxPeers int
+	// Secret is the pairing secret peers must have, any peer is served
+	// without one.
+	Secret string
+	Handle func(s *Session)
+
+	ln       net.Listener
+	mu       sync.Mutex
+	sessions map[*Session]bool
+	closed   bool
+}
+
+func NewServer(ln net.Listener, maxPeers int, handle func(s *Session)) *Server {
+	return &Server{
+		MaxPeers: maxPeers,
+		Handle:   handle,
+		ln:       ln,
+		sessions: make(map[*Session]bool),
+	}
+}
+
+// Serve accepts connections until the server is closed, the peers which
+// fail the hello are disconnected.
+func (srv *Server) Serve() error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := srv.ln.Accept()
+		if err != nil {
+			srv.mu.Lock()
+			closed := srv.closed
+			srv.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s := NewSession(conn)
+		if !srv.add(s) {
+			logger.Warn("too many peers, rejecting", "peer", s.RemoteAddr())
+			_ = s.Close()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if s.AcceptHello(srv.Secret) == nil {
+				srv.Handle(s)
+			}
+			_ = s.Close()
+			srv.remove(s)
+		}()
+	}
+}
+
+func (srv *Server) add(s *Session) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.closed || srv.MaxPeers > 0 && len(srv.sessions) >= srv.MaxPeers {
+		return false
+	}
+	srv.sessions[s] = true
+	return true
+}
+
+func (srv *Server) remove(s *Session) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	delete(srv.sessions, s)
+}
+
+// Close stops accepting new peers and disconnects the active ones.
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	srv.closed = true
+	for s := range srv.sessions {
+		_ = s.Close()
+	}
+	srv.mu.Unlock()
+	return srv.ln.Close()
+}
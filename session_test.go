@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sessionPair connects a sender to a receiver with the policy over an
+// in-memory transport.
+func sessionPair(t *testing.T, policy ReceivePolicy) (*Session, *Session) {
+	address := "mem://session-" + t.Name()
+	ln, err := Listen(NetworkDualStack, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return connectPair(t, ln, address, policy)
+}
+
+// connectPair connects to the address of the listener and accepts the
+// session on it. The listener is closed after the sessions, a QUIC one
+// carries them.
+func connectPair(t *testing.T, ln net.Listener, address string, policy ReceivePolicy) (*Session, *Session) {
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	accepted := make(chan *Session, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		s := NewSession(conn)
+		s.SetReceivePolicy(policy)
+		if s.AcceptHello("") != nil {
+			_ = s.Close()
+			s = nil
+		}
+		accepted <- s
+	}()
+	sender, err := Connect(address, Pairing{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver := <-accepted
+	if receiver == nil {
+		t.Fatal("hello failed")
+	}
+	t.Cleanup(func() {
+		_ = sender.Close()
+		_ = receiver.Close()
+	})
+	return sender, receiver
+}
+
+type receiveResult struct {
+	files    []ReceivedFile
+	rejected []string
+	err      error
+}
+
+// receiveAll handles the events of the peer into the directory until it
+// is done.
+func receiveAll(s *Session, dir string) <-chan receiveResult {
+	done := make(chan receiveResult, 1)
+	go func() {
+		var result receiveResult
+		for {
+			more, err := s.ReadFile(dir, func(string, int64) {}, func(int) {}, func(file ReceivedFile) {
+				result.files = append(result.files, file)
+			})
+			if rejected, ok := err.(*RejectedError); ok {
+				result.rejected = append(result.rejected, rejected.Name)
+			} else if err != nil {
+				result.err = err
+				break
+			}
+			if !more {
+				break
+			}
+		}
+		done <- result
+	}()
+	return done
+}
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func checkFile(t *testing.T, name string, want []byte) {
+	t.Helper()
+	got, err := os.ReadFile(name)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s has %d bytes differing from the %d sent", name, len(got), len(want))
+	}
+}
+
+func TestSessionSendReceive(t *testing.T) {
+	sender, receiver := sessionPair(t, ReceivePolicy{KeepModTime: true})
+	src, dst := t.TempDir(), t.TempDir()
+	data := randomData(10, 3*BufferSize+17)
+	name := writeFile(t, filepath.Join(src, "report.pdf"), data)
+	mtime := time.Unix(1600000000, 0)
+	if err := os.Chtimes(name, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	empty := writeFile(t, filepath.Join(src, "empty"), nil)
+
+	result := receiveAll(receiver, dst)
+	for _, file := range []string{name, empty} {
+		if err := sender.SendFile(file, func(int) {}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sender.SendDone(); err != nil {
+		t.Fatal(err)
+	}
+	r := <-result
+	if r.err != nil || len(r.files) != 2 {
+		t.Fatalf("received %d files, error %v", len(r.files), r.err)
+	}
+	checkFile(t, filepath.Join(dst, "report.pdf"), data)
+	checkFile(t, filepath.Join(dst, "empty"), nil)
+	if stat, err := os.Stat(filepath.Join(dst, "report.pdf")); err != nil || !stat.ModTime().Equal(mtime) {
+		t.Errorf("modification time not kept: %v", err)
+	}
+}
+
+func TestSessionReject(t *testing.T) {
+	sender, receiver := sessionPair(t, ReceivePolicy{MaxFileSize: 1000})
+	src, dst := t.TempDir(), t.TempDir()
+	large := writeFile(t, filepath.Join(src, "large"), randomData(11, 1001))
+	small := writeFile(t, filepath.Join(src, "small"), randomData(12, 1000))
+
+	result := receiveAll(receiver, dst)
+	err := sender.SendFile(large, func(int) {})
+	if _, ok := err.(*RejectedError); !ok {
+		t.Fatalf("large file: %v, want a rejection", err)
+	}
+	// The session goes on after a refused file.
+	if err = sender.SendFile(small, func(int) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err = sender.SendDone(); err != nil {
+		t.Fatal(err)
+	}
+	r := <-result
+	if r.err != nil || len(r.files) != 1 || len(r.rejected) != 1 || r.rejected[0] != "large" {
+		t.Fatalf("received %d files, rejected %v, error %v", len(r.files), r.rejected, r.err)
+	}
+	if _, err = os.Stat(filepath.Join(dst, "large")); !os.IsNotExist(err) {
+		t.Error("rejected file was created")
+	}
+	checkFile(t, filepath.Join(dst, "small"), randomData(12, 1000))
+}
+
+func TestSessionQuota(t *testing.T) {
+	sender, receiver := sessionPair(t, ReceivePolicy{Quota: 1500})
+	src, dst := t.TempDir(), t.TempDir()
+	first := writeFile(t, filepath.Join(src, "first"), randomData(13, 1000))
+	second := writeFile(t, filepath.Join(src, "second"), randomData(14, 1000))
+
+	result := receiveAll(receiver, dst)
+	if err := sender.SendFile(first, func(int) {}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sender.SendFile(second, func(int) {}).(*RejectedError); !ok {
+		t.Error("file over the quota wasn't rejected")
+	}
+	if err := sender.SendDone(); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-result; r.err != nil || len(r.files) != 1 || len(r.rejected) != 1 {
+		t.Fatalf("received %d files, rejected %v, error %v", len(r.files), r.rejected, r.err)
+	}
+}
+
+func TestSessionSync(t *testing.T) {
+	sender, receiver := sessionPair(t, ReceivePolicy{AllowDelete: true})
+	src, dst := t.TempDir(), t.TempDir()
+	local := filepath.Join(src, "docs")
+	writeFile(t, filepath.Join(local, "same.txt"), []byte("same"))
+	writeFile(t, filepath.Join(local, "changed.txt"), []byte("new content"))
+	writeFile(t, filepath.Join(local, "sub", "added.txt"), []byte("added"))
+	writeFile(t, filepath.Join(dst, "docs", "same.txt"), []byte("same"))
+	writeFile(t, filepath.Join(dst, "docs", "changed.txt"), []byte("old content"))
+	writeFile(t, filepath.Join(dst, "docs", "removed.txt"), []byte("removed"))
+
+	result := receiveAll(receiver, dst)
+	entries, err := BuildManifest(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := sender.RequestManifest("docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := PlanSync("docs", entries, remote)
+	var send []string
+	for _, e := range plan.Send {
+		send = append(send, e.Path)
+	}
+	sort.Strings(send)
+	if len(send) != 2 || send[0] != "changed.txt" || send[1] != "sub/added.txt" {
+		t.Errorf("plan sends %v", send)
+	}
+	if len(plan.Delete) != 1 || plan.Delete[0] != "removed.txt" || !plan.AllowDelete {
+		t.Errorf("plan deletes %v, allowed %v", plan.Delete, plan.AllowDelete)
+	}
+	for _, e := range plan.Send {
+		if err = sender.SendSyncFile(filepath.Join(local, filepath.FromSlash(e.Path)), "docs/"+e.Path, func(int) {}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, rel := range plan.Delete {
+		if err = sender.SendDelete("docs/" + rel); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = sender.SendDone(); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-result; r.err != nil {
+		t.Fatal(r.err)
+	}
+	checkFile(t, filepath.Join(dst, "docs", "changed.txt"), []byte("new content"))
+	checkFile(t, filepath.Join(dst, "docs", "sub", "added.txt"), []byte("added"))
+	if _, err = os.Stat(filepath.Join(dst, "docs", "removed.txt")); !os.IsNotExist(err) {
+		t.Error("deleted file is still there")
+	}
+}
+
+func TestSessionDelta(t *testing.T) {
+	sender, receiver := sessionPair(t, ReceivePolicy{Delta: true})
+	src, dst := t.TempDir(), t.TempDir()
+	old := randomData(15, 2*deltaMinSize)
+	edited := editedData(old)
+	name := writeFile(t, filepath.Join(src, "disk.img"), edited)
+	writeFile(t, filepath.Join(dst, "disk.img"), old)
+
+	sent := atomic.LoadUint64(&metricBytesSent.value)
+	result := receiveAll(receiver, dst)
+	if err := sender.SendFile(name, func(int) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sender.SendDone(); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-result; r.err != nil || len(r.files) != 1 {
+		t.Fatalf("received %d files, error %v", len(r.files), r.err)
+	}
+	checkFile(t, filepath.Join(dst, "disk.img"), edited)
+	// Both directions count, the signature goes back to the sender.
+	if n := atomic.LoadUint64(&metricBytesSent.value) - sent; n > uint64(len(edited)/4) {
+		t.Errorf("%d bytes exchanged for a file of %d", n, len(edited))
+	}
+}
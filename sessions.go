@@ -0,0 +1,1188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gotk3/gotk3/glib"
+	"github.com/gotk3/gotk3/gtk"
+)
+
+var server *Server
+var serverMu sync.Mutex
+
+var sessions = make(map[*Session]bool)
+var sessionsMu sync.Mutex
+
+var filesMu sync.Mutex
+
+var watcher *Watcher
+var watcherMu sync.Mutex
+
+var metricsServer *MetricsServer
+
+var controlServer *ControlServer
+
+// webCode is the code browsers enter on the upload page served on
+// webAddresses.
+var webCode string
+var webAddresses []string
+
+// uploadSections hold the files uploaded over HTTP by their senders.
+var uploadSections = make(map[string]*uploadSection)
+var uploadMu sync.Mutex
+
+var localSend *LocalSend
+
+// relayStatus describes the pending relay rendezvous, relayURI is
+// the link to share with the peer, relayCancel stops waiting for it.
+var relayStatus string
+var relayURI *ConnectionURI
+var relayCancel context.CancelFunc
+
+// listenSubtitle describes the listener while no peer is connected,
+// listenAddresses are the host:port pairs it can be reached on.
+var listenSubtitle string
+var listenAddresses []string
+
+func StartServerAsync() {
+	go func() {
+		logger.Info("server start")
+		StartServer()
+		logger.Info("server stopped")
+	}()
+}
+
+// StartServer listens for peers and serves them until StopServer is called.
+func StartServer() {
+	if !config.Server.Listen {
+		return
+	}
+	network, bind, port := config.Server.Network, config.Server.Bind, config.Server.Port
+	address := net.JoinHostPort(bind, port)
+	if config.Server.Address != "" {
+		address = config.Server.Address
+	}
+	ln, err := Listen(network, address)
+	if err != nil {
+		logger.Error("listening failed", "error", err)
+		showError("Unable to listen on %s: %s", address, err)
+		return
+	}
+	srv := NewServer(ln, config.Server.MaxPeers, ServeSession)
+	srv.Secret = config.Server.Secret
+	serverMu.Lock()
+	server = srv
+	serverMu.Unlock()
+	if config.Web.Enabled {
+		if web := startWebReceiver(network, bind); web != nil {
+			defer stopWebReceiver(web)
+		}
+	}
+
+	addresses := ListenAddresses(network, bind, port)
+	if config.Server.Address != "" {
+		addresses = []string{config.Server.Address}
+	}
+	logger.Info("server addresses", "addresses", strings.Join(addresses, ","))
+	if config.Server.Address != "" {
+		// Other transports are not reachable from the network.
+		setListenSubtitle(listenDescription(addresses, port))
+	} else if config.Server.MapPort && network != NetworkIPv6 && !net.ParseIP(bind).IsLoopback() {
+		setListenSubtitle(listenDescription(addresses, port) + ", mapping port…")
+		p, _ := strconv.Atoi(port)
+		mapping, err := MapPort(p)
+		if err != nil {
+			logger.Warn("port mapping failed", "error", err)
+			setListenSubtitle(listenDescription(addresses, port) + ", port mapping failed")
+		} else {
+			//noinspection GoUnhandledErrorResult
+			defer mapping.Close()
+			addresses = append([]string{mapping.Address()}, addresses...)
+			setListenSubtitle(listenDescription(addresses, port) + " (mapped via " + mapping.Method + ")")
+		}
+	} else {
+		if bind == "" && network != NetworkIPv6 {
+			if ip, err := GetIpAddr(); err == nil {
+				addresses = append([]string{net.JoinHostPort(ip, port)}, addresses...)
+			}
+		}
+		setListenSubtitle(listenDescription(addresses, port))
+	}
+	sessionsMu.Lock()
+	listenAddresses = addresses
+	sessionsMu.Unlock()
+	updateSubtitle()
+
+	err = srv.Serve()
+	if err != nil {
+		logger.Error("accepting failed", "error", err)
+	}
+
+	serverMu.Lock()
+	if server == srv {
+		server = nil
+	}
+	stopped := server == nil
+	serverMu.Unlock()
+	if stopped {
+		sessionsMu.Lock()
+		listenAddresses = nil
+		sessionsMu.Unlock()
+		setListenSubtitle("")
+	}
+}
+
+// startWebReceiver serves the upload page for browsers next to the listener.
+func startWebReceiver(network string, bind string) *WebReceiver {
+	address := net.JoinHostPort(bind, config.Web.Port)
+	ln, err := Listen(network, address)
+	if err != nil {
+		logger.Error("unable to serve upload page", "address", address, "error", err)
+		showError("Unable to serve the upload page on %s: %s", address, err)
+		return nil
+	}
+	code, err := NewRelayCode()
+	if err == nil {
+		var web *WebReceiver
+		web, err = NewWebReceiver(ln, config.Server.Directory, code)
+		if err == nil {
+			web.MaxFileSize = int64(config.Server.MaxFileSize) << 20
+			web.Upload = func(client string, name string, size int64) (func(p int), func(file ReceivedFile, err error)) {
+				return httpUpload("From browser at "+client, client, name, size)
+			}
+			if config.Web.Downloads {
+				web.Downloads = queuedDownloads
+			}
+			go func() {
+				if err := web.Serve(); err != nil {
+					logger.Error("serving upload page failed", "error", err)
+				}
+			}()
+			logger.Info("serving upload page", "address", address)
+			sessionsMu.Lock()
+			webCode = code
+			webAddresses = ListenAddresses(network, bind, config.Web.Port)
+			sessionsMu.Unlock()
+			return web
+		}
+	}
+	logger.Error("unable to serve upload page", "error", err)
+	//noinspection GoUnhandledErrorResult
+	ln.Close()
+	return nil
+}
+
+func stopWebReceiver(web *WebReceiver) {
+	assertError(web.Close(), "unable to stop upload page")
+	sessionsMu.Lock()
+	webCode = ""
+	webAddresses = nil
+	sessionsMu.Unlock()
+	updateSubtitle()
+}
+
+// uploadSection is the section of a sender uploading files over HTTP,
+// finished while it isn't uploading any.
+type uploadSection struct {
+	section *gtk.TreeIter
+	uploads int
+}
+
+// httpUpload shows a file uploaded over HTTP in the transfer list below
+// the section with the title.
+func httpUpload(title string, client string, name string, size int64) (func(p int), func(file ReceivedFile, err error)) {
+	uploadMu.Lock()
+	c, ok := uploadSections[title]
+	if !ok {
+		c = &uploadSection{section: addSection(title)}
+		uploadSections[title] = c
+	} else if c.uploads == 0 {
+		setProgress(c.section, 0)
+	}
+	c.uploads++
+	uploadMu.Unlock()
+
+	var row *gtk.TreeIter
+	runOnMain(func() {
+		row = addRow(treeStore, c.section, name, ByteCountBinary(size))
+		treeFiles.ExpandAll()
+	})
+	progress := func(p int) {
+		setProgress(row, p)
+	}
+	done := func(file ReceivedFile, err error) {
+		if err != nil {
+			showError("Receiving %s from %s failed: %s", name, client, err)
+		} else if config.Hooks.Received != "" {
+			command, env := config.Hooks.Received, receivedEnv(file, client, "")
+			go runHook(command, filepath.Dir(file.Path), env, row, file.Name)
+		}
+		uploadMu.Lock()
+		c.uploads--
+		if c.uploads == 0 {
+			finishSection(c.section)
+		}
+		uploadMu.Unlock()
+	}
+	return progress, done
+}
+
+// StartLocalSend joins the LocalSend devices on the network, if enabled.
+func StartLocalSend() {
+	if !config.LocalSend.Enabled {
+		return
+	}
+	alias := config.LocalSend.Alias
+	if alias == "" {
+		alias, _ = os.Hostname()
+	}
+	port, _ := strconv.Atoi(config.LocalSend.Port)
+	l, err := NewLocalSend(alias, port, config.LocalSend.HTTPS, config.Server.Directory)
+	if err == nil {
+		l.Policy = func(host string) ReceivePolicy {
+			return receivePolicy(&net.TCPAddr{IP: net.ParseIP(host)}, "")
+		}
+		// Devices aren't authenticated, with a pairing secret set the
+		// user takes their files or not.
+		l.Confirm = func(sender string, count int, size int64) bool {
+			accepted := true
+			runOnMain(func() {
+				if config.Server.Secret != "" {
+					accepted = showLocalSendRequest(sender, count, size)
+				}
+			})
+			return accepted
+		}
+		l.Upload = func(client string, name string, size int64) (func(p int), func(file ReceivedFile, err error)) {
+			return httpUpload("From "+client+" via LocalSend", client, name, size)
+		}
+		err = l.Start()
+	}
+	if err != nil {
+		logger.Error("unable to start localsend", "port", port, "error", err)
+		showError("Unable to start LocalSend on port %d: %s", port, err)
+		return
+	}
+	logger.Info("localsend started", "alias", alias, "port", port)
+	localSend = l
+}
+
+func StopLocalSend() {
+	if localSend != nil {
+		assertError(localSend.Close(), "unable to stop localsend")
+		localSend = nil
+	}
+}
+
+// SendLocalSend sends the queued files to the LocalSend device at once,
+// the files which fail go back to the queue.
+func SendLocalSend(l *LocalSend, peer LocalSendPeer) error {
+	var indexes []int
+	var outFiles []OutFile
+	for {
+		i, outFile, ok := takeOutFile()
+		if !ok {
+			break
+		}
+		indexes = append(indexes, i)
+		outFiles = append(outFiles, outFile)
+	}
+	if len(outFiles) == 0 {
+		return errors.New("no files to send")
+	}
+	section := addSection("To " + peer.Title())
+	defer finishSection(section)
+	names := make([]string, len(outFiles))
+	remotes := make([]string, len(outFiles))
+	rows := make([]*gtk.TreeIter, len(outFiles))
+	runOnMain(func() {
+		for i, outFile := range outFiles {
+			names[i], remotes[i] = outFile.Name, outFile.Remote
+			size := ""
+			if stat, err := os.Stat(outFile.Name); err == nil {
+				size = ByteCountBinary(stat.Size())
+			}
+			rows[i] = addRow(treeStore, section, outFile.Title(), size)
+		}
+		treeFiles.ExpandAll()
+	})
+	errs, err := l.Send(peer, names, remotes, func(i int, p int) {
+		setProgress(rows[i], p)
+		setProgress(outFiles[i].Iter, p)
+	})
+	if err != nil {
+		for _, i := range indexes {
+			releaseOutFile(i)
+		}
+		return err
+	}
+	for i, err := range errs {
+		if rejected, ok := err.(*RejectedError); ok {
+			// The file stays out of the queue, resending would be refused again.
+			showError("%s refused %s: %s", peer.Alias, rejected.Name, rejected.Reason)
+		} else if err != nil {
+			releaseOutFile(indexes[i])
+		}
+	}
+	return nil
+}
+
+// queuedDownloads offers the queued files to browsers by their names.
+func queuedDownloads() map[string]string {
+	filesMu.Lock()
+	defer filesMu.Unlock()
+	downloads := make(map[string]string, len(files))
+	for _, f := range files {
+		downloads[f.Title()] = f.Name
+	}
+	return downloads
+}
+
+// WebLink is an address of the upload page, the URL logs the browser in.
+type WebLink struct {
+	Address string
+	URL     string
+}
+
+func WebLinks() []WebLink {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	var links []WebLink
+	for _, address := range webAddresses {
+		links = append(links, WebLink{Address: address, URL: "http://" + address + "/?code=" + webCode})
+	}
+	return links
+}
+
+func listenDescription(addresses []string, port string) string {
+	if len(addresses) == 0 {
+		return "Listening on port " + port
+	}
+	return "Listening on " + strings.Join(addresses, ", ")
+}
+
+func StopServer() {
+	serverMu.Lock()
+	srv := server
+	server = nil
+	serverMu.Unlock()
+	if srv != nil {
+		err := srv.Close()
+		if err != nil {
+			logger.Error("unable to stop listening", "error", err)
+		}
+	}
+}
+
+// StartMetrics serves the metrics, if configured.
+func StartMetrics() {
+	if config.Metrics.Listen == "" {
+		return
+	}
+	m, err := StartMetricsServer(config.Metrics.Listen)
+	if err != nil {
+		logger.Error("unable to serve metrics", "address", config.Metrics.Listen, "error", err)
+		showError("Unable to serve metrics on %s: %s", config.Metrics.Listen, err)
+		return
+	}
+	metricsServer = m
+}
+
+// StartWatcher sends the files dropped into the outbox, if configured.
+func StartWatcher() {
+	if config.Watch.Directory == "" {
+		return
+	}
+	profile := config.Watch.Profile
+	w, err := NewWatcher(config.Watch.Directory, func(names []string) []error {
+		return SendOutbox(profile, names)
+	})
+	if err != nil {
+		logger.Error("unable to watch outbox", "dir", config.Watch.Directory, "error", err)
+		showError("Unable to watch %s: %s", config.Watch.Directory, err)
+		return
+	}
+	logger.Info("watching outbox", "dir", config.Watch.Directory)
+	watcherMu.Lock()
+	watcher = w
+	watcherMu.Unlock()
+}
+
+func StopWatcher() {
+	watcherMu.Lock()
+	w := watcher
+	watcher = nil
+	watcherMu.Unlock()
+	if w != nil {
+		assertError(w.Close(), "unable to stop watching outbox")
+	}
+}
+
+// StartControl serves the control API, if enabled.
+func StartControl() {
+	if !config.Control.Enabled {
+		return
+	}
+	path := config.Control.Socket
+	if path == "" {
+		path = defaultControlSocket()
+	}
+	c, err := StartControlServer(path, controlMethods())
+	if err != nil {
+		logger.Error("unable to serve control api", "socket", path, "error", err)
+		return
+	}
+	controlServer = c
+}
+
+func StopControl() {
+	if controlServer != nil {
+		assertError(controlServer.Close(), "unable to stop control api")
+		controlServer = nil
+	}
+}
+
+// TransferRow is a row of the transfer list, a queued file or a session
+// with the files it sent or received.
+type TransferRow struct {
+	Path     string        `json:"path"`
+	Name     string        `json:"name"`
+	Size     string        `json:"size"`
+	Progress int           `json:"progress"`
+	Rows     []TransferRow `json:"rows,omitempty"`
+}
+
+func controlMethods() map[string]ControlMethod {
+	return map[string]ControlMethod{
+		// queue adds the files to the list of files to send.
+		"queue": func(params json.RawMessage) (interface{}, error) {
+			var p struct {
+				Files []string `json:"files"`
+			}
+			if err := json.Unmarshal(params, &p); err != nil {
+				return nil, err
+			}
+			if len(p.Files) == 0 {
+				return nil, errors.New("no files given")
+			}
+			for _, name := range p.Files {
+				name, err := filepath.Abs(name)
+				if err == nil {
+					runOnMain(func() {
+						err = QueueFile(name)
+					})
+				}
+				if err != nil {
+					return nil, fmt.Errorf("%s: %v", name, err)
+				}
+			}
+			return len(p.Files), nil
+		},
+		// connect connects to the profile or to the host and port.
+		"connect": func(params json.RawMessage) (interface{}, error) {
+			var p struct {
+				Profile string `json:"profile"`
+				Host    string `json:"host"`
+				Port    string `json:"port"`
+			}
+			if err := json.Unmarshal(params, &p); err != nil {
+				return nil, err
+			}
+			destination := Profile{Host: p.Host, Port: p.Port}
+			if p.Profile != "" {
+				var ok bool
+				if destination, ok = profileByName(p.Profile); !ok {
+					return nil, fmt.Errorf("profile %q not found", p.Profile)
+				}
+			}
+			if destination.Port == "" {
+				destination.Port = defaultPort
+			}
+			if destination.Host == "" {
+				return nil, errors.New("no profile or host given")
+			}
+			if err := validatePort(destination.Port); err != nil {
+				return nil, err
+			}
+			runOnMain(func() {
+				ConnectAsync(destination)
+			})
+			return true, nil
+		},
+		"transfers": func(json.RawMessage) (interface{}, error) {
+			var rows []TransferRow
+			runOnMain(func() {
+				rows = transferRows(nil)
+			})
+			return rows, nil
+		},
+		"profiles": func(json.RawMessage) (interface{}, error) {
+			return profilesSnapshot(), nil
+		},
+	}
+}
+
+// transferRows returns the children of the row, the toplevel ones for nil.
+func transferRows(parent *gtk.TreeIter) []TransferRow {
+	rows := []TransferRow{}
+	var iter gtk.TreeIter
+	for ok := treeStore.IterChildren(parent, &iter); ok; ok = treeStore.IterNext(&iter) {
+		row := TransferRow{Path: rowPath(&iter)}
+		row.Name, _ = rowValue(&iter, ColumnName).(string)
+		row.Size, _ = rowValue(&iter, ColumnSize).(string)
+		row.Progress, _ = rowValue(&iter, ColumnProgress).(int)
+		if treeStore.IterHasChild(&iter) {
+			row.Rows = transferRows(&iter)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func rowValue(iter *gtk.TreeIter, column int) interface{} {
+	value, err := treeStore.GetValue(iter, column)
+	if err != nil {
+		return nil
+	}
+	v, _ := value.GoValue()
+	return v
+}
+
+func rowPath(iter *gtk.TreeIter) string {
+	path, err := treeStore.GetPath(iter)
+	if err != nil {
+		return ""
+	}
+	return path.String()
+}
+
+// SendOutbox sends the files to the profile in a single session and
+// returns the outcome for every file.
+func SendOutbox(name string, names []string) []error {
+	errs := make([]error, len(names))
+	fail := func(err error) []error {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+		return errs
+	}
+	profile, ok := profileByName(name)
+	if !ok {
+		return fail(fmt.Errorf("profile %q not found", name))
+	}
+	logger.Info("send outbox", "address", profile.Address(), "files", len(names))
+	s, err := Connect(profile.Address(), profile.Pairing())
+	if err != nil {
+		logger.Error("unable to connect", "address", profile.Address(), "error", err)
+		return fail(err)
+	}
+	addSession(s)
+	section := addSection("Outbox to " + profile.Title())
+	defer func() {
+		_ = s.Close()
+		finishSection(section)
+		removeSession(s)
+	}()
+
+	for j, file := range names {
+		size := ""
+		if stat, err := os.Stat(file); err == nil {
+			size = ByteCountBinary(stat.Size())
+		}
+		var row *gtk.TreeIter
+		runOnMain(func() {
+			row = addRow(treeStore, section, filepath.Base(file), size)
+			treeFiles.ExpandAll()
+		})
+		errs[j] = s.SendFile(file, func(p int) {
+			setProgress(row, p)
+		})
+		if _, ok := errs[j].(*RejectedError); !ok && errs[j] != nil {
+			return fail(errs[j])
+		}
+	}
+	if err = s.SendDone(); err != nil {
+		return fail(err)
+	}
+	ReceiveFiles(s, section)
+	return errs
+}
+
+// ServeSession exchanges files with a peer accepted by the listener.
+func ServeSession(s *Session) {
+	serveSession(s, "From "+s.RemoteAddr())
+}
+
+func serveSession(s *Session, title string) {
+	addSession(s)
+	section := addSection(title)
+	ReceiveFiles(s, section)
+	SendFiles(s)
+	finishSection(section)
+	removeSession(s)
+}
+
+func RunClient(destination Profile) error {
+	address := destination.Address()
+	logger.Info("connect", "address", address)
+	SetSubtitle("Connecting to " + address)
+	s, err := Connect(address, destination.Pairing())
+	if err != nil {
+		logger.Error("unable to connect", "address", address, "error", err)
+		updateSubtitle()
+		return err
+	}
+	runClientSession(s, "To "+address)
+	return nil
+}
+
+func runClientSession(s *Session, title string) {
+	addSession(s)
+	section := addSection(title)
+	SendFiles(s)
+	ReceiveFiles(s, section)
+	_ = s.Close()
+	finishSection(section)
+	removeSession(s)
+}
+
+// RunRelay meets the peer with the rendezvous code on the configured relay
+// and exchanges files with it. The receiver serves the session the way the
+// listener does, the sender acts like a connecting client and checks the
+// key of the receiver, when given.
+func RunRelay(address string, code string, key string, role byte) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	status := "Connecting via relay"
+	var uri *ConnectionURI
+	if role == RoleReceiver {
+		status = "Waiting on relay, code " + code
+		uri = &ConnectionURI{Relay: address, Code: code, Key: LocalFingerprint()}
+	}
+	setRelayState(status, uri, cancel)
+	conn, err := DialRelay(ctx, address, code, role)
+	setRelayState("", nil, nil)
+	if err != nil {
+		logger.Error("relay failed", "error", err)
+		return err
+	}
+	s := NewSession(conn)
+	// The rendezvous code pairs the peers already.
+	if role == RoleReceiver {
+		err = s.AcceptHello("")
+	} else {
+		err = s.Hello(Pairing{Key: key})
+	}
+	if err != nil {
+		_ = s.Close()
+		return err
+	}
+	if role == RoleReceiver {
+		serveSession(s, "From relay peer")
+		_ = s.Close()
+	} else {
+		runClientSession(s, "To relay peer")
+	}
+	return nil
+}
+
+// RunSync mirrors the local directory to the peer's incoming directory.
+// Only new and changed files are sent, after preview has approved the plan
+// and told if the files missing locally are deleted on the peer.
+func RunSync(destination Profile, dir string, preview func(plan SyncPlan) (bool, bool)) error {
+	address := destination.Address()
+	logger.Info("sync", "dir", dir, "address", address)
+	SetSubtitle("Connecting to " + address)
+	s, err := Connect(address, destination.Pairing())
+	if err != nil {
+		logger.Error("unable to connect", "address", address, "error", err)
+		updateSubtitle()
+		return err
+	}
+	addSession(s)
+	section := addSection("Sync to " + address)
+	defer func() {
+		_ = s.Close()
+		finishSection(section)
+		removeSession(s)
+	}()
+
+	folder := filepath.Base(dir)
+	local, err := BuildManifest(dir)
+	if err != nil {
+		return err
+	}
+	remote, err := s.RequestManifest(folder)
+	if err != nil {
+		return err
+	}
+	plan := PlanSync(folder, local, remote)
+	proceed, deletions := preview(plan)
+	if proceed {
+		for _, e := range plan.Send {
+			var row *gtk.TreeIter
+			runOnMain(func() {
+				row = addRow(treeStore, section, e.Path, ByteCountBinary(e.Size))
+				treeFiles.ExpandAll()
+			})
+			err = s.SendSyncFile(filepath.Join(dir, filepath.FromSlash(e.Path)), folder+"/"+e.Path, func(p int) {
+				setProgress(row, p)
+			})
+			if rejected, ok := err.(*RejectedError); ok {
+				showError("Peer refused %s: %s", rejected.Name, rejected.Reason)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if deletions && plan.AllowDelete {
+			for _, rel := range plan.Delete {
+				if err = s.SendDelete(folder + "/" + rel); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err = s.SendDone(); err != nil {
+		return err
+	}
+	ReceiveFiles(s, section)
+	return nil
+}
+
+// RunBroadcast sends the queued files to several peers in parallel and
+// returns the outcome for every destination, nil for the successful ones.
+func RunBroadcast(destinations []Profile) []error {
+	errs := make([]error, len(destinations))
+	peers := make([]*Session, len(destinations))
+	sections := make([]*gtk.TreeIter, len(destinations))
+	var wg sync.WaitGroup
+	for i, d := range destinations {
+		wg.Add(1)
+		go func(i int, d Profile) {
+			defer wg.Done()
+			logger.Info("connect", "address", d.Address())
+			peers[i], errs[i] = Connect(d.Address(), d.Pairing())
+		}(i, d)
+	}
+	wg.Wait()
+	for i, s := range peers {
+		if errs[i] != nil {
+			logger.Error("unable to connect", "address", destinations[i].Address(), "error", errs[i])
+			continue
+		}
+		addSession(s)
+		sections[i] = addSection("To " + destinations[i].Address())
+	}
+
+	for {
+		var targets []*Session
+		var indexes []int
+		for i, s := range peers {
+			if errs[i] == nil {
+				targets = append(targets, s)
+				indexes = append(indexes, i)
+			}
+		}
+		if len(targets) == 0 {
+			break
+		}
+		q, outFile, ok := takeOutFile()
+		if !ok {
+			break
+		}
+		size := ""
+		if stat, err := os.Stat(outFile.Name); err == nil {
+			size = ByteCountBinary(stat.Size())
+		}
+		rows := make([]*gtk.TreeIter, len(targets))
+		progress := make([]int, len(targets))
+		runOnMain(func() {
+			for j, i := range indexes {
+				rows[j] = addRow(treeStore, sections[i], outFile.Title(), size)
+			}
+			treeFiles.ExpandAll()
+		})
+		results := SendFileToAll(targets, outFile.Name, outFile.Remote, func(j int, p int) {
+			setProgress(rows[j], p)
+			// The queued file shows the progress of the slowest peer.
+			progress[j] = p
+			min := progress[0]
+			for _, other := range progress[1:] {
+				if other < min {
+					min = other
+				}
+			}
+			setProgress(outFile.Iter, min)
+		})
+		sent := false
+		for j, err := range results {
+			if rejected, ok := err.(*RejectedError); ok {
+				showError("%s refused %s: %s", destinations[indexes[j]].Address(), rejected.Name, rejected.Reason)
+			} else if err != nil {
+				errs[indexes[j]] = err
+			} else {
+				sent = true
+			}
+		}
+		if !sent {
+			releaseOutFile(q)
+		}
+	}
+
+	for i, s := range peers {
+		if s == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, s *Session) {
+			defer wg.Done()
+			if errs[i] == nil {
+				errs[i] = s.SendDone()
+			}
+			if errs[i] == nil {
+				ReceiveFiles(s, sections[i])
+			}
+			_ = s.Close()
+			finishSection(sections[i])
+			removeSession(s)
+		}(i, s)
+	}
+	wg.Wait()
+	return errs
+}
+
+// DisconnectAll drops every connected peer, the listener keeps running.
+func DisconnectAll() error {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	if relayCancel != nil {
+		relayCancel()
+	}
+	var result error
+	for s := range sessions {
+		if err := s.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+func addSession(s *Session) {
+	s.SetRateLimits(int64(config.Limits.PeerUpload)*1024, int64(config.Limits.PeerDownload)*1024)
+	s.SetReceivePolicy(receivePolicy(s.conn.RemoteAddr(), s.PeerKey()))
+	sessionsMu.Lock()
+	sessions[s] = true
+	sessionsMu.Unlock()
+	updateSubtitle()
+}
+
+// receivePolicy returns the settings for files of the peer at the address
+// with the key, which is empty for peers without one. The settings and the
+// profiles are read on the main loop which changes them, the sender is
+// looked up outside of it.
+func receivePolicy(addr net.Addr, key string) ReceivePolicy {
+	var policy ReceivePolicy
+	var profiles []Profile
+	runOnMain(func() {
+		policy = ReceivePolicy{
+			MaxFileSize: int64(config.Server.MaxFileSize) << 20,
+			Quota:       int64(config.Server.Quota) << 20,
+			Preallocate: config.Server.Preallocate,
+			KeepModTime: config.Server.KeepModTime,
+			KeepMode:    config.Server.KeepMode,
+			KeepXattrs:  config.Server.KeepXattrs,
+			AllowDelete: config.Server.AllowDelete,
+			Delta:       config.Server.Delta,
+			Routes:      config.Routes,
+			SenderKey:   key,
+		}
+		profiles = append([]Profile{}, config.Client.Profiles...)
+	})
+	policy.Sender = senderProfile(addr, key, profiles)
+	return policy
+}
+
+// ApplyRateLimits puts the configured limits in force, also for the
+// transfers already running.
+func ApplyRateLimits() {
+	GlobalUpload.SetRate(int64(config.Limits.Upload) * 1024)
+	GlobalDownload.SetRate(int64(config.Limits.Download) * 1024)
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	for s := range sessions {
+		s.SetRateLimits(int64(config.Limits.PeerUpload)*1024, int64(config.Limits.PeerDownload)*1024)
+	}
+}
+
+func removeSession(s *Session) {
+	sessionsMu.Lock()
+	delete(sessions, s)
+	sessionsMu.Unlock()
+	updateSubtitle()
+}
+
+func setRelayState(status string, uri *ConnectionURI, cancel context.CancelFunc) {
+	sessionsMu.Lock()
+	relayStatus = status
+	relayURI = uri
+	relayCancel = cancel
+	sessionsMu.Unlock()
+	updateSubtitle()
+}
+
+func setListenSubtitle(subtitle string) {
+	sessionsMu.Lock()
+	listenSubtitle = subtitle
+	sessionsMu.Unlock()
+	updateSubtitle()
+}
+
+// updateSubtitle reflects connected peers or the listener state in the header.
+func updateSubtitle() {
+	sessionsMu.Lock()
+	count := len(sessions)
+	subtitle := listenSubtitle
+	if relayStatus != "" {
+		subtitle = relayStatus
+	}
+	for s := range sessions {
+		subtitle = "Connected to " + s.RemoteAddr()
+	}
+	busy := count > 0 || relayStatus != ""
+	sessionsMu.Unlock()
+	if count > 1 {
+		subtitle = fmt.Sprintf("Connected to %d peers", count)
+	}
+	SetSubtitle(subtitle)
+	SwitchConnectionButton(busy)
+	SwitchShareButton(len(ConnectionURIs())+len(WebLinks()) > 0)
+}
+
+// ConnectionURIs lists the links peers can use to reach this instance.
+func ConnectionURIs() []ConnectionURI {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	var uris []ConnectionURI
+	if relayURI != nil {
+		uris = append(uris, *relayURI)
+	}
+	for _, address := range listenAddresses {
+		if HasTransport(address) {
+			continue
+		}
+		host, port, err := net.SplitHostPort(address)
+		if err == nil {
+			uris = append(uris, ConnectionURI{Host: host, Port: port, Secret: config.Server.Secret, Key: LocalFingerprint()})
+		}
+	}
+	return uris
+}
+
+func ReceiveFiles(s *Session, section *gtk.TreeIter) {
+	var iter *gtk.TreeIter
+	var received []ReceivedFile
+	// Hooks run one after another in the background, a chain of channels
+	// keeps them in the order the files came in.
+	hooks := make(chan struct{})
+	close(hooks)
+	for {
+		more, err := s.ReadFile(config.Server.Directory, func(name string, size int64) {
+			runOnMain(func() {
+				iter = addRow(treeStore, section, name, ByteCountBinary(size))
+				treeFiles.ExpandAll()
+			})
+		}, func(p int) {
+			setProgress(iter, p)
+		}, func(file ReceivedFile) {
+			received = append(received, file)
+			if config.Hooks.Received == "" {
+				return
+			}
+			command, env := config.Hooks.Received, receivedEnv(file, s.RemoteAddr(), s.policy.Sender)
+			prev, done, row := hooks, make(chan struct{}), iter
+			hooks = done
+			go func() {
+				<-prev
+				runHook(command, filepath.Dir(file.Path), env, row, file.Name)
+				close(done)
+			}()
+		})
+		if rejected, ok := err.(*RejectedError); ok {
+			showError("Refused %s: %s", rejected.Name, rejected.Reason)
+			continue
+		}
+		if err != nil {
+			showError("File receiving error")
+			break
+		}
+		if !more {
+			s.log.Info("done receiving files", "files", len(received))
+			break
+		}
+		s.log.Debug("receive next file")
+	}
+	if config.Hooks.SessionEnd != "" && len(received) > 0 {
+		command, dir := config.Hooks.SessionEnd, config.Server.Directory
+		env := sessionEnv(dir, received, s.RemoteAddr(), s.policy.Sender)
+		go func(prev chan struct{}) {
+			<-prev
+			runHook(command, dir, env, section, "session with "+s.RemoteAddr())
+		}(hooks)
+	}
+}
+
+// runHook runs the command and shows its output below the row, a failure
+// is reported but doesn't touch the received files.
+func runHook(command string, dir string, env []string, row *gtk.TreeIter, subject string) {
+	logger.Info("run hook", "subject", subject)
+	output, err := RunHook(command, dir, env, time.Duration(config.Hooks.Timeout)*time.Second)
+	if output != "" {
+		logger.Info("hook output", "subject", subject, "output", output)
+	}
+	status := "hook done"
+	if err != nil {
+		logger.Error("hook failed", "subject", subject, "error", err)
+		showError("Hook for %s failed: %s", subject, err)
+		status = "hook failed"
+	}
+	lines := strings.Split(output, "\n")
+	if len(lines) > maxPreviewLines {
+		lines = append([]string{"..."}, lines[len(lines)-maxPreviewLines:]...)
+	}
+	text := strings.Join(lines, "\n")
+	if output == "" {
+		text = "(no output)"
+	}
+	runOnMain(func() {
+		hookRow := addRow(treeStore, row, text, status)
+		if err == nil {
+			_ = treeStore.SetValue(hookRow, ColumnProgress, 100)
+		}
+		treeFiles.ExpandAll()
+	})
+}
+
+func SendFiles(s *Session) {
+	var err error
+	for {
+		i, outFile, ok := takeOutFile()
+		if !ok {
+			break
+		}
+		progress := func(p int) {
+			setProgress(outFile.Iter, p)
+		}
+		if outFile.Remote != "" {
+			err = s.SendSyncFile(outFile.Name, outFile.Remote, progress)
+		} else {
+			err = s.SendFile(outFile.Name, progress)
+		}
+		if rejected, ok := err.(*RejectedError); ok {
+			// The file stays out of the queue, resending would be refused again.
+			showError("Peer refused %s: %s", rejected.Name, rejected.Reason)
+			err = nil
+			continue
+		}
+		if err != nil {
+			releaseOutFile(i)
+			break
+		}
+	}
+	if err == nil {
+		err = s.SendDone()
+	}
+	if err != nil {
+		showError("File sending error")
+	}
+}
+
+// takeOutFile marks the next queued file as done and returns its index,
+// so every file goes to a single peer when several are connected.
+func takeOutFile() (int, OutFile, bool) {
+	filesMu.Lock()
+	defer filesMu.Unlock()
+	for i := range files {
+		if !files[i].IsDone {
+			files[i].IsDone = true
+			return i, files[i], true
+		}
+	}
+	return 0, OutFile{}, false
+}
+
+// releaseOutFile returns a file which failed to send back to the queue.
+func releaseOutFile(i int) {
+	filesMu.Lock()
+	files[i].IsDone = false
+	filesMu.Unlock()
+}
+
+func addSection(title string) *gtk.TreeIter {
+	var iter *gtk.TreeIter
+	runOnMain(func() {
+		iter = addRow(treeStore, nil, title, "")
+	})
+	return iter
+}
+
+func finishSection(section *gtk.TreeIter) {
+	setProgress(section, 100)
+}
+
+func setProgress(iter *gtk.TreeIter, p int) {
+	glib.IdleAdd(func() {
+		err := treeStore.SetValue(iter, ColumnProgress, p)
+		if err != nil {
+			log.Fatal("unable set value:", err)
+		}
+		publishControl(ControlEvent{Event: eventProgress, Path: rowPath(iter), Progress: p})
+	})
+}
+
+// runOnMain runs f in the GTK main loop and waits for it to return,
+// it must not be called from the main loop itself.
+func runOnMain(f func()) {
+	done := make(chan struct{})
+	glib.IdleAdd(func() {
+		f()
+		close(done)
+	})
+	<-done
+}
+
+// profilesSnapshot copies the profiles on the main loop, which changes
+// them, for other goroutines.
+func profilesSnapshot() []Profile {
+	var profiles []Profile
+	runOnMain(func() {
+		profiles = append([]Profile{}, config.Client.Profiles...)
+	})
+	return profiles
+}
+
+// profileByName looks the profile up on the main loop and returns a copy.
+func profileByName(name string) (Profile, bool) {
+	var profile Profile
+	found := false
+	runOnMain(func() {
+		if i := findProfile(name); i >= 0 {
+			profile, found = config.Client.Profiles[i], true
+		}
+	})
+	return profile, found
+}
@@ -3,168 +3,561 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
-	"log"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var ln net.Listener
-var conn net.Conn
-var reader *bufio.Reader
-var writer *bufio.Writer
-
 const BufferSize = 102400
 
-func Listen(port string) (string, error) {
-	var err error
-	err = StopListen()
-	log.Println("listening...")
+// Event types, every event starts with its type byte.
+const (
+	typeFile     byte = 1
+	typeDone     byte = 2
+	typeManifest byte = 3
+	typeSyncFile byte = 4
+	typeDelete   byte = 5
+)
 
-	// listen on port 8000
-	ln, err = net.Listen("tcp", ":"+port)
-	if err != nil || ln == nil {
-		return "", err
-	}
+// Replies of the receiver to a file header, a rejection is followed by
+// the reason line and no file data.
+// A delta reply is followed by the signature of the receiver's copy.
+const (
+	replyAccept byte = 0
+	replyReject byte = 1
+	replyDelta  byte = 2
+)
 
-	// accept connection
-	conn, err = ln.Accept()
-	if err != nil {
-		return "", err
+// Flags at the end of a file header.
+const headerDelta byte = 1
+
+// ReceivePolicy limits what a session accepts, zero values are unlimited.
+type ReceivePolicy struct {
+	MaxFileSize int64
+	Quota       int64
+	Preallocate bool
+	// Metadata of the sender honoured on received files.
+	KeepModTime bool
+	KeepMode    bool
+	KeepXattrs  bool
+	// AllowDelete lets the peer remove synced files.
+	AllowDelete bool
+	// Delta patches existing copies with the changed blocks only.
+	Delta bool
+	// Routes pick the directory of received files by the rules, Sender is
+	// the profile name of the peer and SenderKey its key fingerprint.
+	Routes    []Route
+	Sender    string
+	SenderKey string
+}
+
+// ReceivedFile is a file stored by ReadFile.
+type ReceivedFile struct {
+	Path     string
+	Name     string
+	Size     int64
+	Checksum []byte
+	// Rule is the name of the routing rule which picked the directory.
+	Rule string
+}
+
+// RejectedError is a file refused by the receiver, the session goes on.
+type RejectedError struct {
+	Name   string
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return e.Name + " rejected: " + e.Reason
+}
+
+// StreamConn is a connection carrying every event on a stream of its own.
+// The session still handles one event at a time.
+type StreamConn interface {
+	net.Conn
+	OpenStream() (net.Conn, error)
+	AcceptStream() (net.Conn, error)
+}
+
+// Session is a connection to a single peer.
+type Session struct {
+	conn     net.Conn
+	stream   net.Conn
+	reader   *bufio.Reader
+	writer   *bufio.Writer
+	upload   *RateLimiter
+	download *RateLimiter
+	policy   ReceivePolicy
+	received int64
+	// peerKey is the fingerprint of the peer's identity, known after the
+	// hello.
+	peerKey string
+	// keys encrypt the events once the hello agreed on them.
+	keys *sessionKeys
+	log  Logger
+	// Metrics of the session.
+	started   time.Time
+	failed    int32
+	closeOnce sync.Once
+}
+
+// NewSession paces the connection with its own limits and the global ones.
+func NewSession(conn net.Conn) *Session {
+	s := &Session{
+		started:  time.Now(),
+		conn:     conn,
+		upload:   &RateLimiter{},
+		download: &RateLimiter{},
+		log:      logger.With("peer", conn.RemoteAddr().String()),
 	}
+	s.use(conn, nil)
+	metricActiveSessions.Add(1)
+	return s
+}
 
-	reader = bufio.NewReader(conn)
-	writer = bufio.NewWriter(conn)
+// use makes the events go over the connection or stream, encrypted by
+// secure when it is given.
+func (s *Session) use(conn net.Conn, secure func(net.Conn) net.Conn) {
+	var limited net.Conn = &rateConn{
+		Conn:     conn,
+		upload:   []*RateLimiter{s.upload, GlobalUpload},
+		download: []*RateLimiter{s.download, GlobalDownload},
+	}
+	if secure != nil {
+		limited = secure(limited)
+	}
+	s.reader = bufio.NewReader(limited)
+	s.writer = bufio.NewWriter(limited)
+}
 
-	return conn.RemoteAddr().String(), nil
+// openEvent moves to a new stream for an event going to the peer, when the
+// connection has streams.
+func (s *Session) openEvent() error {
+	if streams, ok := s.conn.(StreamConn); ok {
+		stream, err := streams.OpenStream()
+		if s.assertError(err, "unable to open stream") {
+			return err
+		}
+		s.nextStream(stream, true)
+	}
+	return nil
 }
 
-func StopListen() error {
-	if ln != nil {
-		err := ln.Close()
+// acceptEvent moves to the stream of the next event of the peer, when the
+// connection has streams.
+func (s *Session) acceptEvent() error {
+	if streams, ok := s.conn.(StreamConn); ok {
+		stream, err := streams.AcceptStream()
 		if err != nil {
 			return err
 		}
+		s.nextStream(stream, false)
 	}
 	return nil
 }
 
-func Connect(address string) (string, error) {
-	var err error
-	conn, err = net.Dial("tcp", address)
+// nextStream closes the stream of the previous event, it has been read
+// and written in full. After the hello every stream has keys of its own,
+// named by the side opening it and their count.
+func (s *Session) nextStream(stream net.Conn, opened bool) {
+	if s.stream != nil {
+		//noinspection GoUnhandledErrorResult
+		s.stream.Close()
+	}
+	s.stream = stream
+	if s.keys == nil {
+		s.use(stream, nil)
+	} else {
+		s.use(stream, s.keys.stream(opened))
+	}
+}
+
+// Listen listens on the address by the transport of its scheme, by TCP of
+// the network family without one.
+func Listen(network string, address string) (net.Listener, error) {
+	logger.Info("listening", "network", network, "address", address)
+	t, rest, err := resolveTransport(network, address)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	return t.Listen(rest)
+}
 
-	reader = bufio.NewReader(conn)
-	writer = bufio.NewWriter(conn)
+// Connect opens a session by the transport of the address scheme, by TCP
+// without one, and asks the peer for the pairing.
+func Connect(address string, pairing Pairing) (*Session, error) {
+	t, rest, err := resolveTransport(NetworkDualStack, address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := t.Dial(rest)
+	if err != nil {
+		return nil, err
+	}
+	s := NewSession(conn)
+	if err = s.Hello(pairing); err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetRateLimits limits the session in bytes per second, zero is unlimited.
+func (s *Session) SetRateLimits(upload int64, download int64) {
+	s.upload.SetRate(upload)
+	s.download.SetRate(download)
+}
 
-	return conn.RemoteAddr().String(), nil
+func (s *Session) SetReceivePolicy(policy ReceivePolicy) {
+	s.policy = policy
 }
 
-func ReadFile(path string, nl func(name string, size int64), pl func(p int)) (bool, error) {
-	t, err := reader.ReadByte()
-	if assertError(err, "unable to read type") {
+func (s *Session) RemoteAddr() string {
+	return s.conn.RemoteAddr().String()
+}
+
+// PeerKey is the fingerprint of the peer's identity.
+func (s *Session) PeerKey() string {
+	return s.peerKey
+}
+
+// ReadFile handles the next event of the peer. For a file nl is called once
+// it is accepted, pl with the progress and rl once it is stored.
+func (s *Session) ReadFile(path string, nl func(name string, size int64), pl func(p int), rl func(file ReceivedFile)) (bool, error) {
+	err := s.acceptEvent()
+	if s.assertError(err, "unable to accept event") {
+		return false, err
+	}
+	t, err := s.reader.ReadByte()
+	if s.assertError(err, "unable to read type") {
 		return false, err
 	}
-	log.Println("type:", t)
+	s.log.Debug("event", "type", t)
 	switch t {
-	case 1:
-		line, isPrefix, err := reader.ReadLine()
-		if assertError(err, "unable to read name") {
+	case typeManifest, typeDelete:
+		line, err := s.reader.ReadString('\n')
+		if s.assertError(err, "unable to read path") {
 			return false, err
 		}
-		log.Println(string(line), isPrefix)
-		var size int64
-		err = binary.Read(reader, binary.LittleEndian, &size)
-		if assertError(err, "unable to read size") {
-			return false, err
+		line = strings.TrimSuffix(line, "\n")
+		if t == typeDelete {
+			s.deleteSynced(path, line)
+			return true, nil
 		}
-
-		name := filepath.Base(string(line))
-		nl(name, size)
-		log.Println("create file:", filepath.Join(path, name))
-		file, err := os.Create(filepath.Join(path, name))
-		if assertError(err, "unable to create file") {
+		return true, s.sendManifest(path, line)
+	case typeFile, typeSyncFile:
+		started := time.Now()
+		size, err := s.receiveFile(t, path, nl, pl, rl)
+		s.countFile(metricFilesReceived, err, size, started)
+		if _, rejected := err.(*RejectedError); err != nil && !rejected {
 			return false, err
 		}
+		return true, err
+	default:
+		return false, nil
+	}
+}
 
-		buffer := make([]byte, BufferSize)
-		var total int64 = 0
-		p := 0
-		for {
-			if total+int64(len(buffer)) > size {
-				buffer = make([]byte, size-total)
-				log.Println("resize buffer to", size-total)
-			}
-			n, err := reader.Read(buffer)
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				assertError(err, "file read error")
-				return false, err
-			}
-			total += int64(n)
-			n, err = file.Write(buffer[:n])
-			if err != nil {
-				panic("file write error")
-			}
-			if int(100*total/size) != p {
-				p = int(100 * total / size)
-				pl(p)
-			}
-			if total == size {
-				break
+// receiveData writes the plain content of the file and returns the checksum
+// announced by the sender and the one of the received data.
+func (s *Session) receiveData(file *os.File, size int64, pl func(p int)) ([]byte, []byte, error) {
+	writer := &hashingWriter{Writer: file, hash: sha256.New()}
+	buffer := make([]byte, BufferSize)
+	var total int64 = 0
+	p := 0
+	for total < size {
+		if total+int64(len(buffer)) > size {
+			buffer = make([]byte, size-total)
+			s.log.Debug("resize buffer", "size", size-total)
+		}
+		n, err := s.reader.Read(buffer)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
 			}
+			s.assertError(err, "file read error")
+			return nil, nil, err
 		}
-		err = file.Close()
-		if assertError(err, "file close error") {
-			return false, err
+		total += int64(n)
+		_, err = writer.Write(buffer[:n])
+		if s.assertError(err, "file write error") {
+			return nil, nil, err
 		}
-		return true, nil
-	default:
-		return false, nil
+		if int(100*total/size) != p {
+			p = int(100 * total / size)
+			pl(p)
+		}
+	}
+	expected := make([]byte, sha256.Size)
+	_, err := io.ReadFull(s.reader, expected)
+	if s.assertError(err, "unable to read checksum") {
+		return nil, nil, err
 	}
+	return expected, writer.hash.Sum(nil), nil
 }
 
-func SendFile(name string, l func(p int)) error {
-	base := filepath.Base(name)
-	stat, err := os.Stat(name)
-	if assertError(err, "unable to get file info") {
-		return err
+// acceptFile checks the announced file against the policy and the free
+// disk space and creates it, the reason of a refusal goes to the sender.
+// If the sender can do it and a large enough copy exists already, the file
+// is created next to the copy to be patched from it.
+func (s *Session) acceptFile(target string, size int64, delta bool) (*os.File, *deltaPatch, error) {
+	if size < 0 {
+		return nil, nil, errors.New("invalid file size")
+	}
+	if s.policy.MaxFileSize > 0 && size > s.policy.MaxFileSize {
+		return nil, nil, fmt.Errorf("file is larger than the limit of %s", ByteCountBinary(s.policy.MaxFileSize))
+	}
+	if s.policy.Quota > 0 && s.received+size > s.policy.Quota {
+		return nil, nil, fmt.Errorf("session quota of %s is exceeded", ByteCountBinary(s.policy.Quota))
+	}
+	var existing int64
+	stat, err := os.Stat(target)
+	if err == nil && stat.Mode().IsRegular() {
+		existing = stat.Size()
+	}
+	delta = delta && s.policy.Delta && existing >= deltaMinSize && existing <= deltaMaxSize
+	free, err := freeSpace(filepath.Dir(target))
+	if err != nil {
+		s.log.Warn("unable to get free space", "error", err)
+	} else {
+		// Without delta the copy is truncated first, so its space is free
+		// too. With delta it stays until the new file is complete.
+		available := free + existing
+		if delta {
+			available = free
+		}
+		if size > available {
+			return nil, nil, fmt.Errorf("not enough disk space, %s free", ByteCountBinary(free))
+		}
+	}
+	var file *os.File
+	var patch *deltaPatch
+	if delta {
+		file, patch, err = newDeltaPatch(target, existing)
+		if err == nil {
+			s.log.Info("offer delta", "file", target, "blocks", len(patch.sig.Blocks))
+		} else {
+			s.log.Warn("unable to sign existing file", "file", target, "error", err)
+		}
+	}
+	if patch == nil {
+		s.log.Info("create file", "file", target, "size", size)
+		file, err = os.Create(target)
+		if s.assertError(err, "unable to create file") {
+			return nil, nil, errors.New("unable to create file")
+		}
+	}
+	if s.policy.Preallocate && size > 0 {
+		if err = preallocate(file, size); err == errNoSpace {
+			discardFile(file, patch)
+			return nil, nil, errors.New("not enough disk space")
+		}
+		s.assertError(err, "unable to preallocate file")
+	}
+	return file, patch, nil
+}
+
+// discardFile removes a file which isn't received completely, a copy being
+// patched stays as it was.
+func discardFile(file *os.File, patch *deltaPatch) {
+	if patch != nil {
+		patch.discard(file)
+		return
+	}
+	//noinspection GoUnhandledErrorResult
+	file.Close()
+	//noinspection GoUnhandledErrorResult
+	os.Remove(file.Name())
+}
+
+// receiveFile stores the file announced by the header and returns its size.
+func (s *Session) receiveFile(t byte, path string, nl func(name string, size int64), pl func(p int), rl func(file ReceivedFile)) (int64, error) {
+	var size int64
+	line, _, err := s.reader.ReadLine()
+	if s.assertError(err, "unable to read name") {
+		return size, err
+	}
+	err = binary.Read(s.reader, binary.LittleEndian, &size)
+	if s.assertError(err, "unable to read size") {
+		return size, err
+	}
+	meta, err := readMeta(s.reader)
+	if s.assertError(err, "unable to read metadata") {
+		return size, err
 	}
-	size := stat.Size()
-	err = writer.WriteByte(1)
-	if assertError(err, "event type sending failed") {
+	flags, err := s.reader.ReadByte()
+	if s.assertError(err, "unable to read header flags") {
+		return size, err
+	}
+
+	name := filepath.Base(string(line))
+	target := filepath.Join(path, name)
+	var refusal error
+	route := -1
+	if t == typeSyncFile {
+		name = string(line)
+		target, refusal = syncTarget(path, name)
+	} else if route = MatchRoute(s.policy.Routes, name, size, s.policy.Sender, s.policy.SenderKey); route >= 0 {
+		s.log.Info("route file", "file", name, "rule", s.policy.Routes[route].Name)
+		var dir string
+		dir, refusal = routeDirectory(s.policy.Routes[route])
+		target = filepath.Join(dir, name)
+	}
+	var file *os.File
+	var patch *deltaPatch
+	if refusal == nil {
+		file, patch, refusal = s.acceptFile(target, size, flags&headerDelta != 0)
+	}
+	if refusal != nil {
+		if err = s.sendReply(replyReject, refusal.Error()); err != nil {
+			return size, err
+		}
+		return size, &RejectedError{Name: name, Reason: refusal.Error()}
+	}
+	if patch != nil {
+		err = s.sendReply(replyDelta, "")
+		if err == nil {
+			err = s.sendSignature(patch.sig)
+		}
+		if err == nil {
+			err = s.writer.Flush()
+		}
+	} else {
+		err = s.sendReply(replyAccept, "")
+	}
+	if s.assertError(err, "reply sending failed") {
+		discardFile(file, patch)
+		return size, err
+	}
+	s.received += size
+	nl(name, size)
+
+	var expected, actual []byte
+	if patch != nil {
+		s.log.Info("patch file", "file", target)
+		expected, actual, err = s.receiveDelta(file, size, patch, pl)
+	} else {
+		expected, actual, err = s.receiveData(file, size, pl)
+	}
+	if err == nil && !bytes.Equal(expected, actual) {
+		err = errors.New("checksum mismatch")
+	}
+	if s.assertError(err, "file receiving error") {
+		discardFile(file, patch)
+		return size, err
+	}
+	if size == 0 {
+		pl(100)
+	}
+	if patch != nil {
+		err = patch.commit(file)
+	} else {
+		err = file.Close()
+	}
+	if s.assertError(err, "file close error") {
+		return size, err
+	}
+	applyMeta(target, meta, s.policy)
+	received := ReceivedFile{Path: target, Name: name, Size: size, Checksum: actual}
+	if route >= 0 {
+		received.Rule = s.policy.Routes[route].Name
+		runAction(s.policy.Routes[route], target)
+	}
+	rl(received)
+	return size, nil
+}
+
+func (s *Session) sendReply(reply byte, reason string) error {
+	err := s.writer.WriteByte(reply)
+	if s.assertError(err, "reply sending failed") {
 		return err
 	}
-	_, err = writer.WriteString(base + "\n")
-	if assertError(err, "file name sending failed") {
+	if reply == replyReject {
+		_, err = s.writer.WriteString(strings.ReplaceAll(reason, "\n", " ") + "\n")
+		if s.assertError(err, "reason sending failed") {
+			return err
+		}
+	}
+	err = s.writer.Flush()
+	if s.assertError(err, "reply flushing failed") {
 		return err
 	}
+	return nil
+}
 
-	buf := new(bytes.Buffer)
-	if err = binary.Write(buf, binary.LittleEndian, size); err != nil {
-		assertError(err, "file size preparing failed")
+// readReply waits for the receiver to accept the announced file, a
+// signature comes back when the receiver wants a delta of its copy.
+func (s *Session) readReply(base string) (*deltaSignature, error) {
+	reply, err := s.reader.ReadByte()
+	if s.assertError(err, "unable to read reply") {
+		return nil, err
+	}
+	switch reply {
+	case replyAccept:
+		return nil, nil
+	case replyDelta:
+		sig, err := s.readSignature()
+		if s.assertError(err, "unable to read signature") {
+			return nil, err
+		}
+		return sig, nil
+	case replyReject:
+		reason, err := s.reader.ReadString('\n')
+		if s.assertError(err, "unable to read reason") {
+			return nil, err
+		}
+		s.log.Warn("file rejected", "file", base, "reason", strings.TrimSuffix(reason, "\n"))
+		return nil, &RejectedError{Name: base, Reason: strings.TrimSuffix(reason, "\n")}
+	default:
+		return nil, fmt.Errorf("unexpected reply %d", reply)
+	}
+}
+
+func (s *Session) SendFile(name string, l func(p int)) error {
+	return s.sendFile(typeFile, name, filepath.Base(name), l)
+}
+
+// sendFile sends the local file under the remote name.
+func (s *Session) sendFile(t byte, name string, remote string, l func(p int)) (err error) {
+	started := time.Now()
+	var size int64
+	defer func() {
+		s.countFile(metricFilesSent, err, size, started)
+	}()
+	stat, err := os.Stat(name)
+	if s.assertError(err, "unable to get file info") {
 		return err
 	}
-	_, err = buf.WriteTo(writer)
-	if assertError(err, "file size sending failed") {
+	size = stat.Size()
+	err = s.sendHeader(t, remote, size, statMeta(name, stat), headerDelta)
+	if err != nil {
 		return err
 	}
-
-	err = writer.Flush()
-	if assertError(err, "header flushing failed") {
+	sig, err := s.readReply(remote)
+	if err != nil {
 		return err
 	}
 
 	file, err := os.Open(name)
-	if assertError(err, "unable to open file") {
+	if s.assertError(err, "unable to open file") {
 		return err
 	}
+	//noinspection GoUnhandledErrorResult
+	defer file.Close()
+	if sig != nil {
+		s.log.Info("send delta", "file", name)
+		return s.sendDelta(file, size, sig, l)
+	}
+	whole := sha256.New()
 	buffer := make([]byte, BufferSize)
 	var total int64 = 0
 	p := 0
@@ -174,16 +567,13 @@ func SendFile(name string, l func(p int)) error {
 			if err == io.EOF {
 				break
 			}
-			assertError(err, "local file read error")
+			s.assertError(err, "local file read error")
 			return err
 		}
 		total += int64(n)
-		n, err = writer.Write(buffer[:n])
-		if assertError(err, "file write to socket error") {
-			return err
-		}
-		err = writer.Flush()
-		if assertError(err, "file data flushing error") {
+		whole.Write(buffer[:n])
+		err = s.sendChunk(buffer[:n])
+		if err != nil {
 			return err
 		}
 		if int(100*total/size) != p {
@@ -191,42 +581,129 @@ func SendFile(name string, l func(p int)) error {
 			l(p)
 		}
 	}
-	err = writer.Flush()
-	if assertError(err, "data flushing error") {
+	if total != size {
+		return errors.New("file changed while sending")
+	}
+	err = s.sendChunk(whole.Sum(nil))
+	if err != nil {
+		return err
+	}
+	err = s.writer.Flush()
+	if s.assertError(err, "data flushing error") {
 		return err
 	}
 	err = file.Close()
-	if assertError(err, "file closing error") {
+	if s.assertError(err, "file closing error") {
 		return err
 	}
 	return nil
 }
 
-func SendDone() error {
-	err := writer.WriteByte(2)
-	if assertError(err, "done sending failed") {
+func (s *Session) sendHeader(t byte, base string, size int64, meta FileMeta, flags byte) error {
+	if err := s.openEvent(); err != nil {
+		return err
+	}
+	err := s.writer.WriteByte(t)
+	if s.assertError(err, "event type sending failed") {
+		return err
+	}
+	_, err = s.writer.WriteString(base + "\n")
+	if s.assertError(err, "file name sending failed") {
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+	if err = binary.Write(buf, binary.LittleEndian, size); err != nil {
+		s.assertError(err, "file size preparing failed")
 		return err
 	}
-	err = writer.Flush()
-	if assertError(err, "done flushing failed") {
+	_, err = buf.WriteTo(s.writer)
+	if s.assertError(err, "file size sending failed") {
+		return err
+	}
+	err = writeMeta(s.writer, meta)
+	if s.assertError(err, "file metadata sending failed") {
+		return err
+	}
+	err = s.writer.WriteByte(flags)
+	if s.assertError(err, "header flags sending failed") {
+		return err
+	}
+
+	err = s.writer.Flush()
+	if s.assertError(err, "header flushing failed") {
 		return err
 	}
 	return nil
 }
 
-func Disconnect() error {
-	if conn != nil {
-		err := conn.Close()
-		if err != nil {
-			return err
-		}
+func (s *Session) sendChunk(chunk []byte) error {
+	_, err := s.writer.Write(chunk)
+	if s.assertError(err, "file write to socket error") {
+		return err
+	}
+	err = s.writer.Flush()
+	if s.assertError(err, "file data flushing error") {
+		return err
+	}
+	return nil
+}
+
+func (s *Session) SendDone() error {
+	if err := s.openEvent(); err != nil {
+		return err
+	}
+	err := s.writer.WriteByte(typeDone)
+	if s.assertError(err, "done sending failed") {
+		return err
+	}
+	err = s.writer.Flush()
+	if s.assertError(err, "done flushing failed") {
+		return err
 	}
 	return nil
 }
 
+// Close disconnects the peer, the session is counted as finished once.
+func (s *Session) Close() error {
+	s.closeOnce.Do(func() {
+		result := resultCompleted
+		if atomic.LoadInt32(&s.failed) != 0 {
+			result = resultFailed
+		}
+		metricSessions[result].Add(1)
+		metricSessionDuration.Observe(time.Since(s.started).Seconds())
+		metricActiveSessions.Add(-1)
+	})
+	return s.conn.Close()
+}
+
+// countFile counts the transferred file, a failure other than a refusal
+// marks the session as failed.
+func (s *Session) countFile(m fileMetrics, err error, size int64, started time.Time) {
+	switch err.(type) {
+	case nil:
+		m.done(resultCompleted, size, started)
+	case *RejectedError:
+		m.done(resultRejected, size, started)
+	default:
+		m.done(resultFailed, size, started)
+		atomic.StoreInt32(&s.failed, 1)
+	}
+}
+
+// assertError logs the error with the fields of the session.
+func (s *Session) assertError(err error, message string) bool {
+	if err != nil {
+		s.log.Error(message, "error", err)
+		return true
+	}
+	return false
+}
+
 func assertError(err error, message string) bool {
 	if err != nil {
-		log.Fatalln(message, err)
+		logger.Error(message, "error", err)
 		return true
 	}
 	return false
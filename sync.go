@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxManifestEntries bounds the manifest a peer may announce.
+const maxManifestEntries = 1 << 20
+
+// Flags of a manifest reply.
+const manifestAllowDelete byte = 1
+
+// ManifestEntry describes a file of a synced folder, the path is slash
+// separated and relative to the folder.
+type ManifestEntry struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	Hash    [sha256.Size]byte
+}
+
+// Manifest is the content of the peer's copy of a folder.
+type Manifest struct {
+	AllowDelete bool
+	Entries     []ManifestEntry
+}
+
+// SyncPlan lists the changes making the peer's copy match the folder.
+type SyncPlan struct {
+	Folder string
+	Send   []ManifestEntry
+	Delete []string
+	// AllowDelete tells if the peer accepts deletions.
+	AllowDelete bool
+}
+
+// BuildManifest hashes every regular file below root, a missing root
+// gives an empty manifest.
+func BuildManifest(root string) ([]ManifestEntry, error) {
+	var entries []ManifestEntry
+	err := walkFolder(root, func(name string, rel string, info os.FileInfo) error {
+		hash, err := hashFile(name)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, ManifestEntry{
+			Path:    rel,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			Hash:    hash,
+		})
+		return nil
+	})
+	return entries, err
+}
+
+// walkFolder calls f for every regular file below root with its path
+// relative to root in the slash form, a missing root has no files.
+func walkFolder(root string, f func(name string, rel string, info os.FileInfo) error) error {
+	return filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && name == root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if strings.Contains(rel, "\n") {
+			logger.Warn("skip file with a line break in the name", "file", rel)
+			return nil
+		}
+		return f(name, rel, info)
+	})
+}
+
+func hashFile(name string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	file, err := os.Open(name)
+	if err != nil {
+		return sum, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer file.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return sum, err
+	}
+	copy(sum[:], hash.Sum(nil))
+	return sum, nil
+}
+
+// PlanSync compares the local folder with the peer's copy. New files and
+// files with a different content are sent, files missing locally are
+// candidates for deletion.
+func PlanSync(folder string, local []ManifestEntry, remote Manifest) SyncPlan {
+	plan := SyncPlan{Folder: folder, AllowDelete: remote.AllowDelete}
+	theirs := make(map[string]ManifestEntry, len(remote.Entries))
+	for _, e := range remote.Entries {
+		theirs[e.Path] = e
+	}
+	for _, e := range local {
+		other, ok := theirs[e.Path]
+		delete(theirs, e.Path)
+		if ok && other.Size == e.Size && other.Hash == e.Hash {
+			continue
+		}
+		plan.Send = append(plan.Send, e)
+	}
+	for p := range theirs {
+		plan.Delete = append(plan.Delete, p)
+	}
+	sort.Strings(plan.Delete)
+	return plan
+}
+
+// syncPath resolves a path sent by the peer inside the incoming directory.
+func syncPath(root string, rel string) (string, error) {
+	clean := path.Clean(rel)
+	if rel == "" || path.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", errors.New("invalid path")
+	}
+	return filepath.Join(root, filepath.FromSlash(clean)), nil
+}
+
+// syncTarget resolves the path of a received file and creates its parent
+// directories.
+func syncTarget(root string, rel string) (string, error) {
+	target, err := syncPath(root, rel)
+	if err != nil {
+		return "", err
+	}
+	if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", errors.New("unable to create directory")
+	}
+	return target, nil
+}
+
+// RequestManifest asks the peer for the content of its copy of the folder.
+func (s *Session) RequestManifest(folder string) (Manifest, error) {
+	var manifest Manifest
+	if err := s.openEvent(); err != nil {
+		return manifest, err
+	}
+	err := s.writer.WriteByte(typeManifest)
+	if s.assertError(err, "event type sending failed") {
+		return manifest, err
+	}
+	_, err = s.writer.WriteString(folder + "\n")
+	if s.assertError(err, "folder name sending failed") {
+		return manifest, err
+	}
+	err = s.writer.Flush()
+	if s.assertError(err, "manifest request flushing failed") {
+		return manifest, err
+	}
+
+	flags, err := s.reader.ReadByte()
+	if s.assertError(err, "unable to read manifest") {
+		return manifest, err
+	}
+	manifest.AllowDelete = flags&manifestAllowDelete != 0
+	var count uint32
+	err = binary.Read(s.reader, binary.LittleEndian, &count)
+	if s.assertError(err, "unable to read manifest") {
+		return manifest, err
+	}
+	if count > maxManifestEntries {
+		return manifest, errors.New("manifest is too large")
+	}
+	for i := uint32(0); i < count; i++ {
+		var e ManifestEntry
+		line, err := s.reader.ReadString('\n')
+		if s.assertError(err, "unable to read manifest entry") {
+			return manifest, err
+		}
+		e.Path = strings.TrimSuffix(line, "\n")
+		var mtime int64
+		for _, field := range []interface{}{&e.Size, &mtime, &e.Hash} {
+			err = binary.Read(s.reader, binary.LittleEndian, field)
+			if s.assertError(err, "unable to read manifest entry") {
+				return manifest, err
+			}
+		}
+		e.ModTime = time.Unix(0, mtime)
+		manifest.Entries = append(manifest.Entries, e)
+	}
+	return manifest, nil
+}
+
+// sendManifest answers a manifest request with the content of the folder
+// below the incoming directory.
+func (s *Session) sendManifest(root string, folder string) error {
+	var entries []ManifestEntry
+	dir, err := syncPath(root, path.Base(folder))
+	if err == nil {
+		entries, err = BuildManifest(dir)
+	}
+	if err != nil {
+		// An unreadable folder looks empty, the peer sends everything.
+		s.log.Warn("unable to build manifest", "folder", folder, "error", err)
+		entries = nil
+	}
+	var flags byte
+	if s.policy.AllowDelete {
+		flags |= manifestAllowDelete
+	}
+	err = s.writer.WriteByte(flags)
+	if s.assertError(err, "manifest sending failed") {
+		return err
+	}
+	err = binary.Write(s.writer, binary.LittleEndian, uint32(len(entries)))
+	if s.assertError(err, "manifest sending failed") {
+		return err
+	}
+	for _, e := range entries {
+		_, err = s.writer.WriteString(e.Path + "\n")
+		if s.assertError(err, "manifest sending failed") {
+			return err
+		}
+		for _, field := range []interface{}{e.Size, e.ModTime.UnixNano(), e.Hash} {
+			err = binary.Write(s.writer, binary.LittleEndian, field)
+			if s.assertError(err, "manifest sending failed") {
+				return err
+			}
+		}
+	}
+	err = s.writer.Flush()
+	if s.assertError(err, "manifest flushing failed") {
+		return err
+	}
+	return nil
+}
+
+// SendSyncFile sends the file to the path below the peer's incoming directory.
+func (s *Session) SendSyncFile(name string, rel string, l func(p int)) error {
+	return s.sendFile(typeSyncFile, name, rel, l)
+}
+
+// SendDelete asks the peer to remove the synced file, peers which don't
+// allow deletions ignore it.
+func (s *Session) SendDelete(rel string) error {
+	if err := s.openEvent(); err != nil {
+		return err
+	}
+	err := s.writer.WriteByte(typeDelete)
+	if s.assertError(err, "event type sending failed") {
+		return err
+	}
+	_, err = s.writer.WriteString(rel + "\n")
+	if s.assertError(err, "path sending failed") {
+		return err
+	}
+	err = s.writer.Flush()
+	if s.assertError(err, "delete flushing failed") {
+		return err
+	}
+	return nil
+}
+
+func (s *Session) deleteSynced(root string, rel string) {
+	if !s.policy.AllowDelete {
+		s.log.Warn("deletion is not allowed, keep file", "file", rel)
+		return
+	}
+	target, err := syncPath(root, rel)
+	if err != nil {
+		s.log.Warn("unable to delete file", "file", rel, "error", err)
+		return
+	}
+	s.log.Info("delete file", "file", target)
+	s.assertError(os.Remove(target), "unable to delete file")
+}
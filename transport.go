@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Transport carries sessions. The scheme of an address picks it, like
+// tcp://192.168.1.5:3214, unix:///run/user/1000/siphon.sock or mem://test,
+// addresses without a scheme go over TCP. Transports built with tags, like
+// quic://, register themselves.
+type Transport interface {
+	// Listen and Dial get the address without the scheme.
+	Listen(address string) (net.Listener, error)
+	Dial(address string) (net.Conn, error)
+	// HostPort tells if addresses are host:port pairs, a path or a name
+	// otherwise.
+	HostPort() bool
+}
+
+const transportSeparator = "://"
+
+var transportsMu sync.Mutex
+var transports = map[string]Transport{
+	NetworkDualStack: tcpTransport(NetworkDualStack),
+	NetworkIPv4:      tcpTransport(NetworkIPv4),
+	NetworkIPv6:      tcpTransport(NetworkIPv6),
+	"unix":           unixTransport{},
+	"mem":            memTransport{},
+}
+
+// RegisterTransport makes the transport available for the scheme.
+func RegisterTransport(scheme string, t Transport) {
+	transportsMu.Lock()
+	transports[scheme] = t
+	transportsMu.Unlock()
+}
+
+func findTransport(scheme string) (Transport, error) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	t, ok := transports[scheme]
+	if !ok {
+		return nil, fmt.Errorf("unknown transport %q", scheme)
+	}
+	return t, nil
+}
+
+// splitScheme returns the scheme of the address and the rest of it,
+// the scheme is empty for a bare host:port.
+func splitScheme(address string) (string, string) {
+	i := strings.Index(address, transportSeparator)
+	if i <= 0 {
+		return "", address
+	}
+	return strings.ToLower(address[:i]), address[i+len(transportSeparator):]
+}
+
+// resolveTransport returns the transport of the address and the address
+// without the scheme. Without one the network picks the transport.
+func resolveTransport(network string, address string) (Transport, string, error) {
+	scheme, rest := splitScheme(address)
+	if scheme == "" {
+		scheme = network
+	}
+	t, err := findTransport(scheme)
+	if err != nil {
+		return nil, "", err
+	}
+	if rest == "" {
+		return nil, "", errors.New("address is empty")
+	}
+	return t, rest, nil
+}
+
+func validateTransportAddress(address string) error {
+	_, _, err := resolveTransport(NetworkDualStack, address)
+	return err
+}
+
+// HasTransport tells if the host typed in the connect popover or saved in
+// a profile is a transport address rather than a plain host.
+func HasTransport(host string) bool {
+	scheme, _ := splitScheme(host)
+	return scheme != ""
+}
+
+// JoinAddress makes the address to connect to of a host, which may start
+// with a transport scheme, and a port. The port is added for transports
+// taking host:port pairs only and when the host doesn't have one.
+func JoinAddress(host string, port string) string {
+	scheme, rest := splitScheme(host)
+	if scheme == "" {
+		return net.JoinHostPort(host, port)
+	}
+	t, err := findTransport(scheme)
+	if err != nil || !t.HostPort() {
+		return host
+	}
+	if _, _, err := net.SplitHostPort(rest); err == nil {
+		return host
+	}
+	return scheme + transportSeparator + net.JoinHostPort(strings.Trim(rest, "[]"), port)
+}
+
+// NeedsPort tells if JoinAddress adds the port to the host.
+func NeedsPort(host string) bool {
+	return JoinAddress(host, "") != host
+}
+
+// tcpTransport is TCP of the address family, one of the Network constants.
+type tcpTransport string
+
+func (t tcpTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen(string(t), address)
+}
+
+func (t tcpTransport) Dial(address string) (net.Conn, error) {
+	return net.Dial(string(t), address)
+}
+
+func (t tcpTransport) HostPort() bool {
+	return true
+}
+
+// unixTransport goes over a Unix domain socket, for peers on the same
+// machine or sandboxes sharing a directory.
+type unixTransport struct{}
+
+// Listen replaces a socket left behind by a crashed instance.
+func (unixTransport) Listen(path string) (net.Listener, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		//noinspection GoUnhandledErrorResult
+		conn.Close()
+		return nil, errors.New("socket is in use")
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return unixListener{ln}, nil
+}
+
+func (unixTransport) Dial(path string) (net.Conn, error) {
+	return net.Dial("unix", path)
+}
+
+func (unixTransport) HostPort() bool {
+	return false
+}
+
+// unixListener names accepted peers by the socket, they have no address
+// of their own.
+type unixListener struct {
+	net.Listener
+}
+
+func (l unixListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return unixConn{conn}, nil
+}
+
+type unixConn struct {
+	net.Conn
+}
+
+func (c unixConn) RemoteAddr() net.Addr {
+	// Unnamed sockets show up as "@" on Linux.
+	if addr := c.Conn.RemoteAddr(); addr != nil && addr.String() != "" && addr.String() != "@" {
+		return addr
+	}
+	return c.LocalAddr()
+}
+
+// memTransport connects listeners and peers of the same process by name
+// through in-memory pipes, it lets sessions run without a network.
+type memTransport struct{}
+
+var memMu sync.Mutex
+var memListeners = make(map[string]*memListener)
+
+func (memTransport) Listen(name string) (net.Listener, error) {
+	memMu.Lock()
+	defer memMu.Unlock()
+	if _, ok := memListeners[name]; ok {
+		return nil, fmt.Errorf("%s is in use", name)
+	}
+	l := &memListener{name: name, conns: make(chan net.Conn), closed: make(chan struct{})}
+	memListeners[name] = l
+	return l, nil
+}
+
+func (memTransport) Dial(name string) (net.Conn, error) {
+	memMu.Lock()
+	l, ok := memListeners[name]
+	memMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("nothing listens on %s", name)
+	}
+	local, remote := net.Pipe()
+	select {
+	case l.conns <- memConn{remote, memAddr(name)}:
+		return memConn{local, memAddr(name)}, nil
+	case <-l.closed:
+		//noinspection GoUnhandledErrorResult
+		local.Close()
+		//noinspection GoUnhandledErrorResult
+		remote.Close()
+		return nil, fmt.Errorf("nothing listens on %s", name)
+	}
+}
+
+func (memTransport) HostPort() bool {
+	return false
+}
+
+type memListener struct {
+	name   string
+	conns  chan net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() {
+		memMu.Lock()
+		delete(memListeners, l.name)
+		memMu.Unlock()
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return memAddr(l.name)
+}
+
+type memAddr string
+
+func (a memAddr) Network() string {
+	return "mem"
+}
+
+func (a memAddr) String() string {
+	return "mem://" + string(a)
+}
+
+// memConn is a pipe end named after the listener.
+type memConn struct {
+	net.Conn
+	addr memAddr
+}
+
+func (c memConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c memConn) RemoteAddr() net.Addr {
+	return c.addr
+}
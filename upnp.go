@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	ssdpAddress     = "239.255.255.250:1900"
+	ssdpSearchTime  = 2 * time.Second
+	upnpGatewayType = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	upnpTimeout     = 5 * time.Second
+
+	// upnpOnlyPermanentLeases is returned by gateways which can't expire mappings.
+	upnpOnlyPermanentLeases = 725
+)
+
+var upnpClient = &http.Client{Timeout: upnpTimeout}
+
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+type upnpMapper struct {
+	controlURL  string
+	serviceType string
+	client      net.IP
+}
+
+// upnpError is a SOAP fault reported by the gateway.
+type upnpError struct {
+	Code        int
+	Description string
+}
+
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("UPnP error %d %s", e.Code, e.Description)
+}
+
+// discoverUPnP finds an internet gateway device with SSDP at the address
+// and picks its WAN connection service.
+func discoverUPnP(address string) (*upnpMapper, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer conn.Close()
+	target, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return nil, err
+	}
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddress + "\r\n" +
+		"ST: " + upnpGatewayType + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n"
+	if _, err = conn.WriteTo([]byte(search), target); err != nil {
+		return nil, err
+	}
+	if err = conn.SetReadDeadline(time.Now().Add(ssdpSearchTime)); err != nil {
+		return nil, err
+	}
+	buffer := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return nil, errors.New("no gateway found")
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buffer[:n])), nil)
+		if err != nil {
+			continue
+		}
+		location := resp.Header.Get("Location")
+		if location == "" {
+			continue
+		}
+		if mapper, err := newUPnPMapper(location); err == nil {
+			return mapper, nil
+		}
+	}
+}
+
+func newUPnPMapper(location string) (*upnpMapper, error) {
+	resp, err := upnpClient.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+	var root struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err = xml.NewDecoder(resp.Body).Decode(&root); err != nil {
+		return nil, err
+	}
+	service := findWANService(root.Device)
+	if service == nil {
+		return nil, errors.New("no WAN connection service")
+	}
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if root.URLBase != "" {
+		if base, err = url.Parse(root.URLBase); err != nil {
+			return nil, err
+		}
+	}
+	control, err := base.Parse(service.ControlURL)
+	if err != nil {
+		return nil, err
+	}
+	client, err := localAddressTo(control.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	return &upnpMapper{
+		controlURL:  control.String(),
+		serviceType: service.ServiceType,
+		client:      client,
+	}, nil
+}
+
+func findWANService(device upnpDevice) *upnpService {
+	for i, service := range device.Services {
+		if strings.Contains(service.ServiceType, ":WANIPConnection:") ||
+			strings.Contains(service.ServiceType, ":WANPPPConnection:") {
+			return &device.Services[i]
+		}
+	}
+	for _, child := range device.Devices {
+		if service := findWANService(child); service != nil {
+			return service
+		}
+	}
+	return nil
+}
+
+func (m *upnpMapper) Name() string {
+	return "UPnP IGD"
+}
+
+func (m *upnpMapper) Add(internal int, external int, lifetime time.Duration) (net.IP, int, time.Duration, error) {
+	response, err := m.soap("GetExternalIPAddress", nil)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	ip := net.ParseIP(xmlValue(response, "NewExternalIPAddress"))
+	if ip == nil {
+		return nil, 0, 0, errors.New("gateway has no external address")
+	}
+
+	add := func(lease time.Duration) error {
+		_, err := m.soap("AddPortMapping", [][2]string{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", fmt.Sprint(external)},
+			{"NewProtocol", "TCP"},
+			{"NewInternalPort", fmt.Sprint(internal)},
+			{"NewInternalClient", m.client.String()},
+			{"NewEnabled", "1"},
+			{"NewPortMappingDescription", "Siphon"},
+			{"NewLeaseDuration", fmt.Sprint(int(lease / time.Second))},
+		})
+		return err
+	}
+	err = add(lifetime)
+	if soapErr, ok := err.(*upnpError); ok && soapErr.Code == upnpOnlyPermanentLeases {
+		lifetime = 0
+		err = add(lifetime)
+	}
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return ip, external, lifetime, nil
+}
+
+func (m *upnpMapper) Remove(internal int, external int) error {
+	_, err := m.soap("DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", fmt.Sprint(external)},
+		{"NewProtocol", "TCP"},
+	})
+	return err
+}
+
+// soap invokes the action of the WAN connection service.
+func (m *upnpMapper) soap(action string, args [][2]string) ([]byte, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+		`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	body.WriteString(`<u:` + action + ` xmlns:u="` + m.serviceType + `">`)
+	for _, arg := range args {
+		body.WriteString("<" + arg[0] + ">")
+		_ = xml.EscapeText(&body, []byte(arg[1]))
+		body.WriteString("</" + arg[0] + ">")
+	}
+	body.WriteString(`</u:` + action + `></s:Body></s:Envelope>`)
+
+	req, err := http.NewRequest(http.MethodPost, m.controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+m.serviceType+"#"+action+`"`)
+	resp, err := upnpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+	response, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		code := 0
+		_, _ = fmt.Sscan(xmlValue(response, "errorCode"), &code)
+		if code != 0 {
+			return nil, &upnpError{Code: code, Description: xmlValue(response, "errorDescription")}
+		}
+		return nil, fmt.Errorf("UPnP %s failed: %s", action, resp.Status)
+	}
+	return response, nil
+}
+
+// xmlValue returns the text of the first element with the local name.
+func xmlValue(document []byte, name string) string {
+	decoder := xml.NewDecoder(bytes.NewReader(document))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return ""
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == name {
+			var value string
+			if decoder.DecodeElement(&value, &start) == nil {
+				return strings.TrimSpace(value)
+			}
+			return ""
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+)
+
+const uriScheme = "siphon"
+
+// ConnectionURI carries everything needed to reach a peer, either directly
+// (siphon://host:port) or on a relay (siphon://?relay=host:port&code=...).
+// The pairing secret of a listener and the key fingerprint of the peer go
+// along, like siphon://host:port?secret=...&key=....
+type ConnectionURI struct {
+	Host   string
+	Port   string
+	Relay  string
+	Code   string
+	Secret string
+	Key    string
+}
+
+func (c ConnectionURI) String() string {
+	u := url.URL{Scheme: uriScheme}
+	if c.Host != "" {
+		u.Host = net.JoinHostPort(c.Host, c.Port)
+	}
+	query := url.Values{}
+	if c.Relay != "" {
+		query.Set("relay", c.Relay)
+	}
+	if c.Code != "" {
+		query.Set("code", c.Code)
+	}
+	if c.Secret != "" {
+		query.Set("secret", c.Secret)
+	}
+	if c.Key != "" {
+		query.Set("key", c.Key)
+	}
+	u.RawQuery = query.Encode()
+	// The relay only form has no authority, keep the "//" for recognizability.
+	if u.Host == "" {
+		return uriScheme + "://?" + u.RawQuery
+	}
+	return u.String()
+}
+
+// IsConnectionURI tells if the text looks like a siphon:// link.
+func IsConnectionURI(text string) bool {
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(text)), uriScheme+":")
+}
+
+func ParseConnectionURI(text string) (ConnectionURI, error) {
+	var c ConnectionURI
+	u, err := url.Parse(strings.TrimSpace(text))
+	if err != nil {
+		return c, err
+	}
+	if u.Scheme != uriScheme {
+		return c, errors.New("not a " + uriScheme + ":// link")
+	}
+	if u.Host != "" {
+		c.Host = u.Hostname()
+		c.Port = u.Port()
+		if c.Port == "" {
+			c.Port = defaultPort
+		}
+		if err := validatePort(c.Port); err != nil {
+			return c, err
+		}
+	}
+	query := u.Query()
+	c.Relay = query.Get("relay")
+	c.Code = query.Get("code")
+	c.Secret = query.Get("secret")
+	if key := query.Get("key"); key != "" {
+		if c.Key, err = normalizeFingerprint(key); err != nil {
+			return c, err
+		}
+	}
+	if c.Relay != "" {
+		if err := validateRelay(c.Relay); err != nil {
+			return c, err
+		}
+		if _, err := normalizeRelayCode(c.Code); err != nil {
+			return c, err
+		}
+	}
+	if c.Host == "" && c.Relay == "" {
+		return c, errors.New("link has neither host nor relay")
+	}
+	return c, nil
+}
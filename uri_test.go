@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestConnectionURIRoundTrip(t *testing.T) {
+	key := "0123:4567:89ab:cdef:0123:4567:89ab:cdef"
+	uris := []ConnectionURI{
+		{Host: "192.168.1.5", Port: "3214"},
+		{Host: "::1", Port: "3214", Secret: "s3 cr&t", Key: key},
+		{Relay: "relay.example.com:3215", Code: "abcd-efgh-ijkl-mnop", Key: key},
+	}
+	for _, uri := range uris {
+		parsed, err := ParseConnectionURI(uri.String())
+		if err != nil {
+			t.Errorf("%s: %v", uri, err)
+			continue
+		}
+		if parsed != uri {
+			t.Errorf("%s parsed as %+v", uri, parsed)
+		}
+	}
+}
+
+func TestParseConnectionURI(t *testing.T) {
+	uri, err := ParseConnectionURI("siphon://example.com?key=0123456789ABCDEF0123456789ABCDEF")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri.Port != defaultPort || uri.Key != "0123:4567:89ab:cdef:0123:4567:89ab:cdef" {
+		t.Errorf("parsed as %+v", uri)
+	}
+	for _, link := range []string{
+		"http://example.com",
+		"siphon://",
+		"siphon://example.com:99999",
+		"siphon://example.com?key=0123",
+		"siphon://?relay=relay.example.com:3215&code=x",
+	} {
+		if _, err := ParseConnectionURI(link); err == nil {
+			t.Errorf("%s was parsed", link)
+		}
+	}
+}
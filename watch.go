@@ -0,0 +1,166 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sentDirName   = "sent"
+	failedDirName = "failed"
+
+	watchRetryMin = 5 * time.Second
+	watchRetryMax = 10 * time.Minute
+)
+
+// Watcher sends the files written to the outbox directory and moves them
+// to its "sent" subdirectory, failed sends are retried with a growing delay.
+// Files the peer refuses go to the "failed" subdirectory.
+type Watcher struct {
+	dir    string
+	send   func(names []string) []error
+	events <-chan string
+	closer func() error
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+type pendingFile struct {
+	due   time.Time
+	delay time.Duration
+}
+
+// NewWatcher watches the directory and passes the complete files to send,
+// which returns the outcome for every file.
+func NewWatcher(dir string, send func(names []string) []error) (*Watcher, error) {
+	for _, sub := range []string{sentDirName, failedDirName} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	events, closer, err := watchDirectory(dir)
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		dir:    dir,
+		send:   send,
+		events: events,
+		closer: closer,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *Watcher) run() {
+	defer close(w.done)
+	pending := make(map[string]*pendingFile)
+	add := func(name string) {
+		if _, ok := pending[name]; !ok && isOutboxFile(name) {
+			logger.Info("outbox file", "file", name)
+			pending[name] = &pendingFile{due: time.Now()}
+		}
+	}
+	// Files dropped while not watching go out first.
+	if infos, err := ioutil.ReadDir(w.dir); err == nil {
+		for _, info := range infos {
+			if info.Mode().IsRegular() {
+				add(filepath.Join(w.dir, info.Name()))
+			}
+		}
+	}
+
+	for {
+		var due []string
+		next := time.Time{}
+		now := time.Now()
+		for name, p := range pending {
+			if !p.due.After(now) {
+				due = append(due, name)
+			} else if next.IsZero() || p.due.Before(next) {
+				next = p.due
+			}
+		}
+		if len(due) > 0 {
+			sort.Strings(due)
+			errs := w.send(due)
+			for i, name := range due {
+				if errs[i] == nil {
+					delete(pending, name)
+					assertError(moveInto(name, sentDirName), "unable to move sent file")
+					continue
+				}
+				// Another try would be refused just the same.
+				if rejected, ok := errs[i].(*RejectedError); ok {
+					delete(pending, name)
+					logger.Warn("outbox file rejected", "file", name, "reason", rejected.Reason)
+					assertError(moveInto(name, failedDirName), "unable to move rejected file")
+					continue
+				}
+				if _, err := os.Stat(name); os.IsNotExist(err) {
+					delete(pending, name)
+					continue
+				}
+				p := pending[name]
+				p.delay *= 2
+				if p.delay < watchRetryMin {
+					p.delay = watchRetryMin
+				} else if p.delay > watchRetryMax {
+					p.delay = watchRetryMax
+				}
+				p.due = time.Now().Add(p.delay)
+				logger.Warn("outbox send failed", "file", name, "retry", p.delay, "error", errs[i])
+			}
+			continue
+		}
+
+		var timer <-chan time.Time
+		if !next.IsZero() {
+			timer = time.After(time.Until(next))
+		}
+		select {
+		case <-w.stop:
+			return
+		case name, ok := <-w.events:
+			if !ok {
+				return
+			}
+			add(name)
+		case <-timer:
+		}
+	}
+}
+
+// isOutboxFile skips hidden files, which are usually still being written.
+func isOutboxFile(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && info.Mode().IsRegular() && !strings.HasPrefix(filepath.Base(name), ".")
+}
+
+// moveInto moves the file into the subdirectory of the outbox without
+// overwriting an earlier file of the same name.
+func moveInto(name string, sub string) error {
+	dir := filepath.Join(filepath.Dir(name), sub)
+	base := filepath.Base(name)
+	ext := filepath.Ext(base)
+	target := filepath.Join(dir, base)
+	for i := 1; fileExists(target); i++ {
+		target = filepath.Join(dir, strings.TrimSuffix(base, ext)+" ("+strconv.Itoa(i)+")"+ext)
+	}
+	return os.Rename(name, target)
+}
+
+// Close stops watching, a send in progress is finished first.
+func (w *Watcher) Close() error {
+	close(w.stop)
+	err := w.closer()
+	<-w.done
+	return err
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// watchDirectory reports the files closed after writing or moved into
+// the directory, using inotify.
+func watchDirectory(dir string) (<-chan string, func() error, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err = syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO); err != nil {
+		_ = syscall.Close(fd)
+		return nil, nil, err
+	}
+	// A non-blocking descriptor goes to the runtime poller, so closing
+	// the file ends a pending read.
+	file := os.NewFile(uintptr(fd), "inotify")
+	events := make(chan string, 64)
+	quit := make(chan struct{})
+	go func() {
+		defer close(events)
+		buffer := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := file.Read(buffer)
+			if err != nil {
+				return
+			}
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+				nameStart := offset + syscall.SizeofInotifyEvent
+				offset = nameStart + int(event.Len)
+				if event.Len == 0 || offset > n {
+					continue
+				}
+				name := string(bytes.TrimRight(buffer[nameStart:offset], "\x00"))
+				select {
+				case events <- filepath.Join(dir, name):
+				case <-quit:
+					return
+				}
+			}
+		}
+	}()
+	closer := func() error {
+		close(quit)
+		return file.Close()
+	}
+	return events, closer, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+func watchDirectory(dir string) (<-chan string, func() error, error) {
+	return nil, nil, errors.New("watching folders is not supported on this platform")
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultWebPort = "3216"
+	webCookieName  = "siphon"
+	// webLoginDelay slows down guessing the code.
+	webLoginDelay = time.Second
+	// maxUniqueNames bounds the numbered names tried for an upload.
+	maxUniqueNames = 1000
+)
+
+// WebReceiver serves a page letting browsers of peers without Siphon upload
+// files into the directory and download the offered ones. Every browser
+// has to enter the code first, it gets a cookie for the following requests.
+type WebReceiver struct {
+	Directory   string
+	MaxFileSize int64
+	// Downloads returns the files offered to browsers by name, nil
+	// turns downloads off.
+	Downloads func() map[string]string
+	// Upload is called when a browser starts sending a file, the returned
+	// functions get its progress and its outcome.
+	Upload func(client string, name string, size int64) (progress func(p int), done func(file ReceivedFile, err error))
+
+	code   string
+	token  string
+	server *http.Server
+	ln     net.Listener
+}
+
+func NewWebReceiver(ln net.Listener, dir string, code string) (*WebReceiver, error) {
+	code, err := normalizeRelayCode(code)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	w := &WebReceiver{Directory: dir, code: code, token: hex.EncodeToString(b), ln: ln}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", w.serveIndex)
+	mux.HandleFunc("/login", w.serveLogin)
+	mux.HandleFunc("/upload", w.serveUpload)
+	mux.HandleFunc("/download", w.serveDownload)
+	w.server = &http.Server{Handler: mux}
+	return w, nil
+}
+
+// Serve answers browsers until the receiver is closed.
+func (w *WebReceiver) Serve() error {
+	if err := w.server.Serve(w.ln); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (w *WebReceiver) Close() error {
+	return w.server.Close()
+}
+
+func (w *WebReceiver) authorized(r *http.Request) bool {
+	cookie, err := r.Cookie(webCookieName)
+	return err == nil && subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(w.token)) == 1
+}
+
+func (w *WebReceiver) checkCode(code string) bool {
+	normalized, err := normalizeRelayCode(code)
+	if err != nil || subtle.ConstantTimeCompare([]byte(normalized), []byte(w.code)) != 1 {
+		time.Sleep(webLoginDelay)
+		return false
+	}
+	return true
+}
+
+func (w *WebReceiver) authorize(rw http.ResponseWriter) {
+	http.SetCookie(rw, &http.Cookie{
+		Name:     webCookieName,
+		Value:    w.token,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// serveIndex shows the upload page, or asks for the code. A link with the
+// code in the query logs in right away.
+func (w *WebReceiver) serveIndex(rw http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(rw, r)
+		return
+	}
+	if code := r.URL.Query().Get("code"); code != "" && !w.authorized(r) {
+		if w.checkCode(code) {
+			w.authorize(rw)
+			http.Redirect(rw, r, "/", http.StatusSeeOther)
+			return
+		}
+		w.renderPage(rw, http.StatusForbidden, webPage{Error: "Wrong code"})
+		return
+	}
+	if !w.authorized(r) {
+		w.renderPage(rw, http.StatusOK, webPage{})
+		return
+	}
+	page := webPage{Authorized: true}
+	if w.Downloads != nil {
+		for name := range w.Downloads() {
+			page.Downloads = append(page.Downloads, name)
+		}
+		sort.Strings(page.Downloads)
+	}
+	w.renderPage(rw, http.StatusOK, page)
+}
+
+func (w *WebReceiver) serveLogin(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !w.checkCode(r.PostFormValue("code")) {
+		w.renderPage(rw, http.StatusForbidden, webPage{Error: "Wrong code"})
+		return
+	}
+	w.authorize(rw)
+	http.Redirect(rw, r, "/", http.StatusSeeOther)
+}
+
+// serveUpload stores the body of a PUT request as the named file. The page
+// sends a custom header, so other sites can't make browsers upload.
+func (w *WebReceiver) serveUpload(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !w.authorized(r) || r.Header.Get("X-Siphon") == "" {
+		http.Error(rw, "forbidden", http.StatusForbidden)
+		return
+	}
+	name, err := webFileName(r.URL.Query().Get("name"))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	size := r.ContentLength
+	if size < 0 {
+		http.Error(rw, "length required", http.StatusLengthRequired)
+		return
+	}
+	if w.MaxFileSize > 0 && size > w.MaxFileSize {
+		msg := fmt.Sprintf("file is larger than the limit of %s", ByteCountBinary(w.MaxFileSize))
+		http.Error(rw, msg, http.StatusRequestEntityTooLarge)
+		return
+	}
+	if free, err := freeSpace(w.Directory); err == nil && size > free {
+		msg := fmt.Sprintf("not enough disk space, %s free", ByteCountBinary(free))
+		http.Error(rw, msg, http.StatusInsufficientStorage)
+		return
+	}
+
+	client, _, _ := net.SplitHostPort(r.RemoteAddr)
+	log := logger.With("browser", client)
+	target := filepath.Join(w.Directory, name)
+	log.Info("upload file", "file", target, "size", size)
+	progress, done := w.Upload(client, name, size)
+	started := time.Now()
+	target, sum, err := receiveUpload(target, r.Body, size, progress)
+	if err != nil {
+		log.Error("upload failed", "file", name, "error", err)
+		metricFilesReceived.done(resultFailed, size, started)
+		done(ReceivedFile{}, err)
+		http.Error(rw, "upload failed", http.StatusInternalServerError)
+		return
+	}
+	metricFilesReceived.done(resultCompleted, size, started)
+	done(ReceivedFile{Path: target, Name: filepath.Base(target), Size: size, Checksum: sum}, nil)
+	_, _ = io.WriteString(rw, "ok\n")
+}
+
+// receiveUpload writes the body to the target and returns the path it
+// took and its SHA-256, a partial file is removed. An existing file is
+// kept, the upload gets a numbered name next to it.
+func receiveUpload(target string, body io.Reader, size int64, progress func(p int)) (string, []byte, error) {
+	file, err := createUnique(target)
+	if err != nil {
+		return "", nil, errors.New("unable to create file")
+	}
+	target = file.Name()
+	whole := sha256.New()
+	counter := &uploadCounter{size: size, progress: progress, bytes: metricBytesReceived}
+	n, err := io.Copy(io.MultiWriter(file, whole, counter), io.LimitReader(body, size))
+	if err == nil && n != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		//noinspection GoUnhandledErrorResult
+		os.Remove(target)
+		return "", nil, err
+	}
+	if size == 0 {
+		progress(100)
+	}
+	return target, whole.Sum(nil), nil
+}
+
+// createUnique creates the file, or the first of "name (1).ext",
+// "name (2).ext" and so on which doesn't exist yet.
+func createUnique(target string) (*os.File, error) {
+	ext := filepath.Ext(target)
+	base := strings.TrimSuffix(target, ext)
+	name := target
+	for i := 1; ; i++ {
+		file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if !os.IsExist(err) || i > maxUniqueNames {
+			return file, err
+		}
+		name = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+}
+
+// uploadCounter reports the progress of a file going over HTTP and counts
+// its bytes.
+type uploadCounter struct {
+	size     int64
+	total    int64
+	p        int
+	progress func(p int)
+	bytes    *Counter
+}
+
+func (c *uploadCounter) Write(b []byte) (int, error) {
+	c.total += int64(len(b))
+	c.bytes.Add(uint64(len(b)))
+	if p := int(100 * c.total / c.size); p != c.p {
+		c.p = p
+		c.progress(p)
+	}
+	return len(b), nil
+}
+
+func (w *WebReceiver) serveDownload(rw http.ResponseWriter, r *http.Request) {
+	if !w.authorized(r) || w.Downloads == nil {
+		http.Error(rw, "forbidden", http.StatusForbidden)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	path, ok := w.Downloads()[name]
+	if !ok {
+		http.NotFound(rw, r)
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		http.NotFound(rw, r)
+		return
+	}
+	//noinspection GoUnhandledErrorResult
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		http.NotFound(rw, r)
+		return
+	}
+	logger.Info("download file", "file", path, "browser", r.RemoteAddr)
+	rw.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(name)}))
+	http.ServeContent(rw, r, filepath.Base(name), stat.ModTime(), file)
+}
+
+// webFileName checks the name of an uploaded file.
+func webFileName(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00\n") {
+		return "", errors.New("invalid file name")
+	}
+	return name, nil
+}
+
+type webPage struct {
+	Authorized bool
+	Error      string
+	Downloads  []string
+}
+
+func (w *WebReceiver) renderPage(rw http.ResponseWriter, status int, page webPage) {
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.WriteHeader(status)
+	if err := webTemplate.Execute(rw, page); err != nil {
+		logger.Error("unable to render page", "error", err)
+	}
+}
+
+var webTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Siphon</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em; }
+li { margin: 0.3em 0; }
+.error { color: #c01c28; }
+</style>
+</head>
+<body>
+<h1>Siphon</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{if .Authorized}}
+<h2>Send files</h2>
+<input type="file" id="files" multiple>
+<ul id="uploads"></ul>
+{{if .Downloads}}
+<h2>Get files</h2>
+<ul>
+{{range .Downloads}}<li><a href="download?name={{.}}">{{.}}</a></li>
+{{end}}</ul>
+{{end}}
+<script>
+const input = document.getElementById("files");
+const uploads = document.getElementById("uploads");
+function upload(file) {
+  const row = document.createElement("li");
+  row.textContent = file.name + ": waiting";
+  uploads.appendChild(row);
+  return new Promise(resolve => {
+    const request = new XMLHttpRequest();
+    request.open("PUT", "upload?name=" + encodeURIComponent(file.name));
+    request.setRequestHeader("X-Siphon", "1");
+    request.upload.onprogress = e => {
+      row.textContent = file.name + ": " + Math.floor(100 * e.loaded / e.total) + "%";
+    };
+    request.onload = () => {
+      row.textContent = file.name + ": " + (request.status == 200 ? "done" : "failed, " + request.responseText);
+      resolve();
+    };
+    request.onerror = () => {
+      row.textContent = file.name + ": failed";
+      resolve();
+    };
+    request.send(file);
+  });
+}
+input.onchange = async () => {
+  const files = Array.from(input.files);
+  input.value = "";
+  for (const file of files) {
+    await upload(file);
+  }
+};
+</script>
+{{else}}
+<form method="post" action="login">
+<p><label>Code shown by Siphon<br><input name="code" autofocus autocomplete="off"></label></p>
+<p><button type="submit">Continue</button></p>
+</form>
+{{end}}
+</body>
+</html>
+`))